@@ -6,7 +6,8 @@ require (
 	github.com/cespare/xxhash/v2 v2.1.2 // indirect
 	github.com/go-resty/resty/v2 v2.7.0
 	github.com/go-stack/stack v1.8.1 // indirect
-	github.com/gorilla/websocket v1.5.0 // indirect
+	github.com/gorilla/websocket v1.5.0
+	github.com/hyperledger/fabric-protos-go v0.0.0-20200707132912-fee30f3ccd23
 	github.com/hyperledger/fabric-sdk-go v1.0.1-0.20210201220314-86344dc25e5d
 	github.com/kaleido-io/kaleido-sdk-go v0.0.0-20220511131016-b7be7b0fe441
 	github.com/kr/text v0.2.0 // indirect
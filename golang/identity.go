@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/kaleido-io/kaleido-fabric-go/kaleido"
+)
+
+const identityUsage = `Usage: kfg identity <command> [flags] [args]
+
+Commands:
+  list                                        list the identities
+  get <name>                                  show an identity
+  register [flags] <name>                     register an identity and print its enrollment secret
+    -type string                              client, peer or admin (default client)
+    -affiliation string                       the affiliation of the identity
+    -max-enrollments int                      0 for the default of the CA, -1 for unlimited
+    -attrs name=value,...                     the attributes of the identity
+  enroll [flags] <name> <secret>              enroll a registered identity
+    -attrs name,...                           the attributes to add to the certificate
+    -optional-attrs name,...                  the same, without failing if the identity does not have them
+  reenroll [flags] <name>                     renew the certificate of an identity, with the same attribute flags
+  revoke [flags] <name>                       revoke an identity and its certificates
+    -reason string                            the reason of the revocation
+    -gencrl                                   print the CRL
+
+The FabConnect instance is configured with the FABCONNECT_* environment variables`
+
+// identity manages the identities of the FabConnect instance
+func identity(args []string) {
+	if len(args) == 0 {
+		fmt.Println(identityUsage)
+		os.Exit(1)
+	}
+	client, err := kaleido.NewFabconnectClient(kaleido.FabconnectConfigFromEnv(), "")
+	if err == nil {
+		err = runIdentityCommand(client, args[0], args[1:])
+	}
+	if err != nil {
+		fmt.Printf("\nIdentity %s failed: %v\n", args[0], err)
+		os.Exit(1)
+	}
+}
+
+func runIdentityCommand(client *kaleido.FabconnectClient, command string, args []string) error {
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	flags.Usage = func() { fmt.Println(identityUsage) }
+	switch command {
+	case "list":
+		identities, err := client.ListIdentities()
+		if err != nil {
+			return err
+		}
+		return printJSON(identities)
+	case "get":
+		name, err := identityName(flags, args, 1)
+		if err != nil {
+			return err
+		}
+		identity, err := client.GetIdentity(name)
+		if err != nil {
+			return err
+		}
+		if identity == nil {
+			return fmt.Errorf("identity %s not found", name)
+		}
+		return printJSON(identity)
+	case "register":
+		identityType := flags.String("type", kaleido.IDENTITY_TYPE_CLIENT, "")
+		affiliation := flags.String("affiliation", "", "")
+		maxEnrollments := flags.Int("max-enrollments", 0, "")
+		attrs := flags.String("attrs", "", "")
+		name, err := identityName(flags, args, 1)
+		if err != nil {
+			return err
+		}
+		attributes, err := parseAttributes(*attrs)
+		if err != nil {
+			return err
+		}
+		secret, err := client.RegisterIdentity(&kaleido.FabconnectIdentityPayload{
+			Name:           name,
+			Type:           *identityType,
+			Affiliation:    *affiliation,
+			MaxEnrollments: *maxEnrollments,
+			Attributes:     attributes,
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Println(secret)
+		return nil
+	case "enroll", "reenroll":
+		attrs := flags.String("attrs", "", "")
+		optionalAttrs := flags.String("optional-attrs", "", "")
+		argCount := 1
+		if command == "enroll" {
+			argCount = 2
+		}
+		name, err := identityName(flags, args, argCount)
+		if err != nil {
+			return err
+		}
+		attributes := attributeRequests(*attrs, *optionalAttrs)
+		if command == "enroll" {
+			return client.EnrollIdentity(name, flags.Arg(1), attributes)
+		}
+		return client.ReenrollIdentity(name, attributes)
+	case "revoke":
+		reason := flags.String("reason", "", "")
+		genCRL := flags.Bool("gencrl", false, "")
+		name, err := identityName(flags, args, 1)
+		if err != nil {
+			return err
+		}
+		revoked, err := client.RevokeIdentity(name, *reason, *genCRL)
+		if err != nil {
+			return err
+		}
+		return printJSON(revoked)
+	default:
+		fmt.Println(identityUsage)
+		return fmt.Errorf("unknown command %q", command)
+	}
+}
+
+// identityName parses the flags, and returns the name from the arguments that follow them
+func identityName(flags *flag.FlagSet, args []string, argCount int) (string, error) {
+	err := flags.Parse(args)
+	if err != nil {
+		return "", err
+	}
+	if flags.NArg() != argCount {
+		fmt.Println(identityUsage)
+		return "", fmt.Errorf("expected %d argument(s), found %d", argCount, flags.NArg())
+	}
+	return flags.Arg(0), nil
+}
+
+// parseAttributes parses a comma separated list of name=value pairs
+func parseAttributes(attrs string) (map[string]string, error) {
+	if attrs == "" {
+		return nil, nil
+	}
+	attributes := make(map[string]string)
+	for _, attr := range strings.Split(attrs, ",") {
+		parts := strings.SplitN(attr, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("attributes must be name=value pairs. found: %q", attr)
+		}
+		attributes[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return attributes, nil
+}
+
+// attributeRequests maps the names of the attributes to request to whether they are optional
+func attributeRequests(attrs, optionalAttrs string) map[string]bool {
+	requests := make(map[string]bool)
+	for _, list := range []struct {
+		names    string
+		optional bool
+	}{{attrs, false}, {optionalAttrs, true}} {
+		if list.names == "" {
+			continue
+		}
+		for _, name := range strings.Split(list.names, ",") {
+			requests[strings.TrimSpace(name)] = list.optional
+		}
+	}
+	if len(requests) == 0 {
+		return nil
+	}
+	return requests
+}
+
+func printJSON(v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
@@ -1,28 +1,70 @@
 package kaleido
 
 import (
+	"encoding/json"
 	"fmt"
 	"time"
 
+	pb "github.com/hyperledger/fabric-protos-go/peer"
 	"github.com/hyperledger/fabric-sdk-go/pkg/client/channel"
+	"github.com/hyperledger/fabric-sdk-go/pkg/client/event"
 	"github.com/hyperledger/fabric-sdk-go/pkg/common/errors/retry"
+	"github.com/hyperledger/fabric-sdk-go/pkg/common/errors/status"
+	"github.com/hyperledger/fabric-sdk-go/pkg/common/providers/context"
 	"github.com/hyperledger/fabric-sdk-go/pkg/common/providers/fab"
 	"github.com/hyperledger/fabric-sdk-go/pkg/common/providers/msp"
+	"github.com/hyperledger/fabric-sdk-go/pkg/fab/events/deliverclient/seek"
 	"github.com/hyperledger/fabric-sdk-go/pkg/fabsdk"
 	log "github.com/sirupsen/logrus"
 )
 
+// ChannelRetryOpts are the SDK's default channel client retry options, except that
+// MVCC and phantom read conflicts are not retried by the SDK. They are returned to the
+// caller instead, so they can be counted and retried by the application itself
+var ChannelRetryOpts = channelRetryOpts()
+
+var CHECKPOINT_SAVE_TIMEOUT time.Duration = time.Duration(5) * time.Second
+
+func channelRetryOpts() retry.Opts {
+	conflicts := map[status.Code]bool{
+		status.Code(pb.TxValidationCode_MVCC_READ_CONFLICT):    true,
+		status.Code(pb.TxValidationCode_PHANTOM_READ_CONFLICT): true,
+	}
+	retryableCodes := make(map[status.Group][]status.Code)
+	for group, codes := range retry.ChannelClientRetryableCodes {
+		retryableCodes[group] = []status.Code{}
+		for _, code := range codes {
+			if !conflicts[code] {
+				retryableCodes[group] = append(retryableCodes[group], code)
+			}
+		}
+	}
+	opts := retry.DefaultChannelOpts
+	opts.RetryableCodes = retryableCodes
+	return opts
+}
+
 type Channel struct {
 	ChannelID string
 	client    *channel.Client
+	context   context.ChannelProvider
 	sdk       *fabsdk.FabricSDK
-	Start     time.Time
+	// Checkpoints, if set, keeps the position of the events processed, so the subscriptions
+	// resume from there, and the events delivered again are skipped
+	Checkpoints *CheckpointStore
+	// the event clients of the subscriptions resumed from a checkpoint, and when the last
+	// checkpoint of each one has been saved
+	eventClients map[fab.Registration]*event.Client
+	eventsDone   map[fab.Registration]chan struct{}
+	Start        time.Time
 }
 
 func NewChannel(channelId string, sdk *fabsdk.FabricSDK) *Channel {
 	return &Channel{
-		ChannelID: channelId,
-		sdk:       sdk,
+		ChannelID:    channelId,
+		sdk:          sdk,
+		eventClients: make(map[fab.Registration]*event.Client),
+		eventsDone:   make(map[fab.Registration]chan struct{}),
 	}
 }
 
@@ -33,61 +75,156 @@ func (c *Channel) Connect(signer *msp.IdentityIdentifier, orgId string) error {
 		return fmt.Errorf("failed to create channel client. %s", err)
 	}
 	c.client = channelClient
+	c.context = channelContext
 	return nil
 }
 
-func (c *Channel) InitChaincode(channel, chaincodeId string) (string, error) {
-	return c.invokeChaincode(chaincodeId)
+func (c *Channel) InitChaincode(channelId, chaincodeId string) (string, error) {
+	resp, err := c.client.Execute(
+		channel.Request{ChaincodeID: chaincodeId, Fcn: "InitLedger", IsInit: true},
+		channel.WithRetry(retry.DefaultChannelOpts),
+	)
+	if err != nil {
+		return "", fmt.Errorf("failed to send transaction to initialize the chaincode. %s", err)
+	}
+	return string(resp.TransactionID), nil
 }
 
-func (c *Channel) ExecChaincode(channel, chaincodeId, assetId string) (string, error) {
-	return c.invokeChaincode(chaincodeId, assetId)
+func (c *Channel) ExecChaincode(channelId, chaincodeId, function string, args []string) (string, error) {
+	byteArgs := make([][]byte, len(args))
+	for i, arg := range args {
+		byteArgs[i] = []byte(arg)
+	}
+	resp, err := c.client.Execute(
+		channel.Request{ChaincodeID: chaincodeId, Fcn: function, Args: byteArgs},
+		channel.WithRetry(ChannelRetryOpts),
+	)
+	if err != nil {
+		return "", fmt.Errorf("failed to send transaction to invoke the chaincode. %s", err)
+	}
+	return string(resp.TransactionID), nil
+}
+
+func (c *Channel) QueryChaincode(channelId, chaincodeId, function string, args []string) (string, error) {
+	byteArgs := make([][]byte, len(args))
+	for i, arg := range args {
+		byteArgs[i] = []byte(arg)
+	}
+	resp, err := c.client.Query(
+		channel.Request{ChaincodeID: chaincodeId, Fcn: function, Args: byteArgs},
+		channel.WithRetry(retry.DefaultChannelOpts),
+	)
+	if err != nil {
+		return "", fmt.Errorf("failed to query the chaincode. %s", err)
+	}
+	return string(resp.Payload), nil
 }
 
-func (c *Channel) SubscribeEvents(chaincodeId string, done chan string, total int) (fab.Registration, error) {
-	reg, notifier, err := c.client.RegisterChaincodeEvent(chaincodeId, "AssetCreated")
+func (c *Channel) SubscribeEvents(chaincodeId string, assetIdsChan chan string) (fab.Registration, error) {
+	if c.Checkpoints != nil {
+		return c.subscribeEventsFromCheckpoint(chaincodeId, assetIdsChan)
+	}
+
+	// AssetCreated, AssetUpdated, AssetTransferred
+	reg, notifier, err := c.client.RegisterChaincodeEvent(chaincodeId, "Asset.*")
 	if err != nil {
 		return nil, fmt.Errorf("failed to register chaincode event. %s", err)
 	}
 
 	go func() {
-		eventsReceived := 0
 		for event := range notifier {
-			log.Infof("Received chaincode event with tx ID: %s", event.TxID)
-			eventsReceived++
-			if eventsReceived >= total {
-				break
+			c.handleEvent(event, assetIdsChan)
+		}
+	}()
+
+	return reg, nil
+}
+
+// subscribeEventsFromCheckpoint delivers the events from the block of the checkpoint, if
+// any, through an event client of its own. The events of a block are delivered in order, so
+// the position of each one among the events of the chaincode in the block identifies it.
+// The checkpoint is saved once the events of a block are processed, and when unsubscribing
+func (c *Channel) subscribeEventsFromCheckpoint(chaincodeId string, assetIdsChan chan string) (fab.Registration, error) {
+	// the full blocks are needed for the payloads of the events
+	opts := []event.ClientOption{event.WithBlockEvents()}
+	checkpoint := c.Checkpoints.Get(c.ChannelID, chaincodeId)
+	if checkpoint != nil {
+		log.Infof("Resuming the events of chaincode %s on channel %s from block %d", chaincodeId, c.ChannelID, checkpoint.BlockNumber)
+		opts = append(opts, event.WithSeekType(seek.FromBlock), event.WithBlockNum(checkpoint.BlockNumber))
+	}
+	eventClient, err := event.New(c.context, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create event client. %s", err)
+	}
+	reg, notifier, err := eventClient.RegisterChaincodeEvent(chaincodeId, "Asset.*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to register chaincode event. %s", err)
+	}
+	c.eventClients[reg] = eventClient
+	done := make(chan struct{})
+	c.eventsDone[reg] = done
+
+	go func() {
+		defer close(done)
+		var blockNumber uint64
+		index := -1
+		// the position of the last event processed, not saved yet
+		pending := false
+		save := func() {
+			if !pending {
+				return
+			}
+			pending = false
+			err := c.Checkpoints.Save(c.ChannelID, chaincodeId, blockNumber, index)
+			if err != nil {
+				log.Errorf("Failed to save the checkpoint. %v", err)
 			}
 		}
-		done <- "done"
+		for event := range notifier {
+			if event.BlockNumber != blockNumber {
+				save()
+				blockNumber = event.BlockNumber
+				index = -1
+			}
+			index++
+			if c.Checkpoints.Processed(c.ChannelID, chaincodeId, blockNumber, index) {
+				log.Debugf("Dropped event with tx ID %s processed before the checkpoint", event.TxID)
+				continue
+			}
+			c.handleEvent(event, assetIdsChan)
+			pending = true
+		}
+		// the notifier is closed when unsubscribing
+		save()
 	}()
 
 	return reg, nil
 }
 
-func (c *Channel) UnsubscribeEvents(reg fab.Registration) {
-	c.client.UnregisterChaincodeEvent(reg)
+func (c *Channel) handleEvent(event *fab.CCEvent, assetIdsChan chan string) {
+	log.Infof("Received chaincode event with tx ID: %s", event.TxID)
+	var payload EventPayload
+	err := json.Unmarshal(event.Payload, &payload)
+	if err != nil {
+		log.Errorf("Failed to unmarshal event payload for tx ID %s. %v", event.TxID, err)
+		return
+	}
+	assetIdsChan <- payload.AssetId
 }
 
-func (c *Channel) invokeChaincode(chaincodeId string, assetName ...string) (string, error) {
-	var resp channel.Response
-	var err error
-	if len(assetName) == 0 {
-		resp, err = c.client.Execute(
-			channel.Request{ChaincodeID: chaincodeId, Fcn: "InitLedger", IsInit: true},
-			channel.WithRetry(retry.DefaultChannelOpts),
-		)
-		if err != nil {
-			return "", fmt.Errorf("failed to send transaction to initialize the chaincode. %s", err)
-		}
-	} else {
-		resp, err = c.client.Execute(
-			channel.Request{ChaincodeID: chaincodeId, Fcn: "CreateAsset", Args: [][]byte{[]byte(assetName[0]), []byte("yellow"), []byte("10"), []byte("Tom"), []byte("1300")}},
-			channel.WithRetry(retry.DefaultChannelOpts),
-		)
-		if err != nil {
-			return "", fmt.Errorf("failed to send transaction to invoke the chaincode. %s", err)
+func (c *Channel) UnsubscribeEvents(reg fab.Registration) {
+	if eventClient, ok := c.eventClients[reg]; ok {
+		eventClient.Unregister(reg)
+		// the last checkpoint is saved once the notifier is closed, unless the handler is
+		// stuck on a channel no longer read
+		select {
+		case <-c.eventsDone[reg]:
+		case <-time.After(CHECKPOINT_SAVE_TIMEOUT):
+			log.Warnf("Timed out waiting for the last checkpoint to be saved")
 		}
+		delete(c.eventClients, reg)
+		delete(c.eventsDone, reg)
+		return
 	}
-	return string(resp.TransactionID), nil
+	c.client.UnregisterChaincodeEvent(reg)
 }
@@ -0,0 +1,99 @@
+package kaleido
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// Checkpoint is the position of the last event processed from a chaincode on a channel: the
+// block, and the index of the transaction in the block. With the Fabric SDK, the index is
+// the position of the event among the events of the chaincode in the block
+type Checkpoint struct {
+	BlockNumber uint64 `json:"blockNumber"`
+	TxIndex     int    `json:"transactionIndex"`
+}
+
+// CheckpointStore keeps the checkpoint of each chaincode on each channel in a local file, so
+// a consumer can resume from where it stopped after a restart, without missing any event.
+// A nil store keeps no checkpoint
+type CheckpointStore struct {
+	mu          sync.Mutex
+	file        string
+	checkpoints map[string]*Checkpoint
+}
+
+// NewCheckpointStore loads the checkpoints from the file, if it exists
+func NewCheckpointStore(file string) (*CheckpointStore, error) {
+	s := &CheckpointStore{
+		file:        file,
+		checkpoints: make(map[string]*Checkpoint),
+	}
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the checkpoints file %s. %v", file, err)
+	}
+	err = json.Unmarshal(data, &s.checkpoints)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the checkpoints file %s. %v", file, err)
+	}
+	return s, nil
+}
+
+func checkpointKey(channel, chaincodeId string) string {
+	return fmt.Sprintf("%s/%s", channel, chaincodeId)
+}
+
+// Get returns the checkpoint of a chaincode on a channel, or nil if none has been saved
+func (s *CheckpointStore) Get(channel, chaincodeId string) *Checkpoint {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	checkpoint, ok := s.checkpoints[checkpointKey(channel, chaincodeId)]
+	if !ok {
+		return nil
+	}
+	copied := *checkpoint
+	return &copied
+}
+
+// Processed returns whether the event at the position has already been processed, as it is
+// delivered again when resuming from the block of the checkpoint
+func (s *CheckpointStore) Processed(channel, chaincodeId string, blockNumber uint64, txIndex int) bool {
+	checkpoint := s.Get(channel, chaincodeId)
+	if checkpoint == nil {
+		return false
+	}
+	return blockNumber < checkpoint.BlockNumber || (blockNumber == checkpoint.BlockNumber && txIndex <= checkpoint.TxIndex)
+}
+
+// Save records the position of the last event processed, and writes all the checkpoints to
+// the file, replacing it at once so a crash does not leave it half written
+func (s *CheckpointStore) Save(channel, chaincodeId string, blockNumber uint64, txIndex int) error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.checkpoints[checkpointKey(channel, chaincodeId)] = &Checkpoint{BlockNumber: blockNumber, TxIndex: txIndex}
+	data, err := json.MarshalIndent(s.checkpoints, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal the checkpoints. %v", err)
+	}
+	tmpFile := s.file + ".tmp"
+	err = ioutil.WriteFile(tmpFile, data, 0644)
+	if err == nil {
+		err = os.Rename(tmpFile, s.file)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write the checkpoints file %s. %v", s.file, err)
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package kaleido
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckpointStoreProcessed(t *testing.T) {
+	store, err := NewCheckpointStore(filepath.Join(t.TempDir(), "checkpoints.json"))
+	if err != nil {
+		t.Fatalf("unexpected error. %v", err)
+	}
+	err = store.Save("ch1", "cc1", 10, 3)
+	if err != nil {
+		t.Fatalf("unexpected error. %v", err)
+	}
+	cases := []struct {
+		name        string
+		channel     string
+		chaincodeId string
+		blockNumber uint64
+		txIndex     int
+		processed   bool
+	}{
+		{"earlier block", "ch1", "cc1", 9, 7, true},
+		{"earlier transaction in the block", "ch1", "cc1", 10, 2, true},
+		{"checkpoint", "ch1", "cc1", 10, 3, true},
+		{"later transaction in the block", "ch1", "cc1", 10, 4, false},
+		{"later block", "ch1", "cc1", 11, 0, false},
+		{"other chaincode", "ch1", "cc2", 1, 0, false},
+		{"other channel", "ch2", "cc1", 1, 0, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if processed := store.Processed(c.channel, c.chaincodeId, c.blockNumber, c.txIndex); processed != c.processed {
+				t.Errorf("expected processed to be %v. found: %v", c.processed, processed)
+			}
+		})
+	}
+}
+
+func TestCheckpointStoreSave(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "checkpoints.json")
+	store, err := NewCheckpointStore(file)
+	if err != nil {
+		t.Fatalf("unexpected error. %v", err)
+	}
+	if store.Get("ch1", "cc1") != nil {
+		t.Fatalf("expected no checkpoint before the file exists")
+	}
+	for _, pos := range []Checkpoint{{5, 0}, {7, 2}} {
+		err = store.Save("ch1", "cc1", pos.BlockNumber, pos.TxIndex)
+		if err != nil {
+			t.Fatalf("unexpected error. %v", err)
+		}
+	}
+	err = store.Save("ch2", "cc1", 3, 1)
+	if err != nil {
+		t.Fatalf("unexpected error. %v", err)
+	}
+	if _, err := os.Stat(file + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("expected the temporary file to be renamed. %v", err)
+	}
+
+	reloaded, err := NewCheckpointStore(file)
+	if err != nil {
+		t.Fatalf("unexpected error. %v", err)
+	}
+	if cp := reloaded.Get("ch1", "cc1"); cp == nil || *cp != (Checkpoint{7, 2}) {
+		t.Errorf("expected the last checkpoint of cc1 on ch1 to be reloaded. found: %v", cp)
+	}
+	if cp := reloaded.Get("ch2", "cc1"); cp == nil || *cp != (Checkpoint{3, 1}) {
+		t.Errorf("expected the checkpoint of cc1 on ch2 to be reloaded. found: %v", cp)
+	}
+
+	// the checkpoint returned is a copy
+	reloaded.Get("ch1", "cc1").BlockNumber = 100
+	if cp := reloaded.Get("ch1", "cc1"); cp.BlockNumber != 7 {
+		t.Errorf("expected the checkpoint not to be changed by the caller. found: %v", cp)
+	}
+}
+
+func TestCheckpointStoreInvalidFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "checkpoints.json")
+	err := ioutil.WriteFile(file, []byte("not json"), 0644)
+	if err != nil {
+		t.Fatalf("unexpected error. %v", err)
+	}
+	_, err = NewCheckpointStore(file)
+	if err == nil {
+		t.Errorf("expected an invalid checkpoints file to be rejected")
+	}
+}
+
+func TestCheckpointStoreSaveFails(t *testing.T) {
+	store, err := NewCheckpointStore(filepath.Join(t.TempDir(), "missing", "checkpoints.json"))
+	if err != nil {
+		t.Fatalf("unexpected error. %v", err)
+	}
+	err = store.Save("ch1", "cc1", 1, 0)
+	if err == nil {
+		t.Errorf("expected the checkpoints to fail to be written to a missing directory")
+	}
+}
+
+func TestNilCheckpointStore(t *testing.T) {
+	var store *CheckpointStore
+	if store.Get("ch1", "cc1") != nil {
+		t.Errorf("expected no checkpoint")
+	}
+	if store.Processed("ch1", "cc1", 0, 0) {
+		t.Errorf("expected no event to be processed")
+	}
+	if err := store.Save("ch1", "cc1", 1, 0); err != nil {
+		t.Errorf("unexpected error. %v", err)
+	}
+}
@@ -0,0 +1,427 @@
+package kaleido
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// the types of event stream
+const (
+	EVENT_STREAM_WEBSOCKET = "websocket"
+	EVENT_STREAM_WEBHOOK   = "webhook"
+)
+
+type FabConnectEventStreamPostPayload struct {
+	Name      string         `json:"name,omitempty"`
+	Type      string         `json:"type,omitempty"`
+	BatchSize int            `json:"batchSize,omitempty"`
+	WebSocket *WebSocketSpec `json:"websocket,omitempty"`
+	Webhook   *WebhookSpec   `json:"webhook,omitempty"`
+}
+
+type WebSocketSpec struct {
+	Topic string `json:"topic,omitempty"`
+}
+
+type FabConnectEventStream struct {
+	ID        string         `json:"id,omitempty"`
+	Name      string         `json:"name,omitempty"`
+	Type      string         `json:"type,omitempty"`
+	BatchSize int            `json:"batchSize,omitempty"`
+	Suspended bool           `json:"suspended,omitempty"`
+	WebSocket *WebSocketSpec `json:"websocket,omitempty"`
+	Webhook   *WebhookSpec   `json:"webhook,omitempty"`
+}
+
+type FabConnectSubscriptionPostPayload struct {
+	ID          string     `json:"id,omitempty"`
+	StreamId    string     `json:"stream,omitempty"`
+	Channel     string     `json:"channel,omitempty"`
+	Name        string     `json:"name,omitempty"`
+	Signer      string     `json:"signer,omitempty"`
+	FromBlock   string     `json:"fromBlock,omitempty"`
+	PayloadType string     `json:"payloadType,omitempty"`
+	Filter      FilterSpec `json:"filter,omitempty"`
+}
+
+type FilterSpec struct {
+	ChaincodeId string `json:"chaincodeId,omitempty"`
+}
+
+// subscriptionTarget is the channel and chaincode of a subscription, and how it delivers
+// the payload of the events
+type subscriptionTarget struct {
+	channel     string
+	chaincodeId string
+	payloadType string
+}
+
+// subscriptionOf returns the target of the subscription that delivered the
+// event, if it has been created or reused by this client
+func (f *FabconnectClient) subscriptionOf(event *Event) (subscriptionTarget, bool) {
+	target, ok := f.subscriptions.Load(event.SubscriptionId)
+	if !ok {
+		return subscriptionTarget{}, false
+	}
+	return target.(subscriptionTarget), true
+}
+
+func (f *FabconnectClient) CreateEventListener(channel, chaincodeId string) (string, error) {
+	streamId, err := f.EnsureEventStream()
+	if err != nil {
+		return "", err
+	}
+	_, err = f.EnsureSubscription(streamId, channel, chaincodeId)
+	if err != nil {
+		return "", err
+	}
+	return streamId, nil
+}
+
+// EnsureEventStream returns the ID of the event stream named after EventStreamName. An existing
+// stream is updated to the topic or webhook and batch size of the client, and resumed if it is
+// suspended. A stream of the other type is replaced, as the type cannot be updated
+func (f *FabconnectClient) EnsureEventStream() (string, error) {
+	streams, err := f.ListEventStreams()
+	if err != nil {
+		return "", err
+	}
+	spec, err := f.eventStreamSpec()
+	if err != nil {
+		return "", err
+	}
+	for _, stream := range streams {
+		if stream.Name != spec.Name {
+			continue
+		}
+		if stream.Type != spec.Type {
+			log.Infof("Replacing %s event stream %s: %s", stream.Type, spec.Name, stream.ID)
+			err = f.DeleteEventStream(stream.ID)
+			if err != nil {
+				return "", err
+			}
+			continue
+		}
+		if stream.BatchSize != spec.BatchSize || !reflect.DeepEqual(stream.WebSocket, spec.WebSocket) || !reflect.DeepEqual(stream.Webhook, spec.Webhook) {
+			_, err = f.UpdateEventStream(stream.ID, spec)
+			if err != nil {
+				return "", err
+			}
+			log.Infof("Updated event stream %s: %s", spec.Name, stream.ID)
+		}
+		if stream.Suspended {
+			err = f.ResumeEventStream(stream.ID)
+			if err != nil {
+				return "", err
+			}
+		}
+		log.Infof("Using existing event stream %s: %s", spec.Name, stream.ID)
+		return stream.ID, nil
+	}
+	return f.CreateEventStream()
+}
+
+// CreateEventStream creates the event stream the subscriptions deliver their events to, a
+// webhook one if the client has a Webhook, or else a websocket one
+func (f *FabconnectClient) CreateEventStream() (string, error) {
+	spec, err := f.eventStreamSpec()
+	if err != nil {
+		return "", err
+	}
+	var stream FabConnectEventStream
+	err = f.call("POST", "/eventstreams", spec, &stream)
+	if err != nil {
+		log.Errorf("Failed to create event stream. %v", err)
+		return "", err
+	}
+	log.Infof("Created %s event stream: %s", spec.Type, stream.ID)
+	return stream.ID, nil
+}
+
+func (f *FabconnectClient) eventStreamSpec() (*FabConnectEventStreamPostPayload, error) {
+	if f.EventBatchSize == 0 {
+		f.EventBatchSize = 1
+	}
+	spec := &FabConnectEventStreamPostPayload{
+		Name:      f.EventStreamName,
+		BatchSize: f.EventBatchSize,
+	}
+	if f.Webhook == nil {
+		spec.Type = EVENT_STREAM_WEBSOCKET
+		spec.WebSocket = &WebSocketSpec{
+			Topic: f.Topic,
+		}
+		return spec, nil
+	}
+	webhook, err := f.Webhook.spec()
+	if err != nil {
+		return nil, err
+	}
+	spec.Type = EVENT_STREAM_WEBHOOK
+	spec.Webhook = webhook
+	return spec, nil
+}
+
+func (f *FabconnectClient) ListEventStreams() ([]*FabConnectEventStream, error) {
+	streams := []*FabConnectEventStream{}
+	err := f.call("GET", "/eventstreams", nil, &streams)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list event streams. %v", err)
+	}
+	return streams, nil
+}
+
+func (f *FabconnectClient) GetEventStream(streamId string) (*FabConnectEventStream, error) {
+	var stream FabConnectEventStream
+	err := f.call("GET", fmt.Sprintf("/eventstreams/%s", streamId), nil, &stream)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get event stream %s. %v", streamId, err)
+	}
+	return &stream, nil
+}
+
+func (f *FabconnectClient) UpdateEventStream(streamId string, spec *FabConnectEventStreamPostPayload) (*FabConnectEventStream, error) {
+	var stream FabConnectEventStream
+	err := f.call("PATCH", fmt.Sprintf("/eventstreams/%s", streamId), spec, &stream)
+	if err != nil {
+		return nil, fmt.Errorf("failed to update event stream %s. %v", streamId, err)
+	}
+	return &stream, nil
+}
+
+// DeleteEventStream deletes the event stream along with its subscriptions
+func (f *FabconnectClient) DeleteEventStream(streamId string) error {
+	err := f.call("DELETE", fmt.Sprintf("/eventstreams/%s", streamId), nil, nil)
+	if err != nil {
+		return fmt.Errorf("failed to delete event stream %s. %v", streamId, err)
+	}
+	return nil
+}
+
+// SuspendEventStream stops the delivery of the events, which resumes from where it stopped
+func (f *FabconnectClient) SuspendEventStream(streamId string) error {
+	err := f.call("POST", fmt.Sprintf("/eventstreams/%s/suspend", streamId), nil, nil)
+	if err != nil {
+		return fmt.Errorf("failed to suspend event stream %s. %v", streamId, err)
+	}
+	log.Infof("Suspended event stream: %s", streamId)
+	return nil
+}
+
+func (f *FabconnectClient) ResumeEventStream(streamId string) error {
+	err := f.call("POST", fmt.Sprintf("/eventstreams/%s/resume", streamId), nil, nil)
+	if err != nil {
+		return fmt.Errorf("failed to resume event stream %s. %v", streamId, err)
+	}
+	log.Infof("Resumed event stream: %s", streamId)
+	return nil
+}
+
+// EnsureSubscription returns the ID of the subscription of the event stream to the events of a
+// chaincode on a channel. An existing subscription is kept, and continues from its checkpoint,
+// unless it has other settings, as subscriptions cannot be updated
+func (f *FabconnectClient) EnsureSubscription(streamId, channel, chaincodeId string) (string, error) {
+	subscriptions, err := f.ListSubscriptions()
+	if err != nil {
+		return "", err
+	}
+	name := subscriptionName(channel, chaincodeId)
+	for _, sub := range subscriptions {
+		if sub.Name != name || sub.StreamId != streamId {
+			continue
+		}
+		if sub.Channel == channel && sub.Filter.ChaincodeId == chaincodeId && sub.PayloadType == f.PayloadType {
+			log.Infof("Using existing subscription %s: %s", name, sub.ID)
+			f.subscriptions.Store(sub.ID, subscriptionTarget{channel, chaincodeId, sub.PayloadType})
+			return sub.ID, nil
+		}
+		log.Infof("Replacing subscription %s: %s", name, sub.ID)
+		err = f.DeleteSubscription(sub.ID)
+		if err != nil {
+			return "", err
+		}
+	}
+	return f.CreateSubscription(streamId, channel, chaincodeId)
+}
+
+func subscriptionName(channel, chaincodeId string) string {
+	return fmt.Sprintf("fabconnect-perf-subscription-%s-%s", channel, chaincodeId)
+}
+
+// CreateSubscription subscribes the event stream to the events of a chaincode on a channel,
+// from the block of its checkpoint if any, or else the current block height, and returns
+// the ID of the subscription
+func (f *FabconnectClient) CreateSubscription(streamId, channel, chaincodeId string) (string, error) {
+	fromBlock, err := f.subscriptionStart(channel, chaincodeId)
+	if err != nil {
+		return "", err
+	}
+
+	subscriptionBody := FabConnectSubscriptionPostPayload{
+		StreamId:    streamId,
+		Channel:     channel,
+		Name:        subscriptionName(channel, chaincodeId),
+		Signer:      f.username,
+		FromBlock:   fromBlock,
+		PayloadType: f.PayloadType,
+		Filter: FilterSpec{
+			ChaincodeId: chaincodeId,
+		},
+	}
+	subResult := FabConnectSubscriptionPostPayload{}
+	err = f.call("POST", "/subscriptions", subscriptionBody, &subResult)
+	if err != nil {
+		return "", fmt.Errorf("failed to create subscription. %v", err)
+	}
+	log.Infof("Subscribed to the events of chaincode %s on channel %s from block %s: %s", chaincodeId, channel, fromBlock, subResult.ID)
+	f.subscriptions.Store(subResult.ID, subscriptionTarget{channel, chaincodeId, subscriptionBody.PayloadType})
+
+	return subResult.ID, nil
+}
+
+// subscriptionStart returns the block a new subscription starts from: the block of the
+// checkpoint, as its events after the checkpoint have not been processed yet, or else the
+// current block height
+func (f *FabconnectClient) subscriptionStart(channel, chaincodeId string) (string, error) {
+	checkpoint := f.Checkpoints.Get(channel, chaincodeId)
+	if checkpoint != nil {
+		return strconv.FormatUint(checkpoint.BlockNumber, 10), nil
+	}
+
+	chainInfo, err := f.GetChainInfo(channel)
+	if err != nil {
+		log.Errorf("Failed to get chain info. %v", err)
+		return "", err
+	}
+	return strconv.Itoa(chainInfo.Height), nil
+}
+
+func (f *FabconnectClient) ListSubscriptions() ([]*FabConnectSubscriptionPostPayload, error) {
+	subscriptions := []*FabConnectSubscriptionPostPayload{}
+	err := f.call("GET", "/subscriptions", nil, &subscriptions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list subscriptions. %v", err)
+	}
+	return subscriptions, nil
+}
+
+func (f *FabconnectClient) GetSubscription(subscriptionId string) (*FabConnectSubscriptionPostPayload, error) {
+	var subscription FabConnectSubscriptionPostPayload
+	err := f.call("GET", fmt.Sprintf("/subscriptions/%s", subscriptionId), nil, &subscription)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get subscription %s. %v", subscriptionId, err)
+	}
+	return &subscription, nil
+}
+
+func (f *FabconnectClient) DeleteSubscription(subscriptionId string) error {
+	err := f.call("DELETE", fmt.Sprintf("/subscriptions/%s", subscriptionId), nil, nil)
+	if err != nil {
+		return fmt.Errorf("failed to delete subscription %s. %v", subscriptionId, err)
+	}
+	return nil
+}
+
+// SuspendSubscription stops the delivery of the events of the subscription, which resumes
+// from where it stopped, while the other subscriptions of the stream keep delivering
+func (f *FabconnectClient) SuspendSubscription(subscriptionId string) error {
+	err := f.call("POST", fmt.Sprintf("/subscriptions/%s/suspend", subscriptionId), nil, nil)
+	if err != nil {
+		return fmt.Errorf("failed to suspend subscription %s. %v", subscriptionId, err)
+	}
+	log.Infof("Suspended subscription: %s", subscriptionId)
+	return nil
+}
+
+func (f *FabconnectClient) ResumeSubscription(subscriptionId string) error {
+	err := f.call("POST", fmt.Sprintf("/subscriptions/%s/resume", subscriptionId), nil, nil)
+	if err != nil {
+		return fmt.Errorf("failed to resume subscription %s. %v", subscriptionId, err)
+	}
+	log.Infof("Resumed subscription: %s", subscriptionId)
+	return nil
+}
+
+// ResetSubscription moves the checkpoint of the subscription, so its events are delivered
+// again from the block, or from the newest one with "newest"
+func (f *FabconnectClient) ResetSubscription(subscriptionId, fromBlock string) error {
+	body := map[string]string{"fromBlock": fromBlock}
+	err := f.call("POST", fmt.Sprintf("/subscriptions/%s/reset", subscriptionId), body, nil)
+	if err != nil {
+		return fmt.Errorf("failed to reset subscription %s. %v", subscriptionId, err)
+	}
+	return nil
+}
+
+// WaitForSubscription polls FabConnect until the subscription is registered on the event
+// stream and the stream is not suspended, or the timeout expires. It does not tell whether
+// the events are delivered yet, which only the event of a transaction sent after can
+func (f *FabconnectClient) WaitForSubscription(streamId, subscriptionId string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		reason := f.subscriptionStatus(streamId, subscriptionId)
+		if reason == "" {
+			log.Infof("Subscription %s is registered on event stream %s", subscriptionId, streamId)
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("subscription %s not registered after %s. %s", subscriptionId, timeout, reason)
+		}
+		log.Debugf("Waiting for subscription %s. %s", subscriptionId, reason)
+		time.Sleep(SUBSCRIPTION_POLL_INTERVAL)
+	}
+}
+
+// subscriptionStatus returns why the subscription is not registered yet, or an empty string if it is
+func (f *FabconnectClient) subscriptionStatus(streamId, subscriptionId string) string {
+	subscription, err := f.GetSubscription(subscriptionId)
+	if err != nil {
+		return err.Error()
+	}
+	if subscription.StreamId != streamId {
+		return fmt.Sprintf("the subscription is on event stream %q", subscription.StreamId)
+	}
+
+	stream, err := f.GetEventStream(streamId)
+	if err != nil {
+		return err.Error()
+	}
+	if stream.Suspended {
+		return "the event stream is suspended"
+	}
+	return ""
+}
+
+func (f *FabconnectClient) CleanupEventListener(eventStreamId string) error {
+	log.Infof("Cleaning up event stream: %s", eventStreamId)
+	err := f.DeleteEventStream(eventStreamId)
+	if err != nil {
+		log.Errorf("%v", err)
+		return err
+	}
+
+	return nil
+}
+
+// call sends a request to the FabConnect API, and fails if the response is not successful
+func (f *FabconnectClient) call(method, path string, body, result interface{}) error {
+	req := f.r.R()
+	if body != nil {
+		req.SetBody(body)
+	}
+	if result != nil {
+		req.SetResult(result)
+	}
+	resp, err := req.Execute(method, path)
+	if err != nil {
+		return err
+	}
+	if resp.IsError() {
+		return newFabconnectError(resp)
+	}
+	return nil
+}
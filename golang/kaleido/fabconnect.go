@@ -1,10 +1,18 @@
 package kaleido
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
 	"os"
-	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-resty/resty/v2"
@@ -12,22 +20,26 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-type FabconnectIdentity struct {
-	Name           string `json:"name,omitempty"`
-	EnrollmentCert string `json:"enrollmentCert,omitempty"`
-	Secret         string `json:"secret,omitempty"`
+// FabconnectConfig is how to connect to FabConnect, for both the REST API and the websocket
+// the events are delivered on. The websocket URL is derived from the REST URL if not set
+type FabconnectConfig struct {
+	URL          string `yaml:"url,omitempty" json:"url,omitempty"`
+	WebSocketURL string `yaml:"webSocketUrl,omitempty" json:"webSocketUrl,omitempty"`
+	CACert       string `yaml:"caCert,omitempty" json:"caCert,omitempty"`
+	ClientCert   string `yaml:"clientCert,omitempty" json:"clientCert,omitempty"`
+	ClientKey    string `yaml:"clientKey,omitempty" json:"clientKey,omitempty"`
+	// how the rejected requests are retried, the default policy if not set
+	Retry *RetryPolicy `yaml:"retry,omitempty" json:"retry,omitempty"`
 }
 
-type FabconnectIdentityPayload struct {
-	Name           string                 `json:"name,omitempty"`
-	Type           string                 `json:"type,omitempty"`
-	MaxEnrollments int                    `json:"maxEnrollments,omitempty"`
-	Attributes     map[string]interface{} `json:"attributes,omitempty"`
-}
-
-type FabconnectEnrollIdentityPayload struct {
-	Secret     string                 `json:"secret,omitempty"`
-	Attributes map[string]interface{} `json:"attributes,omitempty"`
+func FabconnectConfigFromEnv() FabconnectConfig {
+	return FabconnectConfig{
+		URL:          os.Getenv("FABCONNECT_URL"),
+		WebSocketURL: os.Getenv("FABCONNECT_WS_URL"),
+		CACert:       os.Getenv("FABCONNECT_CA_CERT"),
+		ClientCert:   os.Getenv("FABCONNECT_CLIENT_CERT"),
+		ClientKey:    os.Getenv("FABCONNECT_CLIENT_KEY"),
+	}
 }
 
 type FabconnectTransactionPayloadHeaders struct {
@@ -44,167 +56,285 @@ type FabconnectTransactionPayload struct {
 	Init    bool                                `json:"init,omitempty"`
 }
 
-type FabconnectTransactionConfirmation struct {
-	Sent bool   `json:"sent,omitempty"`
-	Id   string `json:"id,omitempty"`
+type FabconnectQueryPayload struct {
+	Headers FabconnectTransactionPayloadHeaders `json:"headers,omitempty"`
+	Func    string                              `json:"func,omitempty"`
+	Args    []string                            `json:"args,omitempty"`
 }
 
-type FabconnectTransactionReceiptHeaders struct {
-	TimeElapsed float64 `json:"timeElapsed,omitempty"`
-	Type        string  `json:"type,omitempty"`
+type FabconnectQueryResponse struct {
+	Result json.RawMessage `json:"result,omitempty"`
 }
 
-type FabconnectTransactionReceipt struct {
-	Id      string                              `json:"_id,omitempty"`
-	Headers FabconnectTransactionReceiptHeaders `json:"headers,omitempty"`
-	Status  string                              `json:"status,omitempty"`
+type FabconnectTransactionConfirmation struct {
+	Sent bool   `json:"sent,omitempty"`
+	Id   string `json:"id,omitempty"`
 }
 
-type FabConnectEventStreamPostPayload struct {
-	Name      string        `json:"name,omitempty"`
-	Type      string        `json:"type,omitempty"`
-	BatchSize int           `json:"batchSize,omitempty"`
-	WebSocket WebSocketSpec `json:"websocket,omitempty"`
+// Event is a chaincode event delivered by an event stream. The payload is kept as delivered,
+// encoded according to the payload type of the subscription
+type Event struct {
+	ChaincodeId    string          `json:"chaincodeId"`
+	BlockNumber    uint64          `json:"blockNumber"`
+	TxId           string          `json:"transactionId"`
+	TxIndex        int             `json:"transactionIndex"`
+	EventIndex     int             `json:"eventIndex"`
+	EventName      string          `json:"eventName"`
+	Timestamp      int64           `json:"timestamp,omitempty"`
+	SubscriptionId string          `json:"subId,omitempty"`
+	Payload        json.RawMessage `json:"payload"`
+	PayloadType    string          `json:"-"`
 }
 
-type WebSocketSpec struct {
-	Topic string `json:"topic,omitempty"`
-}
+// EventHandler is called for each event received, in the order of the stream
+type EventHandler func(event *Event)
 
-type FabConnectEventStreamPostResponse struct {
-	ID string `json:"id,omitempty"`
+// EventPayload is the JSON payload of the events of the asset_transfer chaincode
+type EventPayload struct {
+	AssetId string `json:"ID"`
 }
 
-type FabConnectSubscriptionPostPayload struct {
-	StreamId    string     `json:"stream,omitempty"`
-	Channel     string     `json:"channel,omitempty"`
-	Name        string     `json:"name,omitempty"`
-	Signer      string     `json:"signer,omitempty"`
-	FromBlock   string     `json:"fromBlock,omitempty"`
-	PayloadType string     `json:"payloadType,omitempty"`
-	Filter      FilterSpec `json:"filter,omitempty"`
+// PayloadBytes returns the payload as emitted by the chaincode: a JSON payload as is, a
+// string payload unquoted, and a bytes payload decoded from base64
+func (e *Event) PayloadBytes() ([]byte, error) {
+	switch e.PayloadType {
+	case PAYLOAD_TYPE_STRING:
+		var str string
+		err := json.Unmarshal(e.Payload, &str)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode the string payload. %v", err)
+		}
+		return []byte(str), nil
+	case PAYLOAD_TYPE_BYTES:
+		var encoded string
+		err := json.Unmarshal(e.Payload, &encoded)
+		if err == nil {
+			var decoded []byte
+			decoded, err = base64.StdEncoding.DecodeString(encoded)
+			if err == nil {
+				return decoded, nil
+			}
+		}
+		return nil, fmt.Errorf("failed to decode the bytes payload. %v", err)
+	default:
+		return e.Payload, nil
+	}
 }
 
-type FilterSpec struct {
-	ChaincodeId string `json:"chaincodeId,omitempty"`
+// DecodePayload unmarshals the payload, emitted by the chaincode as JSON, into v
+func (e *Event) DecodePayload(v interface{}) error {
+	payload, err := e.PayloadBytes()
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(payload, v)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal the payload of event %s in transaction %s. %v", e.EventName, e.TxId, err)
+	}
+	return nil
 }
 
-type Event struct {
-	ChaincodeId string       `json:"chaincodeId"`
-	BlockNumber uint64       `json:"blockNumber"`
-	TxId        string       `json:"transactionId"`
-	TxIndex     int          `json:"transactionIndex"`
-	EventIndex  int          `json:"eventIndex"`
-	EventName   string       `json:"eventName"`
-	Payload     EventPayload `json:"payload"`
+type ErrorMessage struct {
+	Message string `json:"error"`
 }
 
-type EventPayload struct {
-	AssetId string `json:"ID"`
+// FabconnectError is an error status returned by FabConnect, with the message of the body if any
+type FabconnectError struct {
+	StatusCode int
+	Message    string
+	Body       string
 }
 
-type ChainInfoResponse struct {
-	Result ChainInfo `json:"result"`
+func newFabconnectError(resp *resty.Response) *FabconnectError {
+	var errMsg ErrorMessage
+	_ = json.Unmarshal(resp.Body(), &errMsg)
+	return &FabconnectError{
+		StatusCode: resp.StatusCode(),
+		Message:    errMsg.Message,
+		Body:       resp.String(),
+	}
 }
 
-type ChainInfo struct {
-	Height int `json:"height"`
+func (e *FabconnectError) Error() string {
+	return fmt.Sprintf("[%d] %s", e.StatusCode, e.Body)
 }
 
-type ErrorMessage struct {
-	Message string `json:"error"`
-}
+const (
+	EVENT_LISTENER_TOPIC      = "fabconnect-perf-topic-1"
+	DEFAULT_EVENT_STREAM_NAME = "fabconnect-perf-1"
+	RECEIPT_SUCCESS           = "TransactionSuccess"
+)
 
+// how the subscriptions deliver the payload of the events
 const (
-	EVENT_LISTENER_TOPIC = "fabconnect-perf-topic-1"
+	PAYLOAD_TYPE_JSON   = "json"
+	PAYLOAD_TYPE_STRING = "string"
+	PAYLOAD_TYPE_BYTES  = "bytes"
 )
 
+// the receipts are polled at growing intervals, starting short so the latency measured
+// by polling stays close to the one measured with the events
+var RECEIPT_POLL_INTERVAL time.Duration = time.Duration(100) * time.Millisecond
+var RECEIPT_POLL_MAX_INTERVAL time.Duration = time.Duration(1) * time.Second
+var SUBSCRIPTION_POLL_INTERVAL time.Duration = time.Duration(500) * time.Millisecond
+var WEBSOCKET_RECONNECT_INTERVAL time.Duration = time.Duration(500) * time.Millisecond
+var WEBSOCKET_RECONNECT_MAX_INTERVAL time.Duration = time.Duration(30) * time.Second
+
+// the number of events remembered to drop the ones delivered again. FabConnect delivers again
+// the batches that were not acked, so this must be more than the events of the batches in flight
+var SEEN_EVENTS_CAPACITY = 10000
+
 type FabconnectClient struct {
 	r              *resty.Client
-	ws             *websocket.Conn
+	events         *eventClient
+	wsURL          string
+	wsHeader       http.Header
+	wsDialer       *websocket.Dialer
 	username       string
 	EventBatchSize int
-	Start          time.Time
+	// the name and websocket topic of the event stream, so several clients can each have their own
+	EventStreamName string
+	Topic           string
+	// the payload type of the subscriptions created by the client
+	PayloadType string
+	// Webhook, if set, has the events delivered by FabConnect to a receiver started by the
+	// client, instead of the websocket
+	Webhook *WebhookConfig
+	// Checkpoints, if set, keeps the position of the events processed, so the subscriptions
+	// created by the client start from there, and the events delivered again are skipped
+	Checkpoints *CheckpointStore
+	// the channel and chaincode of the subscriptions, by ID
+	subscriptions *sync.Map
+	// the number of requests retried, shared with the clients of the other signers
+	retries *int64
+	Start   time.Time
 }
 
-func NewFabconnectClient(fabconnectUrl, username string) (*FabconnectClient, error) {
-	r := resty.New().SetBaseURL(fabconnectUrl).SetRetryCount(10).AddRetryCondition(func(r *resty.Response, err error) bool {
-		if r.StatusCode() > 202 {
-			var errMsg ErrorMessage
-			err1 := json.Unmarshal(r.Body(), &errMsg)
-			if err1 == nil && errMsg.Message == "Too many in-flight transactions" {
-				return true
-			}
-		}
-		return false
-	})
-	conn, _, err := websocket.DefaultDialer.Dial("ws://localhost:3001/ws", nil)
+func NewFabconnectClient(config FabconnectConfig, username string) (*FabconnectClient, error) {
+	tlsConfig, err := config.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	wsURL, wsHeader, err := config.webSocketEndpoint()
 	if err != nil {
-		log.Errorf("Failed to connect to websocket. %v", err)
 		return nil, err
 	}
 
+	retryPolicy, err := config.Retry.resolve()
+	if err != nil {
+		return nil, err
+	}
+
+	r := resty.New().SetBaseURL(config.URL)
+	retries := new(int64)
+	retryPolicy.apply(r, retries)
+	if tlsConfig != nil {
+		r.SetTLSClientConfig(tlsConfig)
+	}
+
+	dialer := *websocket.DefaultDialer
+	dialer.TLSClientConfig = tlsConfig
+
 	return &FabconnectClient{
-		r:        r,
-		ws:       conn,
-		username: username,
-		Start:    time.Now(),
+		r:               r,
+		wsURL:           wsURL,
+		wsHeader:        wsHeader,
+		wsDialer:        &dialer,
+		username:        username,
+		EventStreamName: DEFAULT_EVENT_STREAM_NAME,
+		Topic:           EVENT_LISTENER_TOPIC,
+		PayloadType:     PAYLOAD_TYPE_JSON,
+		subscriptions:   &sync.Map{},
+		retries:         retries,
+		Start:           time.Now(),
 	}, nil
 }
 
-func (f *FabconnectClient) EnsureIdentity() error {
-	log.Infof("Checking if identity exists: %s", f.username)
-	var identity FabconnectIdentity
-	getIdentity, err := f.r.R().SetResult(&identity).Get(fmt.Sprintf("/identities/%s", f.username))
-	if err != nil {
-		log.Errorf("Failed to get identity. %v", err)
-		return err
+// tlsConfig loads the CA bundle to trust in addition to the system ones, and the client
+// certificate for mutual TLS. It returns nil if neither is configured
+func (c *FabconnectConfig) tlsConfig() (*tls.Config, error) {
+	if c.CACert == "" && c.ClientCert == "" && c.ClientKey == "" {
+		return nil, nil
 	}
-
-	if getIdentity.StatusCode() == 500 {
-		log.Errorf("Error getting identity. %v", getIdentity.String())
-		log.Infof("Creating identity: %s", f.username)
-
-		identityPayload := FabconnectIdentityPayload{
-			Name:           f.username,
-			Type:           "client",
-			MaxEnrollments: 0,
-			Attributes:     make(map[string]interface{}),
+	tlsConfig := &tls.Config{}
+	if c.CACert != "" {
+		pem, err := ioutil.ReadFile(c.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the FabConnect CA bundle %s. %v", c.CACert, err)
 		}
-
-		_, err := f.r.R().SetBody(identityPayload).SetResult(&identity).Post("/identities")
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in the FabConnect CA bundle %s", c.CACert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if c.ClientCert != "" || c.ClientKey != "" {
+		if c.ClientCert == "" || c.ClientKey == "" {
+			return nil, fmt.Errorf("both the client certificate and key are required for FabConnect mutual TLS")
+		}
+		cert, err := tls.LoadX509KeyPair(c.ClientCert, c.ClientKey)
 		if err != nil {
-			return fmt.Errorf("failed to create identity. %v", err)
+			return nil, fmt.Errorf("failed to load the FabConnect client certificate %s. %v", c.ClientCert, err)
 		}
-	} else {
-		log.Infof("Identity already exists: %s", f.username)
+		tlsConfig.Certificates = []tls.Certificate{cert}
 	}
+	return tlsConfig, nil
+}
 
-	if identity.EnrollmentCert != "" {
-		log.Infof("Identity already enrolled: %s", f.username)
-		return nil
+// webSocketEndpoint returns the websocket URL, ws:// or wss:// with the /ws path of the REST URL
+// unless configured separately, and the basic auth header of the credentials in either URL, as
+// the websocket client does not accept them in the URL
+func (c *FabconnectConfig) webSocketEndpoint() (string, http.Header, error) {
+	restURL, err := url.Parse(c.URL)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to parse the FabConnect URL. %v", err)
 	}
-
-	if identity.Secret != "" {
-		log.Infof("Enrolling identity: %s", f.username)
-
-		enrollIdentityPayload := FabconnectEnrollIdentityPayload{
-			Secret:     identity.Secret,
-			Attributes: make(map[string]interface{}),
-		}
-		_, err := f.r.R().SetBody(enrollIdentityPayload).Post(fmt.Sprintf("/identities/%s/enroll", f.username))
+	var wsURL *url.URL
+	if c.WebSocketURL != "" {
+		wsURL, err = url.Parse(c.WebSocketURL)
 		if err != nil {
-			return err
+			return "", nil, fmt.Errorf("failed to parse the FabConnect websocket URL. %v", err)
 		}
 	} else {
-		return fmt.Errorf("missing enrollment secret for identity: %s", f.username)
+		copied := *restURL
+		wsURL = &copied
+		switch wsURL.Scheme {
+		case "https":
+			wsURL.Scheme = "wss"
+		default:
+			wsURL.Scheme = "ws"
+		}
+		wsURL.Path = strings.TrimSuffix(wsURL.Path, "/") + "/ws"
+		wsURL.RawPath = ""
 	}
 
-	return nil
+	header := http.Header{}
+	user := wsURL.User
+	if user == nil {
+		user = restURL.User
+	}
+	if user != nil {
+		password, _ := user.Password()
+		req := &http.Request{Header: header}
+		req.SetBasicAuth(user.Username(), password)
+	}
+	wsURL.User = nil
+	return wsURL.String(), header, nil
+}
+
+// WithSigner returns a client that submits the transactions signed by another identity,
+// sharing the REST client of this one
+func (f *FabconnectClient) WithSigner(username string) *FabconnectClient {
+	signerClient := *f
+	signerClient.username = username
+	return &signerClient
 }
 
 func (f *FabconnectClient) InitChaincode(channel, chaincodeId string) (string, error) {
-	receiptId, err := f.sendTransaction(true, channel, chaincodeId, "")
+	receiptId, err := f.sendTransaction(true, channel, chaincodeId, "InitLedger", []string{})
 	if err != nil {
 		return "", err
 	}
@@ -212,8 +342,8 @@ func (f *FabconnectClient) InitChaincode(channel, chaincodeId string) (string, e
 	return receiptId, nil
 }
 
-func (f *FabconnectClient) ExecChaincode(channel, chaincodeId, assetName string) (string, error) {
-	receiptId, err := f.sendTransaction(false, channel, chaincodeId, assetName)
+func (f *FabconnectClient) ExecChaincode(channel, chaincodeId, function string, args []string) (string, error) {
+	receiptId, err := f.sendTransaction(false, channel, chaincodeId, function, args)
 	if err != nil {
 		return "", err
 	}
@@ -221,18 +351,22 @@ func (f *FabconnectClient) ExecChaincode(channel, chaincodeId, assetName string)
 	return receiptId, nil
 }
 
-func (f *FabconnectClient) sendTransaction(init bool, channel, chaincodeId string, assetName string) (string, error) {
-	functionName := "InitLedger"
-	functionArgs := []string{}
-	if !init {
-		functionName = "CreateAsset"
-		functionArgs = []string{assetName, "yellow", "10", "Tom", "1300"}
-	}
+// InitChaincodeSync initializes the chaincode, and returns the receipt once the transaction is committed
+func (f *FabconnectClient) InitChaincodeSync(channel, chaincodeId string) (*FabconnectTransactionReceipt, error) {
+	return f.sendTransactionSync(transactionPayload(true, f.username, channel, chaincodeId, "InitLedger", []string{}))
+}
+
+// ExecChaincodeSync invokes the chaincode, and returns the receipt once the transaction is
+// committed, along with an error if it has failed
+func (f *FabconnectClient) ExecChaincodeSync(channel, chaincodeId, function string, args []string) (*FabconnectTransactionReceipt, error) {
+	return f.sendTransactionSync(transactionPayload(false, f.username, channel, chaincodeId, function, args))
+}
 
-	transactionPayload := FabconnectTransactionPayload{
+func transactionPayload(init bool, signer, channel, chaincodeId, functionName string, functionArgs []string) FabconnectTransactionPayload {
+	return FabconnectTransactionPayload{
 		Headers: FabconnectTransactionPayloadHeaders{
 			Type:      "SendTransaction",
-			Signer:    f.username,
+			Signer:    signer,
 			Channel:   channel,
 			Chaincode: chaincodeId,
 		},
@@ -240,6 +374,10 @@ func (f *FabconnectClient) sendTransaction(init bool, channel, chaincodeId strin
 		Args: functionArgs,
 		Init: init,
 	}
+}
+
+func (f *FabconnectClient) sendTransaction(init bool, channel, chaincodeId, functionName string, functionArgs []string) (string, error) {
+	transactionPayload := transactionPayload(init, f.username, channel, chaincodeId, functionName, functionArgs)
 	var transactionConfirmation FabconnectTransactionConfirmation
 
 	sendTx, err := f.r.R().EnableTrace().SetBody(transactionPayload).SetResult(&transactionConfirmation).Post("/transactions?fly-sync=false")
@@ -262,131 +400,326 @@ func (f *FabconnectClient) sendTransaction(init bool, channel, chaincodeId strin
 	return transactionConfirmation.Id, nil
 }
 
-func (f *FabconnectClient) GetReceipt(receiptId string) (*FabconnectTransactionReceipt, error) {
-	log.Infof("Getting receipts for %s", receiptId)
-
+// sendTransactionSync returns once the transaction is committed, with the receipt in the response
+func (f *FabconnectClient) sendTransactionSync(transactionPayload FabconnectTransactionPayload) (*FabconnectTransactionReceipt, error) {
 	var receipt FabconnectTransactionReceipt
-	resp, err := f.r.R().SetResult(&receipt).Get(fmt.Sprintf("/receipts/%s", receiptId))
+	sendTx, err := f.r.R().SetBody(transactionPayload).SetResult(&receipt).SetError(&receipt).Post("/transactions?fly-sync=true")
 	if err != nil {
-		log.Errorf("Failed to get receipt %s. %v", receiptId, err)
-		return nil, err
-	} else if resp.StatusCode() != 200 {
-		log.Errorf("Status code for getting receipt %s: %d", receiptId, resp.StatusCode())
-		return nil, nil
+		return nil, fmt.Errorf("server error message: %s", err.Error())
 	}
 
-	return &receipt, nil
-}
-
-func (f *FabconnectClient) CreateEventListener(channel, chaincodeId string) (string, error) {
-	batchStr := os.Getenv("EVENT_BATCH_SIZE")
-	if batchStr != "" {
-		batchSize, err := strconv.Atoi(batchStr)
-		if err != nil {
-			log.Errorf("Failed to convert %s to integer", batchStr)
-			os.Exit(1)
+	if sendTx.StatusCode() != 200 {
+		if receipt.ErrorMessage != "" {
+			// the transaction was rejected, and the receipt has the reason
+			return &receipt, fmt.Errorf("transaction failed. %s", receipt.ErrorMessage)
 		}
-		f.EventBatchSize = batchSize
-	} else {
-		f.EventBatchSize = 1
+		return nil, fmt.Errorf("unexpected status code: %s", sendTx.String())
+	}
+
+	if !receipt.Succeeded() {
+		return &receipt, fmt.Errorf("transaction failed. %s", receipt.ErrorMessage)
 	}
 
-	body := FabConnectEventStreamPostPayload{
-		Name:      "fabconnect-perf-1",
-		Type:      "websocket",
-		BatchSize: f.EventBatchSize,
-		WebSocket: WebSocketSpec{
-			Topic: EVENT_LISTENER_TOPIC,
+	return &receipt, nil
+}
+
+func (f *FabconnectClient) QueryChaincode(channel, chaincodeId, function string, args []string) (string, error) {
+	queryPayload := FabconnectQueryPayload{
+		Headers: FabconnectTransactionPayloadHeaders{
+			Signer:    f.username,
+			Channel:   channel,
+			Chaincode: chaincodeId,
 		},
+		Func: function,
+		Args: args,
 	}
-	result := FabConnectEventStreamPostResponse{}
-	_, err := f.r.R().SetBody(body).SetResult(&result).Post("/eventstreams")
+	var queryResponse FabconnectQueryResponse
+
+	query, err := f.r.R().SetBody(queryPayload).SetResult(&queryResponse).Post("/query")
 	if err != nil {
-		log.Errorf("Failed to create event stream. %v", err)
-		return "", err
+		return "", fmt.Errorf("server error message: %s", err.Error())
 	}
-	streamId := result.ID
-	log.Infof("Created event stream: %s", streamId)
 
-	// retrieve block height
-	url := fmt.Sprintf("/chainInfo?fly-channel=%s&fly-signer=%s", channel, f.username)
-	var chainInfo ChainInfoResponse
-	_, err = f.r.R().SetResult(&chainInfo).Get(url)
-	if err != nil {
-		log.Errorf("Failed to get chain info. %v", err)
-		return "", err
+	if query.StatusCode() != 200 {
+		return "", fmt.Errorf("unexpected status code: %s", query.String())
 	}
 
-	subscriptionBody := FabConnectSubscriptionPostPayload{
-		StreamId:    streamId,
-		Channel:     channel,
-		Name:        "fabconnect-perf-subscription-1",
-		Signer:      f.username,
-		FromBlock:   strconv.Itoa(chainInfo.Result.Height),
-		PayloadType: "json",
-		Filter: FilterSpec{
-			ChaincodeId: chaincodeId,
-		},
+	return string(queryResponse.Result), nil
+}
+
+// eventClient receives the events of the stream over the websocket, and reconnects when the
+// connection drops
+type eventClient struct {
+	mu         sync.Mutex
+	conn       *websocket.Conn
+	receiver   *http.Server
+	done       chan struct{}
+	reconnects int64
+	// the messages that were not a batch of events, and were not acked
+	invalid int64
+	seen    *seenEvents
+}
+
+// StartEventClient receives the events in the background, and sends the asset IDs in their
+// JSON payload to the channel, until StopEventClient is called
+func (f *FabconnectClient) StartEventClient(assetIdsChan chan string) error {
+	return f.ListenEvents(func(event *Event) {
+		var payload EventPayload
+		err := event.DecodePayload(&payload)
+		if err != nil {
+			log.Errorf("Failed to decode the payload of the event. %v", err)
+			return
+		}
+		select {
+		case assetIdsChan <- payload.AssetId:
+		case <-f.events.done:
+		}
+	})
+}
+
+// ListenEvents receives the events in the background, and calls the handler for each of them,
+// or only for the ones with one of the event names if any, until StopEventClient is called.
+// With a Webhook, the receiver is listening once it returns
+func (f *FabconnectClient) ListenEvents(handler EventHandler, eventNames ...string) error {
+	names := make(map[string]bool)
+	for _, name := range eventNames {
+		names[name] = true
 	}
-	subResult := FabConnectSubscriptionPostPayload{}
-	_, err = f.r.R().SetBody(subscriptionBody).SetResult(&subResult).Post("/subscriptions")
+	f.events = &eventClient{
+		done: make(chan struct{}),
+		seen: newSeenEvents(SEEN_EVENTS_CAPACITY),
+	}
+	if f.Webhook != nil {
+		return f.startWebhookReceiver(handler, names)
+	}
+	err := f.connectEventClient()
 	if err != nil {
-		log.Errorf("Failed to create subscription. %v", err)
-		return "", err
+		log.Errorf("Failed to connect to websocket. %v", err)
+		return err
 	}
+	log.Infof("Listening for events")
+	go f.receiveEvents(handler, names)
+	return nil
+}
 
-	return streamId, nil
+// StopEventClient stops receiving the events and closes the websocket, or the webhook receiver
+func (f *FabconnectClient) StopEventClient() {
+	if f.events == nil {
+		return
+	}
+	f.events.mu.Lock()
+	defer f.events.mu.Unlock()
+	select {
+	case <-f.events.done:
+	default:
+		close(f.events.done)
+		if f.events.conn != nil {
+			f.events.conn.Close()
+		}
+		if f.events.receiver != nil {
+			f.events.receiver.Close()
+		}
+	}
 }
 
-func (f *FabconnectClient) CleanupEventListener(eventStreamId string) error {
-	log.Infof("Cleaning up event stream: %s", eventStreamId)
-	_, err := f.r.R().Delete(fmt.Sprintf("/eventstreams/%s", eventStreamId))
-	if err != nil {
-		log.Errorf("Failed to delete event stream %s. %v", eventStreamId, err)
-		return err
+// Retries returns the number of requests retried so far, by the client and the clients of
+// the other signers derived from it
+func (f *FabconnectClient) Retries() int {
+	return int(atomic.LoadInt64(f.retries))
+}
+
+// Reconnects returns the number of times the websocket has been reconnected
+func (f *FabconnectClient) Reconnects() int {
+	if f.events == nil {
+		return 0
 	}
+	return int(atomic.LoadInt64(&f.events.reconnects))
+}
 
-	return nil
+// InvalidMessages returns the number of messages received on the websocket, or posted to
+// the webhook, that were not a batch of events
+func (f *FabconnectClient) InvalidMessages() int {
+	if f.events == nil {
+		return 0
+	}
+	return int(atomic.LoadInt64(&f.events.invalid))
 }
 
-func (f *FabconnectClient) StartEventClient(assetIdsChan chan string) error {
-	done := make(chan struct{})
-	err := f.ws.WriteJSON(map[string]string{
+// connectEventClient connects the websocket and listens to the topic of the event stream
+func (f *FabconnectClient) connectEventClient() error {
+	conn, _, err := f.wsDialer.Dial(f.wsURL, f.wsHeader)
+	if err != nil {
+		return fmt.Errorf("failed to connect to websocket %s. %v", f.wsURL, err)
+	}
+	err = conn.WriteJSON(map[string]string{
 		"type":  "listen",
-		"topic": EVENT_LISTENER_TOPIC,
+		"topic": f.Topic,
 	})
 	if err != nil {
-		log.Errorf("Failed to write to websocket. %v", err)
-		return err
+		conn.Close()
+		return fmt.Errorf("failed to listen on topic %s. %v", f.Topic, err)
 	}
-	log.Infof("Listening for events")
-	go func() {
-		defer close(done)
-		for {
-			_, message, err := f.ws.ReadMessage()
-			if err != nil {
-				fmt.Println("read:", err)
-				return
-			}
-			events := []Event{}
-			err = json.Unmarshal(message, &events)
-			if err != nil {
-				log.Errorf("Failed to unmarshal event response. %v", err)
-				return
-			}
-			for _, event := range events {
-				assetIdsChan <- event.Payload.AssetId
+
+	f.events.mu.Lock()
+	defer f.events.mu.Unlock()
+	select {
+	case <-f.events.done:
+		conn.Close()
+		return fmt.Errorf("event client stopped")
+	default:
+		f.events.conn = conn
+	}
+	return nil
+}
+
+func (f *FabconnectClient) receiveEvents(handler EventHandler, names map[string]bool) {
+	for {
+		f.events.mu.Lock()
+		conn := f.events.conn
+		f.events.mu.Unlock()
+
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			if f.reconnect(err) {
+				continue
 			}
-			err = f.ws.WriteJSON(map[string]string{
-				"type":  "ack",
-				"topic": EVENT_LISTENER_TOPIC,
-			})
-			if err != nil {
-				log.Errorf("Failed to write to websocket. %v", err)
-				return
+			return
+		}
+		events := []Event{}
+		err = json.Unmarshal(message, &events)
+		if err != nil {
+			// not acked, so a batch that failed to parse is delivered again after reconnecting
+			invalid := atomic.AddInt64(&f.events.invalid, 1)
+			log.Errorf("Failed to unmarshal event response %s. Invalid messages: %d. %v", message, invalid, err)
+			continue
+		}
+		if !f.processEvents(events, handler, names) {
+			return
+		}
+		err = conn.WriteJSON(map[string]string{
+			"type":  "ack",
+			"topic": f.Topic,
+		})
+		if err != nil && !f.reconnect(err) {
+			return
+		}
+	}
+}
+
+// processEvents calls the handler for each event of a batch that has not been seen or
+// checkpointed before, then saves the checkpoints so the batch can be acked. A batch that is
+// not acked, before the websocket drops or the webhook request times out, is delivered again,
+// so the last SEEN_EVENTS_CAPACITY events processed are dropped if they are delivered again.
+// It returns false once the event client is stopped
+func (f *FabconnectClient) processEvents(events []Event, handler EventHandler, names map[string]bool) bool {
+	type position struct {
+		blockNumber uint64
+		txIndex     int
+	}
+	processed := make(map[subscriptionTarget]position)
+	for i := range events {
+		event := &events[i]
+		key := fmt.Sprintf("%s/%d", event.TxId, event.EventIndex)
+		if !f.events.seen.add(key) {
+			log.Debugf("Dropped duplicate event %s", key)
+			continue
+		}
+		target, known := f.subscriptionOf(event)
+		if known && f.Checkpoints.Processed(target.channel, target.chaincodeId, event.BlockNumber, event.TxIndex) {
+			log.Debugf("Dropped event %s processed before the checkpoint", key)
+			continue
+		}
+		if len(names) == 0 || names[event.EventName] {
+			// decoded as delivered by its subscription, which may predate the payload type of the client
+			event.PayloadType = f.PayloadType
+			if known {
+				event.PayloadType = target.payloadType
 			}
+			handler(event)
 		}
-	}()
+		if known {
+			processed[target] = position{event.BlockNumber, event.TxIndex}
+		}
+		select {
+		case <-f.events.done:
+			return false
+		default:
+		}
+	}
+	// the checkpoints are saved before the batch is acked, so it is delivered again if they are not
+	for target, pos := range processed {
+		err := f.Checkpoints.Save(target.channel, target.chaincodeId, pos.blockNumber, pos.txIndex)
+		if err != nil {
+			log.Errorf("Failed to save the checkpoint. %v", err)
+		}
+	}
+	return true
+}
 
-	return nil
+// seenEvents is the set of the keys of the events processed last, forgetting the oldest
+// once it holds capacity keys
+type seenEvents struct {
+	keys map[string]bool
+	ring []string
+	next int
+}
+
+func newSeenEvents(capacity int) *seenEvents {
+	return &seenEvents{
+		keys: make(map[string]bool, capacity),
+		ring: make([]string, 0, capacity),
+	}
+}
+
+// add returns false if the key has been seen already
+func (s *seenEvents) add(key string) bool {
+	if s.keys[key] {
+		return false
+	}
+	if cap(s.ring) == 0 {
+		return true
+	}
+	if len(s.ring) < cap(s.ring) {
+		s.ring = append(s.ring, key)
+	} else {
+		delete(s.keys, s.ring[s.next])
+		s.ring[s.next] = key
+		s.next = (s.next + 1) % len(s.ring)
+	}
+	s.keys[key] = true
+	return true
+}
+
+// reconnect connects the websocket again after an error, backing off up to
+// WEBSOCKET_RECONNECT_MAX_INTERVAL, and returns false once the event client is stopped
+func (f *FabconnectClient) reconnect(cause error) bool {
+	select {
+	case <-f.events.done:
+		return false
+	default:
+	}
+	log.Errorf("Websocket connection lost. %v", cause)
+	f.events.mu.Lock()
+	f.events.conn.Close()
+	f.events.mu.Unlock()
+
+	interval := WEBSOCKET_RECONNECT_INTERVAL
+	for {
+		select {
+		case <-f.events.done:
+			return false
+		case <-time.After(interval):
+		}
+		err := f.connectEventClient()
+		if err == nil {
+			reconnects := atomic.AddInt64(&f.events.reconnects, 1)
+			log.Warnf("Reconnected to websocket %s. Reconnects: %d", f.wsURL, reconnects)
+			return true
+		}
+		log.Errorf("%v. Retrying in %s", err, interval)
+		interval *= 2
+		if interval > WEBSOCKET_RECONNECT_MAX_INTERVAL {
+			interval = WEBSOCKET_RECONNECT_MAX_INTERVAL
+		}
+	}
 }
@@ -0,0 +1,191 @@
+package kaleido
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/go-resty/resty/v2"
+	log "github.com/sirupsen/logrus"
+)
+
+// the types of identity registered with the CA
+const (
+	IDENTITY_TYPE_CLIENT = "client"
+	IDENTITY_TYPE_PEER   = "peer"
+	IDENTITY_TYPE_ADMIN  = "admin"
+)
+
+// FabconnectIdentity is an identity registered with the CA, and its certificate once
+// enrolled. The secret is only returned on registration
+type FabconnectIdentity struct {
+	Name           string            `json:"name,omitempty"`
+	Type           string            `json:"type,omitempty"`
+	Affiliation    string            `json:"affiliation,omitempty"`
+	MaxEnrollments int               `json:"maxEnrollments,omitempty"`
+	Attributes     map[string]string `json:"attributes,omitempty"`
+	CAName         string            `json:"caname,omitempty"`
+	EnrollmentCert string            `json:"enrollmentCert,omitempty"`
+	CACert         string            `json:"caCert,omitempty"`
+	Secret         string            `json:"secret,omitempty"`
+}
+
+// FabconnectIdentityPayload registers an identity. A MaxEnrollments of 0 is the default of
+// the CA, and -1 is unlimited
+type FabconnectIdentityPayload struct {
+	Name           string            `json:"name,omitempty"`
+	Type           string            `json:"type,omitempty"`
+	Affiliation    string            `json:"affiliation,omitempty"`
+	MaxEnrollments int               `json:"maxEnrollments,omitempty"`
+	Attributes     map[string]string `json:"attributes,omitempty"`
+	CAName         string            `json:"caname,omitempty"`
+}
+
+// FabconnectEnrollIdentityPayload enrolls or reenrolls an identity. The attributes are the
+// ones to add to the certificate, each of them optional or not
+type FabconnectEnrollIdentityPayload struct {
+	Secret     string          `json:"secret,omitempty"`
+	CAName     string          `json:"caname,omitempty"`
+	Attributes map[string]bool `json:"attributes,omitempty"`
+}
+
+type FabconnectRevokeIdentityPayload struct {
+	Reason string `json:"reason,omitempty"`
+	GenCRL bool   `json:"gencrl,omitempty"`
+}
+
+// FabconnectRevokeResponse has the serials of the certificates revoked, and the CRL if requested
+type FabconnectRevokeResponse struct {
+	RevokedCerts []map[string]string `json:"revokedCerts,omitempty"`
+	CRL          string              `json:"CRL,omitempty"`
+}
+
+// EnsureIdentity registers the identity of the client if the CA does not have it, and enrolls
+// it unless FabConnect already has its certificate
+func (f *FabconnectClient) EnsureIdentity() error {
+	log.Infof("Checking if identity exists: %s", f.username)
+	identity, err := f.GetIdentity(f.username)
+	if err != nil {
+		return err
+	}
+	if identity != nil {
+		if identity.EnrollmentCert != "" {
+			log.Infof("Identity already enrolled: %s", f.username)
+			return nil
+		}
+		// the secret is only known when registering
+		return fmt.Errorf("missing enrollment secret for identity: %s", f.username)
+	}
+
+	log.Infof("Creating identity: %s", f.username)
+	secret, err := f.RegisterIdentity(&FabconnectIdentityPayload{
+		Name: f.username,
+		Type: IDENTITY_TYPE_CLIENT,
+	})
+	if err != nil {
+		return err
+	}
+	log.Infof("Enrolling identity: %s", f.username)
+	return f.EnrollIdentity(f.username, secret, nil)
+}
+
+func (f *FabconnectClient) ListIdentities() ([]*FabconnectIdentity, error) {
+	identities := []*FabconnectIdentity{}
+	err := f.call("GET", "/identities", nil, &identities)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list identities. %v", err)
+	}
+	return identities, nil
+}
+
+// GetIdentity returns the identity, or nil if the CA does not have it
+func (f *FabconnectClient) GetIdentity(name string) (*FabconnectIdentity, error) {
+	var identity FabconnectIdentity
+	resp, err := f.r.R().SetResult(&identity).Get(fmt.Sprintf("/identities/%s", url.PathEscape(name)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get identity %s. %v", name, err)
+	}
+	if identityNotFound(resp) {
+		return nil, nil
+	}
+	if resp.IsError() {
+		return nil, fmt.Errorf("failed to get identity %s. %v", name, newFabconnectError(resp))
+	}
+	return &identity, nil
+}
+
+// identityNotFound returns whether the response is for an identity the CA does not have.
+// FabConnect returns the error of the CA as a 500, 63 being the code of a missing identity
+func identityNotFound(resp *resty.Response) bool {
+	if resp.StatusCode() == http.StatusNotFound {
+		return true
+	}
+	if resp.StatusCode() != http.StatusInternalServerError {
+		return false
+	}
+	message := strings.ToLower(newFabconnectError(resp).Message)
+	return strings.Contains(message, "code: 63") || strings.Contains(message, "not found")
+}
+
+// RegisterIdentity registers an identity with the CA, as a client unless another type is
+// given, and returns its enrollment secret
+func (f *FabconnectClient) RegisterIdentity(payload *FabconnectIdentityPayload) (string, error) {
+	if payload.Type == "" {
+		payload.Type = IDENTITY_TYPE_CLIENT
+	}
+	var identity FabconnectIdentity
+	err := f.call("POST", "/identities", payload, &identity)
+	if err != nil {
+		return "", fmt.Errorf("failed to register identity %s. %v", payload.Name, err)
+	}
+	if identity.Secret == "" {
+		return "", fmt.Errorf("missing enrollment secret for identity: %s", payload.Name)
+	}
+	log.Infof("Registered identity: %s", payload.Name)
+	return identity.Secret, nil
+}
+
+// EnrollIdentity enrolls a registered identity with its secret, requesting the attributes to
+// add to its certificate, if any
+func (f *FabconnectClient) EnrollIdentity(name, secret string, attributes map[string]bool) error {
+	payload := &FabconnectEnrollIdentityPayload{
+		Secret:     secret,
+		Attributes: attributes,
+	}
+	err := f.call("POST", fmt.Sprintf("/identities/%s/enroll", url.PathEscape(name)), payload, nil)
+	if err != nil {
+		return fmt.Errorf("failed to enroll identity %s. %v", name, err)
+	}
+	log.Infof("Enrolled identity: %s", name)
+	return nil
+}
+
+// ReenrollIdentity renews the certificate of an enrolled identity, requesting the attributes to
+// add to it, if any
+func (f *FabconnectClient) ReenrollIdentity(name string, attributes map[string]bool) error {
+	payload := &FabconnectEnrollIdentityPayload{
+		Attributes: attributes,
+	}
+	err := f.call("POST", fmt.Sprintf("/identities/%s/reenroll", url.PathEscape(name)), payload, nil)
+	if err != nil {
+		return fmt.Errorf("failed to reenroll identity %s. %v", name, err)
+	}
+	log.Infof("Reenrolled identity: %s", name)
+	return nil
+}
+
+// RevokeIdentity revokes the identity and its certificates, and generates the CRL if requested
+func (f *FabconnectClient) RevokeIdentity(name, reason string, genCRL bool) (*FabconnectRevokeResponse, error) {
+	payload := &FabconnectRevokeIdentityPayload{
+		Reason: reason,
+		GenCRL: genCRL,
+	}
+	var revoked FabconnectRevokeResponse
+	err := f.call("POST", fmt.Sprintf("/identities/%s/revoke", url.PathEscape(name)), payload, &revoked)
+	if err != nil {
+		return nil, fmt.Errorf("failed to revoke identity %s. %v", name, err)
+	}
+	log.Infof("Revoked identity: %s", name)
+	return &revoked, nil
+}
@@ -0,0 +1,129 @@
+package kaleido
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+)
+
+type ChainInfoResponse struct {
+	Result ChainInfo `json:"result"`
+}
+
+// ChainInfo is the height of the ledger of a channel, and the hashes of its last two blocks
+type ChainInfo struct {
+	Height            int    `json:"height"`
+	CurrentBlockHash  string `json:"currentBlockHash,omitempty"`
+	PreviousBlockHash string `json:"previousBlockHash,omitempty"`
+}
+
+type BlockResponse struct {
+	Result struct {
+		Block *Block `json:"block"`
+	} `json:"result"`
+}
+
+// Block is a block of the ledger of a channel, with its transactions decoded
+type Block struct {
+	Number       uint64         `json:"block_number"`
+	DataHash     string         `json:"data_hash,omitempty"`
+	PreviousHash string         `json:"previous_hash,omitempty"`
+	Timestamp    int64          `json:"timestamp,omitempty"`
+	Transactions []*Transaction `json:"transactions,omitempty"`
+}
+
+type TransactionResponse struct {
+	Result struct {
+		Transaction *Transaction `json:"transaction"`
+	} `json:"result"`
+}
+
+// Transaction is a transaction of a block. The status is the validation code of the
+// transaction, such as VALID or MVCC_READ_CONFLICT
+type Transaction struct {
+	Type      string               `json:"type,omitempty"`
+	TxId      string               `json:"tx_id"`
+	Nonce     string               `json:"nonce,omitempty"`
+	Creator   *Creator             `json:"creator,omitempty"`
+	Status    string               `json:"status,omitempty"`
+	Signature string               `json:"signature,omitempty"`
+	Timestamp int64                `json:"timestamp,omitempty"`
+	Actions   []*TransactionAction `json:"actions,omitempty"`
+}
+
+type Creator struct {
+	MspId string `json:"msp_id,omitempty"`
+	Cert  string `json:"cert,omitempty"`
+}
+
+// TransactionAction is the invocation of a chaincode by a transaction, and the event it set, if any
+type TransactionAction struct {
+	Nonce         string          `json:"nonce,omitempty"`
+	Creator       *Creator        `json:"creator,omitempty"`
+	TransactionId string          `json:"transaction_id,omitempty"`
+	ChaincodeId   *ChaincodeId    `json:"chaincode_id,omitempty"`
+	Input         *ChaincodeInput `json:"input,omitempty"`
+	ProposalHash  string          `json:"proposal_hash,omitempty"`
+	Event         *ChaincodeEvent `json:"event,omitempty"`
+}
+
+type ChaincodeEvent struct {
+	ChaincodeId string          `json:"chaincodeId,omitempty"`
+	TxId        string          `json:"transactionId,omitempty"`
+	EventName   string          `json:"eventName,omitempty"`
+	Payload     json.RawMessage `json:"payload,omitempty"`
+}
+
+type ChaincodeId struct {
+	Name    string `json:"name,omitempty"`
+	Version string `json:"version,omitempty"`
+	Path    string `json:"path,omitempty"`
+}
+
+type ChaincodeInput struct {
+	Args   []string `json:"args,omitempty"`
+	IsInit bool     `json:"is_init,omitempty"`
+}
+
+// GetChainInfo returns the height of the ledger of the channel, and the hashes of its last blocks
+func (f *FabconnectClient) GetChainInfo(channel string) (*ChainInfo, error) {
+	var chainInfo ChainInfoResponse
+	err := f.call("GET", f.ledgerPath("/chainInfo", channel), nil, &chainInfo)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the chain info of channel %s. %v", channel, err)
+	}
+	return &chainInfo.Result, nil
+}
+
+func (f *FabconnectClient) GetBlock(channel string, blockNumber uint64) (*Block, error) {
+	var block BlockResponse
+	err := f.call("GET", f.ledgerPath(fmt.Sprintf("/blocks/%d", blockNumber), channel), nil, &block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get block %d of channel %s. %v", blockNumber, channel, err)
+	}
+	return block.Result.Block, nil
+}
+
+// GetBlockByTxId returns the block the transaction has been committed in
+func (f *FabconnectClient) GetBlockByTxId(channel, txId string) (*Block, error) {
+	var block BlockResponse
+	err := f.call("GET", f.ledgerPath(fmt.Sprintf("/blockByTxId/%s", url.PathEscape(txId)), channel), nil, &block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the block of transaction %s on channel %s. %v", txId, channel, err)
+	}
+	return block.Result.Block, nil
+}
+
+func (f *FabconnectClient) GetTransaction(channel, txId string) (*Transaction, error) {
+	var transaction TransactionResponse
+	err := f.call("GET", f.ledgerPath(fmt.Sprintf("/transactions/%s", url.PathEscape(txId)), channel), nil, &transaction)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get transaction %s on channel %s. %v", txId, channel, err)
+	}
+	return transaction.Result.Transaction, nil
+}
+
+// ledgerPath queries the ledger of the channel as the identity of the client
+func (f *FabconnectClient) ledgerPath(path, channel string) string {
+	return fmt.Sprintf("%s?fly-channel=%s&fly-signer=%s", path, url.QueryEscape(channel), url.QueryEscape(f.username))
+}
@@ -10,6 +10,15 @@ import (
 	kld "github.com/kaleido-io/kaleido-sdk-go/kaleido"
 )
 
+type NetworkConfig struct {
+	URL         string `yaml:"url,omitempty" json:"url,omitempty"`
+	APIKey      string `yaml:"apiKey,omitempty" json:"apiKey,omitempty"`
+	Consortium  string `yaml:"consortium,omitempty" json:"consortium,omitempty"`
+	Environment string `yaml:"environment,omitempty" json:"environment,omitempty"`
+	Membership  string `yaml:"membership,omitempty" json:"membership,omitempty"`
+	Channel     string `yaml:"channel,omitempty" json:"channel,omitempty"`
+}
+
 type KaleidoNetwork struct {
 	Consortium    kld.Consortium
 	Environment   kld.Environment
@@ -21,26 +30,42 @@ type KaleidoNetwork struct {
 	Peers         []kld.Node
 
 	client kld.KaleidoClient
+	config NetworkConfig
+}
+
+// NetworkConfigFromEnv reads the Kaleido network settings from the environment variables
+func NetworkConfigFromEnv() NetworkConfig {
+	return NetworkConfig{
+		URL:         os.Getenv("KALEIDO_URL"),
+		APIKey:      os.Getenv("APIKEY"),
+		Consortium:  os.Getenv("CONSORTIUM"),
+		Environment: os.Getenv("ENVIRONMENT"),
+		Membership:  os.Getenv("SUBMITTER"),
+		Channel:     os.Getenv("CHANNEL_ID"),
+	}
 }
 
-func NewNetwork() *KaleidoNetwork {
-	kn := KaleidoNetwork{}
+func NewNetwork(config NetworkConfig) *KaleidoNetwork {
+	if config.URL == "" {
+		config.URL = "https://console.kaleido.io/api/v1"
+	}
+	kn := KaleidoNetwork{
+		config: config,
+	}
 	return &kn
 }
 
 func (kn *KaleidoNetwork) Initialize() {
 	fmt.Println("Initializing Kaleido Network...")
 
-	apikey := os.Getenv("APIKEY")
-	if apikey == "" {
-		fmt.Println("Must set environment variable \"APIKEY\"")
+	if kn.config.APIKey == "" {
+		fmt.Println("Must set environment variable \"APIKEY\", or \"apiKey\" in the scenario's Kaleido target")
 		os.Exit(1)
 	}
 
-	url := getApiUrl()
-	fmt.Printf("URL: %v\n", url)
+	fmt.Printf("URL: %v\n", kn.config.URL)
 
-	kn.client = kld.NewClient(url, apikey)
+	kn.client = kld.NewClient(kn.config.URL, kn.config.APIKey)
 
 	kn.selectConsortium()
 	kn.selectEnvironment()
@@ -66,7 +91,7 @@ func (kn *KaleidoNetwork) selectConsortium() {
 		}
 	}
 
-	requestedConsortium := os.Getenv("CONSORTIUM")
+	requestedConsortium := kn.config.Consortium
 	if len(liveConsortiums) == 0 {
 		fmt.Printf("No consortium found using URL\n")
 		os.Exit(1)
@@ -121,7 +146,7 @@ func (kn *KaleidoNetwork) selectEnvironment() {
 		}
 	}
 
-	requestedEnvironment := os.Getenv("ENVIRONMENT")
+	requestedEnvironment := kn.config.Environment
 	if len(liveEnvs) == 0 {
 		fmt.Printf("No Fabric environments found in consortium %s\n", kn.Consortium.ID)
 		os.Exit(1)
@@ -170,7 +195,7 @@ func (kn *KaleidoNetwork) selectMembership() {
 		os.Exit(1)
 	}
 
-	desiredMembership := os.Getenv("SUBMITTER")
+	desiredMembership := kn.config.Membership
 	if len(memberships) > 1 && desiredMembership == "" {
 		reader := bufio.NewReader(os.Stdin)
 		fmt.Println("Select the membership to submit transactions from:")
@@ -219,7 +244,7 @@ func (kn *KaleidoNetwork) selectChannel() {
 		fmt.Println("The environment does not have any channels.")
 		os.Exit(1)
 	}
-	desiredChannel := os.Getenv("CHANNEL_ID")
+	desiredChannel := kn.config.Channel
 	if len(channels) > 1 && desiredChannel == "" {
 		reader := bufio.NewReader(os.Stdin)
 		fmt.Println("Select the channel to submit transactions to:")
@@ -315,11 +340,3 @@ func (kn *KaleidoNetwork) getMyCA() {
 	fmt.Printf("Failed to locate fabric-ca service for my membership %s\n", kn.MyMembership.ID)
 	os.Exit(1)
 }
-
-func getApiUrl() string {
-	url := os.Getenv("KALEIDO_URL")
-	if url == "" {
-		url = "https://console.kaleido.io/api/v1"
-	}
-	return url
-}
@@ -0,0 +1,184 @@
+package kaleido
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// FabconnectTransactionReceiptHeaders identify the request of the transaction. The time
+// received is when FabConnect received the request, and the time elapsed, in seconds, is
+// how long it took to complete it
+type FabconnectTransactionReceiptHeaders struct {
+	Id            string  `json:"id,omitempty"`
+	RequestId     string  `json:"requestId,omitempty"`
+	RequestOffset string  `json:"requestOffset,omitempty"`
+	Type          string  `json:"type,omitempty"`
+	Channel       string  `json:"channel,omitempty"`
+	Signer        string  `json:"signer,omitempty"`
+	TimeReceived  string  `json:"timeReceived,omitempty"`
+	TimeElapsed   float64 `json:"timeElapsed,omitempty"`
+}
+
+// FabconnectTransactionReceipt is the outcome of a transaction. The status is the validation
+// code of the transaction, such as VALID or MVCC_READ_CONFLICT, and the result is the payload
+// returned by the chaincode. ReceivedAt is when the receipt was stored, in milliseconds since
+// the epoch
+type FabconnectTransactionReceipt struct {
+	Id            string                              `json:"_id,omitempty"`
+	Headers       FabconnectTransactionReceiptHeaders `json:"headers,omitempty"`
+	Status        string                              `json:"status,omitempty"`
+	TransactionId string                              `json:"transactionID,omitempty"`
+	BlockNumber   uint64                              `json:"blockNumber,omitempty"`
+	Signer        string                              `json:"signer,omitempty"`
+	SignerMSP     string                              `json:"signerMSP,omitempty"`
+	ReceivedAt    int64                               `json:"receivedAt,omitempty"`
+	Result        json.RawMessage                     `json:"result,omitempty"`
+	ErrorMessage  string                              `json:"errorMessage,omitempty"`
+}
+
+// Succeeded returns whether the transaction has been committed as valid
+func (r *FabconnectTransactionReceipt) Succeeded() bool {
+	return r.Headers.Type == RECEIPT_SUCCESS
+}
+
+// Elapsed returns how long FabConnect took to complete the transaction
+func (r *FabconnectTransactionReceipt) Elapsed() time.Duration {
+	return time.Duration(r.Headers.TimeElapsed * float64(time.Second))
+}
+
+// ReceiptNotFoundError is returned for a receipt FabConnect does not have, as the
+// transaction is not complete yet, or the receipt ID is unknown
+type ReceiptNotFoundError struct {
+	ReceiptId string
+}
+
+func (e *ReceiptNotFoundError) Error() string {
+	return fmt.Sprintf("receipt %s not found", e.ReceiptId)
+}
+
+// ReceiptTimeoutError is returned when a receipt is still not available once the timeout of
+// WaitForReceipt expires, with the last error getting it, if any
+type ReceiptTimeoutError struct {
+	ReceiptId string
+	Timeout   time.Duration
+	LastErr   error
+}
+
+func (e *ReceiptTimeoutError) Error() string {
+	if e.LastErr != nil {
+		return fmt.Sprintf("timed out after %s waiting for receipt %s. %v", e.Timeout, e.ReceiptId, e.LastErr)
+	}
+	return fmt.Sprintf("timed out after %s waiting for receipt %s", e.Timeout, e.ReceiptId)
+}
+
+// ReceiptFilter selects the receipts to list, by ID, by signer, or received since a time, a
+// page at a time. A zero limit is the default page size of FabConnect
+type ReceiptFilter struct {
+	Ids    []string
+	Signer string
+	Since  time.Time
+	Limit  int
+	Skip   int
+}
+
+// GetReceipt returns the receipt of a transaction, or a ReceiptNotFoundError if it is not
+// complete yet. An error status is returned as a FabconnectError
+func (f *FabconnectClient) GetReceipt(receiptId string) (*FabconnectTransactionReceipt, error) {
+	log.Debugf("Getting receipts for %s", receiptId)
+
+	var receipt FabconnectTransactionReceipt
+	resp, err := f.r.R().SetResult(&receipt).Get(fmt.Sprintf("/receipts/%s", url.PathEscape(receiptId)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get receipt %s. %v", receiptId, err)
+	}
+	if resp.StatusCode() == http.StatusNotFound {
+		return nil, &ReceiptNotFoundError{ReceiptId: receiptId}
+	}
+	if resp.StatusCode() != http.StatusOK {
+		return nil, newFabconnectError(resp)
+	}
+
+	return &receipt, nil
+}
+
+// WaitForReceipt polls the receipt of a transaction until it is available, backing off up to
+// RECEIPT_POLL_MAX_INTERVAL, and returns an error if the transaction failed, or a
+// ReceiptTimeoutError if the timeout expires. The connection and server errors are retried,
+// not the client ones. It stops polling when the context is done
+func (f *FabconnectClient) WaitForReceipt(ctx context.Context, receiptId string, timeout time.Duration) (*FabconnectTransactionReceipt, error) {
+	deadline := time.Now().Add(timeout)
+	interval := RECEIPT_POLL_INTERVAL
+	var lastErr error
+	for {
+		timer := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, fmt.Errorf("stopped waiting for receipt %s. %w", receiptId, ctx.Err())
+		case <-timer.C:
+		}
+		receipt, err := f.GetReceipt(receiptId)
+		if err == nil {
+			if !receipt.Succeeded() {
+				return receipt, fmt.Errorf("transaction failed. %s", receipt.ErrorMessage)
+			}
+			return receipt, nil
+		}
+		var notFound *ReceiptNotFoundError
+		var fabconnectErr *FabconnectError
+		if errors.As(err, &fabconnectErr) && fabconnectErr.StatusCode < http.StatusInternalServerError {
+			return nil, fmt.Errorf("failed to get receipt %s. %v", receiptId, err)
+		}
+		if !errors.As(err, &notFound) {
+			log.Warnf("Failed to get receipt %s, retrying. %v", receiptId, err)
+			lastErr = err
+		}
+		if time.Now().After(deadline) {
+			return nil, &ReceiptTimeoutError{ReceiptId: receiptId, Timeout: timeout, LastErr: lastErr}
+		}
+		interval *= 2
+		if interval > RECEIPT_POLL_MAX_INTERVAL {
+			interval = RECEIPT_POLL_MAX_INTERVAL
+		}
+	}
+}
+
+// ListReceipts returns a page of the receipts matching the filter, the most recent first
+func (f *FabconnectClient) ListReceipts(filter *ReceiptFilter) ([]*FabconnectTransactionReceipt, error) {
+	query := url.Values{}
+	if filter != nil {
+		for _, id := range filter.Ids {
+			query.Add("id", id)
+		}
+		if filter.Signer != "" {
+			query.Set("from", filter.Signer)
+		}
+		if !filter.Since.IsZero() {
+			query.Set("since", filter.Since.UTC().Format(time.RFC3339))
+		}
+		if filter.Limit > 0 {
+			query.Set("limit", strconv.Itoa(filter.Limit))
+		}
+		if filter.Skip > 0 {
+			query.Set("skip", strconv.Itoa(filter.Skip))
+		}
+	}
+	path := "/receipts"
+	if len(query) > 0 {
+		path = fmt.Sprintf("%s?%s", path, query.Encode())
+	}
+	receipts := []*FabconnectTransactionReceipt{}
+	err := f.call("GET", path, nil, &receipts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list receipts. %w", err)
+	}
+	return receipts, nil
+}
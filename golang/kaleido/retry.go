@@ -0,0 +1,181 @@
+package kaleido
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	log "github.com/sirupsen/logrus"
+)
+
+// RetryPolicy is how the requests rejected by FabConnect are retried, waiting from the backoff
+// up to the max wait with a jittered exponential backoff. A response is retried when its
+// status code is one of the status codes, or its error message matches one of the patterns,
+// which are regular expressions. The policy defaults to the one of the clients created
+// without it, field by field
+type RetryPolicy struct {
+	MaxAttempts   int      `yaml:"maxAttempts,omitempty" json:"maxAttempts,omitempty"`
+	Backoff       string   `yaml:"backoff,omitempty" json:"backoff,omitempty"`
+	MaxWait       string   `yaml:"maxWait,omitempty" json:"maxWait,omitempty"`
+	StatusCodes   []int    `yaml:"statusCodes,omitempty" json:"statusCodes,omitempty"`
+	ErrorPatterns []string `yaml:"errorPatterns,omitempty" json:"errorPatterns,omitempty"`
+}
+
+// the retry policy of the clients created without one: the requests rejected because
+// FabConnect has too many transactions in flight are sent up to 11 times
+var DEFAULT_RETRY_MAX_ATTEMPTS = 11
+var DEFAULT_RETRY_BACKOFF time.Duration = time.Duration(100) * time.Millisecond
+var DEFAULT_RETRY_MAX_WAIT time.Duration = time.Duration(2) * time.Second
+var DEFAULT_RETRY_ERROR_PATTERNS = []string{"^Too many in-flight transactions$"}
+
+// RetryPolicyFromEnv returns nil unless one of the FABCONNECT_RETRY_* variables is set. The
+// status codes and the error patterns are comma separated lists
+func RetryPolicyFromEnv() (*RetryPolicy, error) {
+	maxAttempts := os.Getenv("FABCONNECT_RETRY_MAX_ATTEMPTS")
+	backoff := os.Getenv("FABCONNECT_RETRY_BACKOFF")
+	maxWait := os.Getenv("FABCONNECT_RETRY_MAX_WAIT")
+	statusCodes := os.Getenv("FABCONNECT_RETRY_STATUS_CODES")
+	errorPatterns := os.Getenv("FABCONNECT_RETRY_ERROR_PATTERNS")
+	if maxAttempts == "" && backoff == "" && maxWait == "" && statusCodes == "" && errorPatterns == "" {
+		return nil, nil
+	}
+
+	policy := &RetryPolicy{
+		Backoff: backoff,
+		MaxWait: maxWait,
+	}
+	if maxAttempts != "" {
+		attempts, err := strconv.Atoi(maxAttempts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse FABCONNECT_RETRY_MAX_ATTEMPTS %s as an integer. %v", maxAttempts, err)
+		}
+		policy.MaxAttempts = attempts
+	}
+	if statusCodes != "" {
+		for _, code := range strings.Split(statusCodes, ",") {
+			statusCode, err := strconv.Atoi(strings.TrimSpace(code))
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse the retryable status code %s as an integer. %v", code, err)
+			}
+			policy.StatusCodes = append(policy.StatusCodes, statusCode)
+		}
+	}
+	if errorPatterns != "" {
+		for _, pattern := range strings.Split(errorPatterns, ",") {
+			policy.ErrorPatterns = append(policy.ErrorPatterns, strings.TrimSpace(pattern))
+		}
+	}
+	return policy, nil
+}
+
+// Validate checks the attempts, the durations and the patterns of the policy
+func (p *RetryPolicy) Validate() error {
+	_, err := p.resolve()
+	return err
+}
+
+// retryPolicy is a policy with its defaults applied and its fields parsed
+type retryPolicy struct {
+	maxAttempts   int
+	backoff       time.Duration
+	maxWait       time.Duration
+	statusCodes   map[int]bool
+	errorPatterns []*regexp.Regexp
+}
+
+func (p *RetryPolicy) resolve() (*retryPolicy, error) {
+	if p == nil {
+		p = &RetryPolicy{}
+	}
+	resolved := &retryPolicy{
+		maxAttempts: DEFAULT_RETRY_MAX_ATTEMPTS,
+		backoff:     DEFAULT_RETRY_BACKOFF,
+		maxWait:     DEFAULT_RETRY_MAX_WAIT,
+		statusCodes: make(map[int]bool),
+	}
+	if p.MaxAttempts < 0 {
+		return nil, fmt.Errorf("the max attempts of the retry policy must not be negative, 0 for the default. found: %d", p.MaxAttempts)
+	}
+	if p.MaxAttempts > 0 {
+		resolved.maxAttempts = p.MaxAttempts
+	}
+	if p.Backoff != "" {
+		backoff, err := time.ParseDuration(p.Backoff)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse the retry backoff %s as a duration. %v", p.Backoff, err)
+		}
+		resolved.backoff = backoff
+	}
+	if p.MaxWait != "" {
+		maxWait, err := time.ParseDuration(p.MaxWait)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse the retry max wait %s as a duration. %v", p.MaxWait, err)
+		}
+		resolved.maxWait = maxWait
+	}
+	if resolved.maxWait < resolved.backoff {
+		return nil, fmt.Errorf("the retry max wait %s must not be shorter than the backoff %s", resolved.maxWait, resolved.backoff)
+	}
+	for _, code := range p.StatusCodes {
+		resolved.statusCodes[code] = true
+	}
+	patterns := p.ErrorPatterns
+	if len(p.StatusCodes) == 0 && len(p.ErrorPatterns) == 0 {
+		patterns = DEFAULT_RETRY_ERROR_PATTERNS
+	}
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compile the retryable error pattern %q. %v", pattern, err)
+		}
+		resolved.errorPatterns = append(resolved.errorPatterns, re)
+	}
+	return resolved, nil
+}
+
+// apply configures the client with the policy, and counts the retries
+func (p *retryPolicy) apply(r *resty.Client, retries *int64) {
+	r.SetRetryCount(p.maxAttempts - 1).
+		SetRetryWaitTime(p.backoff).
+		SetRetryMaxWaitTime(p.maxWait).
+		AddRetryCondition(func(resp *resty.Response, err error) bool {
+			return p.retryable(resp)
+		}).
+		AddRetryHook(func(resp *resty.Response, err error) {
+			// the hook is also called after the last attempt, which is not retried
+			if resp == nil || resp.Request.Attempt >= p.maxAttempts {
+				return
+			}
+			atomic.AddInt64(retries, 1)
+			log.Debugf("Retrying %s %s after [%d] %s. Attempt %d of %d", resp.Request.Method, resp.Request.URL, resp.StatusCode(), resp.String(), resp.Request.Attempt+1, p.maxAttempts)
+		})
+}
+
+func (p *retryPolicy) retryable(resp *resty.Response) bool {
+	if resp == nil || resp.StatusCode() <= 202 {
+		return false
+	}
+	if p.statusCodes[resp.StatusCode()] {
+		return true
+	}
+	if len(p.errorPatterns) == 0 {
+		return false
+	}
+	var errMsg ErrorMessage
+	err := json.Unmarshal(resp.Body(), &errMsg)
+	if err != nil {
+		return false
+	}
+	for _, pattern := range p.errorPatterns {
+		if pattern.MatchString(errMsg.Message) {
+			return true
+		}
+	}
+	return false
+}
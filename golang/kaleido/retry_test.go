@@ -0,0 +1,135 @@
+package kaleido
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+)
+
+func TestRetryPolicyResolve(t *testing.T) {
+	cases := []struct {
+		name        string
+		policy      *RetryPolicy
+		maxAttempts int
+		backoff     time.Duration
+		maxWait     time.Duration
+		statusCodes int
+		patterns    int
+		invalid     bool
+	}{
+		{"nil policy", nil, DEFAULT_RETRY_MAX_ATTEMPTS, DEFAULT_RETRY_BACKOFF, DEFAULT_RETRY_MAX_WAIT, 0, len(DEFAULT_RETRY_ERROR_PATTERNS), false},
+		{"empty policy", &RetryPolicy{}, DEFAULT_RETRY_MAX_ATTEMPTS, DEFAULT_RETRY_BACKOFF, DEFAULT_RETRY_MAX_WAIT, 0, len(DEFAULT_RETRY_ERROR_PATTERNS), false},
+		{"max attempts", &RetryPolicy{MaxAttempts: 3}, 3, DEFAULT_RETRY_BACKOFF, DEFAULT_RETRY_MAX_WAIT, 0, len(DEFAULT_RETRY_ERROR_PATTERNS), false},
+		{"single attempt", &RetryPolicy{MaxAttempts: 1}, 1, DEFAULT_RETRY_BACKOFF, DEFAULT_RETRY_MAX_WAIT, 0, len(DEFAULT_RETRY_ERROR_PATTERNS), false},
+		{"negative max attempts", &RetryPolicy{MaxAttempts: -1}, 0, 0, 0, 0, 0, true},
+		{"durations", &RetryPolicy{Backoff: "50ms", MaxWait: "5s"}, DEFAULT_RETRY_MAX_ATTEMPTS, 50 * time.Millisecond, 5 * time.Second, 0, len(DEFAULT_RETRY_ERROR_PATTERNS), false},
+		{"invalid backoff", &RetryPolicy{Backoff: "soon"}, 0, 0, 0, 0, 0, true},
+		{"invalid max wait", &RetryPolicy{MaxWait: "later"}, 0, 0, 0, 0, 0, true},
+		{"max wait shorter than the backoff", &RetryPolicy{Backoff: "3s"}, 0, 0, 0, 0, 0, true},
+		{"status codes replace the default patterns", &RetryPolicy{StatusCodes: []int{429, 503}}, DEFAULT_RETRY_MAX_ATTEMPTS, DEFAULT_RETRY_BACKOFF, DEFAULT_RETRY_MAX_WAIT, 2, 0, false},
+		{"patterns replace the default ones", &RetryPolicy{ErrorPatterns: []string{"busy", "^timeout"}}, DEFAULT_RETRY_MAX_ATTEMPTS, DEFAULT_RETRY_BACKOFF, DEFAULT_RETRY_MAX_WAIT, 0, 2, false},
+		{"invalid pattern", &RetryPolicy{ErrorPatterns: []string{"("}}, 0, 0, 0, 0, 0, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			resolved, err := c.policy.resolve()
+			if c.invalid {
+				if err == nil {
+					t.Fatalf("expected the policy to be rejected")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error. %v", err)
+			}
+			if resolved.maxAttempts != c.maxAttempts {
+				t.Errorf("expected %d max attempts. found: %d", c.maxAttempts, resolved.maxAttempts)
+			}
+			if resolved.backoff != c.backoff {
+				t.Errorf("expected a backoff of %s. found: %s", c.backoff, resolved.backoff)
+			}
+			if resolved.maxWait != c.maxWait {
+				t.Errorf("expected a max wait of %s. found: %s", c.maxWait, resolved.maxWait)
+			}
+			if len(resolved.statusCodes) != c.statusCodes {
+				t.Errorf("expected %d status codes. found: %d", c.statusCodes, len(resolved.statusCodes))
+			}
+			if len(resolved.errorPatterns) != c.patterns {
+				t.Errorf("expected %d error patterns. found: %d", c.patterns, len(resolved.errorPatterns))
+			}
+		})
+	}
+}
+
+func TestRetryPolicyRetryable(t *testing.T) {
+	cases := []struct {
+		name       string
+		policy     *RetryPolicy
+		statusCode int
+		body       string
+		retryable  bool
+	}{
+		{"accepted", nil, 202, `{}`, false},
+		{"too many in-flight transactions", nil, 500, `{"error":"Too many in-flight transactions"}`, true},
+		{"other error", nil, 500, `{"error":"endorsement failure"}`, false},
+		{"error that only contains the default pattern", nil, 500, `{"error":"Too many in-flight transactions, and more"}`, false},
+		{"body that is not JSON", nil, 500, `Too many in-flight transactions`, false},
+		{"status code", &RetryPolicy{StatusCodes: []int{503}}, 503, `unavailable`, true},
+		{"status code not listed", &RetryPolicy{StatusCodes: []int{503}}, 500, `{"error":"Too many in-flight transactions"}`, false},
+		{"custom pattern", &RetryPolicy{ErrorPatterns: []string{"busy"}}, 409, `{"error":"the peer is busy"}`, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(c.statusCode)
+				w.Write([]byte(c.body))
+			}))
+			defer server.Close()
+			resolved, err := c.policy.resolve()
+			if err != nil {
+				t.Fatalf("unexpected error. %v", err)
+			}
+			resp, err := resty.New().R().Get(server.URL)
+			if err != nil {
+				t.Fatalf("unexpected error. %v", err)
+			}
+			if retryable := resolved.retryable(resp); retryable != c.retryable {
+				t.Errorf("expected retryable to be %v. found: %v", c.retryable, retryable)
+			}
+		})
+	}
+}
+
+func TestRetryPolicyApplyCountsRetries(t *testing.T) {
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	resolved, err := (&RetryPolicy{MaxAttempts: 4, Backoff: "1ms", MaxWait: "1ms", StatusCodes: []int{503}}).resolve()
+	if err != nil {
+		t.Fatalf("unexpected error. %v", err)
+	}
+	r := resty.New()
+	retries := new(int64)
+	resolved.apply(r, retries)
+	resp, err := r.R().Post(server.URL)
+	if err != nil {
+		t.Fatalf("unexpected error. %v", err)
+	}
+	if resp.StatusCode() != http.StatusAccepted {
+		t.Errorf("expected the request to succeed after the retries. found: %d", resp.StatusCode())
+	}
+	if attempts != 3 || *retries != 2 {
+		t.Errorf("expected 3 attempts and 2 retries. found: %d attempts, %d retries", attempts, *retries)
+	}
+}
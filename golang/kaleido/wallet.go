@@ -34,7 +34,7 @@ func (w *Wallet) InitIdentity() error {
 	si, err := mspClient.GetSigningIdentity(w.UserName)
 	if err != nil {
 		fmt.Printf("Failed to get signing identity: %v. Assuming this is a new user and will attempt to register and enroll.\n", err)
-		baseUrl := getApiUrl()
+		baseUrl := w.network.config.URL
 		svcId := w.network.MyCA.ID
 
 		var existingRegistrations []map[string]interface{}
@@ -0,0 +1,161 @@
+package kaleido
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// WebhookConfig is where FabConnect delivers the events of a webhook event stream, and the
+// address the receiver started by the client listens on, by default the port of the URL on
+// all the interfaces. The receiver serves plain HTTP, so an https URL needs a proxy in front
+type WebhookConfig struct {
+	URL               string            `yaml:"url,omitempty" json:"url,omitempty"`
+	Headers           map[string]string `yaml:"headers,omitempty" json:"headers,omitempty"`
+	TLSSkipHostVerify bool              `yaml:"tlsSkipHostVerify,omitempty" json:"tlsSkipHostVerify,omitempty"`
+	RequestTimeout    string            `yaml:"requestTimeout,omitempty" json:"requestTimeout,omitempty"`
+	ListenAddress     string            `yaml:"listenAddress,omitempty" json:"listenAddress,omitempty"`
+}
+
+// WebhookSpec is the webhook FabConnect posts the batches of events of a stream to
+type WebhookSpec struct {
+	URL               string            `json:"url,omitempty"`
+	Headers           map[string]string `json:"headers,omitempty"`
+	TLSSkipHostVerify bool              `json:"tlsSkipHostVerify,omitempty"`
+	RequestTimeoutSec int               `json:"requestTimeoutSec,omitempty"`
+}
+
+// WebhookConfigFromEnv returns nil unless WEBHOOK_URL is set. WEBHOOK_HEADERS is a comma
+// separated list of name=value pairs
+func WebhookConfigFromEnv() (*WebhookConfig, error) {
+	if os.Getenv("WEBHOOK_URL") == "" {
+		return nil, nil
+	}
+	var headers map[string]string
+	if os.Getenv("WEBHOOK_HEADERS") != "" {
+		headers = make(map[string]string)
+		for _, header := range strings.Split(os.Getenv("WEBHOOK_HEADERS"), ",") {
+			parts := strings.SplitN(header, "=", 2)
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("webhook headers must be name=value pairs. found: %q", header)
+			}
+			headers[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+		}
+	}
+	return &WebhookConfig{
+		URL:               os.Getenv("WEBHOOK_URL"),
+		Headers:           headers,
+		TLSSkipHostVerify: strings.ToLower(os.Getenv("WEBHOOK_TLS_SKIP_VERIFY")) == "true",
+		RequestTimeout:    os.Getenv("WEBHOOK_REQUEST_TIMEOUT"),
+		ListenAddress:     os.Getenv("WEBHOOK_LISTEN_ADDRESS"),
+	}, nil
+}
+
+// Validate checks the URL and the request timeout of the webhook
+func (w *WebhookConfig) Validate() error {
+	_, err := w.spec()
+	if err != nil {
+		return err
+	}
+	_, err = w.listenAddress()
+	return err
+}
+
+func (w *WebhookConfig) spec() (*WebhookSpec, error) {
+	spec := &WebhookSpec{
+		URL:               w.URL,
+		Headers:           w.Headers,
+		TLSSkipHostVerify: w.TLSSkipHostVerify,
+	}
+	if w.RequestTimeout != "" {
+		timeout, err := time.ParseDuration(w.RequestTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse the webhook request timeout %s as a duration. %v", w.RequestTimeout, err)
+		}
+		// FabConnect takes whole seconds
+		spec.RequestTimeoutSec = int((timeout + time.Second - 1) / time.Second)
+	}
+	return spec, nil
+}
+
+func (w *WebhookConfig) listenAddress() (string, error) {
+	u, err := url.Parse(w.URL)
+	if err != nil || u.Host == "" {
+		return "", fmt.Errorf("invalid webhook URL %q", w.URL)
+	}
+	if w.ListenAddress != "" {
+		return w.ListenAddress, nil
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return ":" + port, nil
+}
+
+// startWebhookReceiver listens for the batches of events posted by FabConnect. A batch is
+// acked by the response, once it has been processed, so the batches are processed one at
+// a time in the order they are delivered
+func (f *FabconnectClient) startWebhookReceiver(handler EventHandler, names map[string]bool) error {
+	address, err := f.Webhook.listenAddress()
+	if err != nil {
+		return err
+	}
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s for the webhook. %v", address, err)
+	}
+
+	// the batches are processed one at a time, and the events seen are dropped
+	var mu sync.Mutex
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		events := []Event{}
+		err := json.NewDecoder(r.Body).Decode(&events)
+		if err != nil {
+			// not acked, so a batch that failed to parse is delivered again
+			invalid := atomic.AddInt64(&f.events.invalid, 1)
+			log.Errorf("Failed to unmarshal the webhook request. Invalid messages: %d. %v", invalid, err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		processed := f.processEvents(events, handler, names)
+		mu.Unlock()
+		if !processed {
+			// stopping, so the rest of the batch is delivered again to the next receiver
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	server := &http.Server{Handler: mux}
+	f.events.mu.Lock()
+	f.events.receiver = server
+	f.events.mu.Unlock()
+	go func() {
+		err := server.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			log.Errorf("Webhook receiver failed. %v", err)
+		}
+	}()
+	log.Infof("Receiving the events of webhook %s on %s", f.Webhook.URL, listener.Addr())
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/kaleido-io/kaleido-fabric-go/kaleido"
+)
+
+const ledgerUsage = `Usage: kfg ledger <command> <channel> [args]
+
+Commands:
+  chaininfo <channel>                         show the height of the ledger and the hashes of its last blocks
+  block <channel> <number>                    show a block and its transactions
+  block-by-tx <channel> <transaction ID>      show the block a transaction has been committed in
+  tx <channel> <transaction ID>               show a transaction
+
+The FabConnect instance is configured with the FABCONNECT_* environment variables, and
+the ledger is queried as the USER_ID identity`
+
+// ledger queries the ledger of a channel through FabConnect
+func ledger(args []string) {
+	if len(args) < 2 {
+		fmt.Println(ledgerUsage)
+		os.Exit(1)
+	}
+	username := os.Getenv("USER_ID")
+	if username == "" {
+		username = "user1"
+	}
+	client, err := kaleido.NewFabconnectClient(kaleido.FabconnectConfigFromEnv(), username)
+	if err == nil {
+		err = runLedgerCommand(client, args[0], args[1], args[2:])
+	}
+	if err != nil {
+		fmt.Printf("\nLedger %s failed: %v\n", args[0], err)
+		os.Exit(1)
+	}
+}
+
+func runLedgerCommand(client *kaleido.FabconnectClient, command, channel string, args []string) error {
+	argCount := 1
+	if command == "chaininfo" {
+		argCount = 0
+	}
+	if len(args) != argCount {
+		fmt.Println(ledgerUsage)
+		return fmt.Errorf("expected %d argument(s) after the channel, found %d", argCount, len(args))
+	}
+
+	var result interface{}
+	var err error
+	switch command {
+	case "chaininfo":
+		result, err = client.GetChainInfo(channel)
+	case "block":
+		blockNumber, parseErr := strconv.ParseUint(args[0], 10, 64)
+		if parseErr != nil {
+			return fmt.Errorf("invalid block number %q", args[0])
+		}
+		result, err = client.GetBlock(channel, blockNumber)
+	case "block-by-tx":
+		result, err = client.GetBlockByTxId(channel, args[0])
+	case "tx":
+		result, err = client.GetTransaction(channel, args[0])
+	default:
+		fmt.Println(ledgerUsage)
+		return fmt.Errorf("unknown command %q", command)
+	}
+	if err != nil {
+		return err
+	}
+	return printJSON(result)
+}
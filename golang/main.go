@@ -1,11 +1,12 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"math/rand"
 	"os"
-	"strconv"
-	"strings"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/kaleido-io/kaleido-fabric-go/runners"
@@ -23,63 +24,91 @@ func main() {
 
 	rand.Seed(time.Now().UTC().UnixNano())
 
-	username := os.Getenv("USER_ID")
-	if username == "" {
-		username = "user1"
+	// "kfg compare <results file> <baseline file>" compares the results of a previous run with a baseline
+	if len(os.Args) > 1 && os.Args[1] == "compare" {
+		compare(os.Args[2:])
+		return
 	}
 
-	channel := os.Getenv("CHANNEL_ID")
-	if channel == "" {
-		channel = "default-channel"
+	// "kfg identity <command>" manages the identities of the FabConnect instance
+	if len(os.Args) > 1 && os.Args[1] == "identity" {
+		identity(os.Args[2:])
+		return
 	}
 
-	ccname := os.Getenv("CCNAME")
-	if ccname == "" {
-		ccname = "asset_transfer"
+	// "kfg ledger <command> <channel>" queries the chain info, blocks and transactions of a channel
+	if len(os.Args) > 1 && os.Args[1] == "ledger" {
+		ledger(os.Args[2:])
+		return
 	}
 
-	initChaincode := os.Getenv("INIT_CC")
-	if initChaincode == "" {
-		initChaincode = "false"
-	} else {
-		initChaincode = strings.ToLower(initChaincode)
-	}
+	// cancel the run on SIGINT/SIGTERM, so the runners can stop dispatching transactions,
+	// report on what has completed so far and clean up. A second signal exits immediately
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		log.Warnf("Received %s, shutting down. Send it again to exit immediately", sig)
+		cancel()
+		<-sigs
+		os.Exit(1)
+	}()
 
-	var err error
-	var count int
-	countStr := os.Getenv("TX_COUNT")
-	if countStr != "" {
-		count, err = strconv.Atoi(countStr)
+	// "kfg agent" runs the shares of the scenarios handed out by a coordinator
+	if len(os.Args) > 1 && os.Args[1] == "agent" {
+		agent := runners.NewAgent(os.Getenv("AGENT_ADDRESS"))
+		err := agent.Serve(ctx)
 		if err != nil {
-			fmt.Printf("Failed to convert %s to integer", countStr)
+			fmt.Printf("\nAgent failed: %v\n", err)
 			os.Exit(1)
 		}
-	} else {
-		count = 1
+		return
 	}
 
-	var workers int
-	workersStr := os.Getenv("WORKERS")
-	if workersStr != "" {
-		workers, err = strconv.Atoi(workersStr)
-		if err != nil {
-			fmt.Printf("Failed to convert %s to integer", workersStr)
-			os.Exit(1)
-		}
+	var scenario *runners.Scenario
+	var err error
+	scenarioFile := os.Getenv("SCENARIO")
+	if scenarioFile != "" {
+		scenario, err = runners.LoadScenario(scenarioFile)
 	} else {
-		workers = 1
+		scenario, err = runners.ScenarioFromEnv()
+	}
+	if err != nil {
+		fmt.Printf("Failed to load the scenario. %v\n", err)
+		os.Exit(1)
 	}
 
-	init := initChaincode == "true"
-
-	useFabconnect := os.Getenv("USE_FABCONNECT")
-	if useFabconnect == "true" {
-		runner := runners.NewFabconnectRunner(username, channel, ccname, count, workers, init)
-		_ = runner.Exec()
+	if len(scenario.Agents) > 0 {
+		coordinator := runners.NewCoordinator(scenario)
+		err = coordinator.Exec(ctx)
+	} else if scenario.Target.Type == runners.TARGET_FABCONNECT {
+		runner := runners.NewFabconnectRunner(scenario)
+		err = runner.Exec(ctx)
 	} else {
-		runner := runners.NewSDKRunner(username, channel, ccname, count, workers, init)
-		_ = runner.Exec()
+		runner := runners.NewSDKRunner(scenario)
+		err = runner.Exec(ctx)
+	}
+	if err != nil {
+		fmt.Printf("\nRun failed: %v\n", err)
+		os.Exit(1)
 	}
 
 	fmt.Printf("\nAll Done!\n")
 }
+
+func compare(args []string) {
+	if len(args) != 2 {
+		fmt.Println("Usage: kfg compare <results file> <baseline file>")
+		os.Exit(1)
+	}
+	thresholds, err := runners.ThresholdsFromEnv()
+	if err == nil {
+		err = runners.CompareResultFiles(args[0], args[1], thresholds)
+	}
+	if err != nil {
+		fmt.Printf("\nComparison failed: %v\n", err)
+		os.Exit(1)
+	}
+}
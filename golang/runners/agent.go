@@ -0,0 +1,417 @@
+package runners
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	AGENT_IDLE      = "idle"
+	AGENT_PREPARING = "preparing"
+	AGENT_READY     = "ready"
+	AGENT_WAITING   = "waiting"
+	AGENT_RUNNING   = "running"
+	AGENT_DONE      = "done"
+	AGENT_FAILED    = "failed"
+)
+
+var DEFAULT_AGENT_ADDRESS = ":8090"
+
+// how long a ready agent waits for the coordinator to send the start time, before it
+// gives up and releases the connections and the event subscriptions
+var AGENT_START_TIMEOUT time.Duration = time.Duration(5) * time.Minute
+
+// runner is implemented by the SDK and FabConnect runners, so an agent can run
+// its share of a scenario with either and report on the phases. The identities, the
+// connections and the event subscriptions are set up by prepare, so the transactions
+// of all the agents are dispatched from the same start time
+type runner interface {
+	prepare(ctx context.Context) error
+	dispatch(ctx context.Context) error
+	// close releases what prepare has set up, whether the run was dispatched or not
+	close()
+	phaseSummaries() []*phaseSummary
+}
+
+// cleanups are the calls that release what a runner has set up, run in the
+// reverse order, like deferred calls
+type cleanups []func()
+
+func (c *cleanups) add(cleanup func()) {
+	*c = append(*c, cleanup)
+}
+
+func (c *cleanups) run() {
+	for i := len(*c) - 1; i >= 0; i-- {
+		(*c)[i]()
+	}
+	*c = nil
+}
+
+func newRunner(scenario *Scenario) runner {
+	if scenario.Target.Type == TARGET_FABCONNECT {
+		return NewFabconnectRunner(scenario)
+	}
+	return NewSDKRunner(scenario)
+}
+
+// agentRunRequest is sent by the coordinator to an agent, with the agent's share of the
+// scenario to prepare
+type agentRunRequest struct {
+	Scenario *Scenario `json:"scenario"`
+}
+
+// agentStartRequest is sent by the coordinator to each agent once they are all ready,
+// with the time they all start at
+type agentStartRequest struct {
+	StartAt time.Time `json:"startAt"`
+}
+
+// agentStatus is returned by an agent, with the results of the phases once it is done
+type agentStatus struct {
+	State  string               `json:"state"`
+	Error  string               `json:"error,omitempty"`
+	Phases []*agentPhaseResults `json:"phases,omitempty"`
+}
+
+// agentPhaseResults carries a phase summary between an agent and the coordinator,
+// including the latency of each confirmed transaction so the percentiles can be merged
+type agentPhaseResults struct {
+	Phase          string                `json:"phase"`
+	Expected       int                   `json:"expected"`
+	Submitted      int                   `json:"submitted"`
+	Payload        int                   `json:"payload"`
+	MaxPayload     int                   `json:"maxPayload"`
+	Confirmed      int                   `json:"confirmed"`
+	Failed         int                   `json:"failed"`
+	Failures       map[failureClass]int  `json:"failures,omitempty"`
+	Functions      map[string]agentStats `json:"functions,omitempty"`
+	Identities     map[string]agentStats `json:"identities,omitempty"`
+	Channels       map[string]agentStats `json:"channels,omitempty"`
+	Chaincodes     map[string]agentStats `json:"chaincodes,omitempty"`
+	Conflicts      int                   `json:"conflicts"`
+	Retries        int                   `json:"retries"`
+	Recovered      int                   `json:"recovered"`
+	Reconnects     int                   `json:"reconnects"`
+	RequestRetries int                   `json:"requestRetries"`
+	Missing        []string              `json:"missing,omitempty"`
+	Interrupted    bool                  `json:"interrupted"`
+	Elapsed        time.Duration         `json:"elapsed"`
+	Latencies      []time.Duration       `json:"latencies,omitempty"`
+}
+
+type agentStats struct {
+	Submitted int `json:"submitted"`
+	Confirmed int `json:"confirmed"`
+	Failed    int `json:"failed"`
+}
+
+// Agent runs the share of a scenario handed out by a coordinator, and reports
+// the results back over HTTP:
+//   - POST /run prepares a run, with an agentRunRequest. The agent is ready once the run is prepared
+//   - POST /run/start starts the prepared run, with an agentStartRequest
+//   - GET /run returns the agentStatus
+//   - POST /run/stop interrupts the run
+type Agent struct {
+	address   string
+	mu        sync.Mutex
+	state     string
+	err       error
+	summaries []*phaseSummary
+	cancel    context.CancelFunc
+	starts    chan time.Time
+}
+
+func NewAgent(address string) *Agent {
+	if address == "" {
+		address = DEFAULT_AGENT_ADDRESS
+	}
+	return &Agent{
+		address: address,
+		state:   AGENT_IDLE,
+	}
+}
+
+// Serve handles the requests of the coordinator until the context is cancelled
+func (a *Agent) Serve(ctx context.Context) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/run", a.handleRun)
+	mux.HandleFunc("/run/start", a.handleStart)
+	mux.HandleFunc("/run/stop", a.handleStop)
+	server := &http.Server{Addr: a.address, Handler: mux}
+
+	go func() {
+		<-ctx.Done()
+		a.stop()
+		server.Close()
+	}()
+
+	log.Infof("Agent listening on %s", a.address)
+	err := server.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
+		return fmt.Errorf("agent failed to listen on %s. %v", a.address, err)
+	}
+	return nil
+}
+
+func (a *Agent) handleRun(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, a.status())
+	case http.MethodPost:
+		var req agentRunRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err == nil && req.Scenario == nil {
+			err = fmt.Errorf("the scenario is required")
+		}
+		if err == nil {
+			err = req.Scenario.validate()
+		}
+		if err == nil {
+			// nobody is there to answer a prompt on the agent
+			err = req.Scenario.validateHeadless()
+		}
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("invalid run request. %v", err)})
+			return
+		}
+		err = a.prepare(req.Scenario)
+		if err != nil {
+			writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusAccepted, a.status())
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (a *Agent) handleStart(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var req agentStartRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("invalid start request. %v", err)})
+		return
+	}
+	err = a.start(req.StartAt)
+	if err != nil {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusAccepted, a.status())
+}
+
+func (a *Agent) handleStop(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	a.stop()
+	writeJSON(w, http.StatusOK, a.status())
+}
+
+// prepare sets up the run of the scenario in the background, then waits for the start time
+func (a *Agent) prepare(scenario *Scenario) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	switch a.state {
+	case AGENT_PREPARING, AGENT_READY, AGENT_WAITING, AGENT_RUNNING:
+		return fmt.Errorf("the agent is already running")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	starts := make(chan time.Time, 1)
+	a.state = AGENT_PREPARING
+	a.err = nil
+	a.summaries = nil
+	a.cancel = cancel
+	a.starts = starts
+
+	go func() {
+		defer cancel()
+		log.Infof("Preparing scenario %s", scenario.Name)
+		r := newRunner(scenario)
+		err := a.run(ctx, r, starts)
+		a.finish(r.phaseSummaries(), err)
+	}()
+	return nil
+}
+
+// run prepares the runner and dispatches the transactions at the start time sent by the
+// coordinator. The runner is closed before the agent reports it is done
+func (a *Agent) run(ctx context.Context, r runner, starts chan time.Time) error {
+	defer r.close()
+	err := r.prepare(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to prepare the run. %v", err)
+	}
+	a.setState(AGENT_READY)
+	log.Infof("Ready to start")
+
+	var startAt time.Time
+	timer := time.NewTimer(AGENT_START_TIMEOUT)
+	defer timer.Stop()
+	select {
+	case startAt = <-starts:
+	case <-timer.C:
+		return fmt.Errorf("no start time received within %s of being ready", AGENT_START_TIMEOUT)
+	case <-ctx.Done():
+		return fmt.Errorf("run stopped before it started")
+	}
+	log.Infof("Starting at %s", startAt.Format(time.RFC3339Nano))
+	select {
+	case <-time.After(time.Until(startAt)):
+	case <-ctx.Done():
+		return fmt.Errorf("run stopped before it started")
+	}
+	a.setState(AGENT_RUNNING)
+	return r.dispatch(ctx)
+}
+
+// start sets the time a prepared run starts at
+func (a *Agent) start(startAt time.Time) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.state != AGENT_READY {
+		return fmt.Errorf("the agent is not ready to start. state: %s", a.state)
+	}
+	if time.Until(startAt) <= 0 {
+		// the other agents may already have started
+		return fmt.Errorf("the start time %s has already passed", startAt.Format(time.RFC3339Nano))
+	}
+	a.state = AGENT_WAITING
+	a.starts <- startAt
+	return nil
+}
+
+func (a *Agent) setState(state string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.state = state
+}
+
+func (a *Agent) finish(summaries []*phaseSummary, err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.summaries = summaries
+	a.err = err
+	if err != nil {
+		log.Errorf("Run failed. %v", err)
+		a.state = AGENT_FAILED
+	} else {
+		log.Infof("Run completed")
+		a.state = AGENT_DONE
+	}
+}
+
+func (a *Agent) stop() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.cancel != nil {
+		a.cancel()
+	}
+}
+
+func (a *Agent) status() *agentStatus {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	status := &agentStatus{State: a.state}
+	if a.err != nil {
+		status.Error = a.err.Error()
+	}
+	for _, summary := range a.summaries {
+		status.Phases = append(status.Phases, newAgentPhaseResults(summary))
+	}
+	return status
+}
+
+func writeJSON(w http.ResponseWriter, statusCode int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	err := json.NewEncoder(w).Encode(body)
+	if err != nil {
+		log.Errorf("Failed to write response. %v", err)
+	}
+}
+
+func newAgentPhaseResults(summary *phaseSummary) *agentPhaseResults {
+	return &agentPhaseResults{
+		Phase:          summary.phase,
+		Expected:       summary.expected,
+		Submitted:      summary.submitted,
+		Payload:        summary.payload,
+		MaxPayload:     summary.maxPayload,
+		Confirmed:      summary.confirmed,
+		Failed:         summary.failed,
+		Failures:       summary.failures,
+		Functions:      toAgentStats(summary.functions),
+		Identities:     toAgentStats(summary.identities),
+		Channels:       toAgentStats(summary.channels),
+		Chaincodes:     toAgentStats(summary.chaincodes),
+		Conflicts:      summary.conflicts,
+		Retries:        summary.retries,
+		Recovered:      summary.recovered,
+		Reconnects:     summary.reconnects,
+		RequestRetries: summary.requestRetries,
+		Missing:        summary.missing,
+		Interrupted:    summary.interrupted,
+		Elapsed:        summary.elapsed,
+		Latencies:      summary.latencies,
+	}
+}
+
+func (r *agentPhaseResults) summary() *phaseSummary {
+	failures := r.Failures
+	if failures == nil {
+		failures = make(map[failureClass]int)
+	}
+	return &phaseSummary{
+		phase:          r.Phase,
+		expected:       r.Expected,
+		submitted:      r.Submitted,
+		payload:        r.Payload,
+		maxPayload:     r.MaxPayload,
+		latency:        newLatencyStats(r.Latencies),
+		latencies:      r.Latencies,
+		confirmed:      r.Confirmed,
+		failed:         r.Failed,
+		failures:       failures,
+		functions:      fromAgentStats(r.Functions),
+		identities:     fromAgentStats(r.Identities),
+		channels:       fromAgentStats(r.Channels),
+		chaincodes:     fromAgentStats(r.Chaincodes),
+		conflicts:      r.Conflicts,
+		retries:        r.Retries,
+		recovered:      r.Recovered,
+		reconnects:     r.Reconnects,
+		requestRetries: r.RequestRetries,
+		missing:        r.Missing,
+		interrupted:    r.Interrupted,
+		elapsed:        r.Elapsed,
+	}
+}
+
+func toAgentStats(all map[string]txStats) map[string]agentStats {
+	converted := make(map[string]agentStats)
+	for key, stats := range all {
+		converted[key] = agentStats{Submitted: stats.submitted, Confirmed: stats.confirmed, Failed: stats.failed}
+	}
+	return converted
+}
+
+func fromAgentStats(all map[string]agentStats) map[string]txStats {
+	converted := make(map[string]txStats)
+	for key, stats := range all {
+		converted[key] = txStats{submitted: stats.Submitted, confirmed: stats.Confirmed, failed: stats.Failed}
+	}
+	return converted
+}
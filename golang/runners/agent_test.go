@@ -0,0 +1,170 @@
+package runners
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeRunner records when it is dispatched, and whether it is closed
+type fakeRunner struct {
+	prepareErr error
+	dispatched time.Time
+	closed     bool
+}
+
+func (r *fakeRunner) prepare(ctx context.Context) error {
+	return r.prepareErr
+}
+
+func (r *fakeRunner) dispatch(ctx context.Context) error {
+	r.dispatched = time.Now()
+	return nil
+}
+
+func (r *fakeRunner) close() {
+	r.closed = true
+}
+
+func (r *fakeRunner) phaseSummaries() []*phaseSummary {
+	return nil
+}
+
+// runAgent runs the fake runner on an agent, as started by prepare
+func runAgent(a *Agent, r *fakeRunner) (context.CancelFunc, chan error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	a.state = AGENT_PREPARING
+	a.starts = make(chan time.Time, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- a.run(ctx, r, a.starts)
+	}()
+	return cancel, done
+}
+
+func waitForState(t *testing.T, a *Agent, state string) {
+	deadline := time.Now().Add(time.Second)
+	for a.status().State != state {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the agent to be %s. found: %s", state, a.status().State)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestAgentDispatchesAtTheStartTime(t *testing.T) {
+	a := NewAgent("")
+	r := &fakeRunner{}
+	cancel, done := runAgent(a, r)
+	defer cancel()
+
+	waitForState(t, a, AGENT_READY)
+	startAt := time.Now().Add(50 * time.Millisecond)
+	err := a.start(startAt)
+	if err != nil {
+		t.Fatalf("unexpected error. %v", err)
+	}
+	if err := a.start(startAt); err == nil {
+		t.Errorf("expected the start time to be sent only once")
+	}
+	err = <-done
+	if err != nil {
+		t.Fatalf("unexpected error. %v", err)
+	}
+	if r.dispatched.Before(startAt) {
+		t.Errorf("expected the run to be dispatched at %s. found: %s", startAt, r.dispatched)
+	}
+	if !r.closed {
+		t.Errorf("expected the runner to be closed")
+	}
+}
+
+func TestAgentStart(t *testing.T) {
+	cases := []struct {
+		name    string
+		state   string
+		startAt time.Time
+		invalid string
+	}{
+		{"ready", AGENT_READY, time.Now().Add(time.Minute), ""},
+		{"preparing", AGENT_PREPARING, time.Now().Add(time.Minute), "not ready"},
+		{"already started", AGENT_WAITING, time.Now().Add(time.Minute), "not ready"},
+		{"idle", AGENT_IDLE, time.Now().Add(time.Minute), "not ready"},
+		{"start time passed", AGENT_READY, time.Now().Add(-time.Second), "already passed"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			a := NewAgent("")
+			a.state = c.state
+			a.starts = make(chan time.Time, 1)
+			err := a.start(c.startAt)
+			if c.invalid != "" {
+				if err == nil || !strings.Contains(err.Error(), c.invalid) {
+					t.Fatalf("expected an error about %s. found: %v", c.invalid, err)
+				}
+				if a.state != c.state {
+					t.Errorf("expected the agent to stay %s. found: %s", c.state, a.state)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error. %v", err)
+			}
+			if a.state != AGENT_WAITING || len(a.starts) != 1 {
+				t.Errorf("expected the agent to wait for the start time. found: %s", a.state)
+			}
+		})
+	}
+}
+
+func TestAgentFailsToPrepare(t *testing.T) {
+	a := NewAgent("")
+	r := &fakeRunner{prepareErr: fmt.Errorf("enrollment failed")}
+	cancel, done := runAgent(a, r)
+	defer cancel()
+
+	err := <-done
+	if err == nil || !strings.Contains(err.Error(), "enrollment failed") {
+		t.Fatalf("expected the run to fail to prepare. found: %v", err)
+	}
+	if !r.dispatched.IsZero() || !r.closed {
+		t.Errorf("expected the runner to be closed without being dispatched")
+	}
+}
+
+func TestAgentStoppedBeforeTheStart(t *testing.T) {
+	a := NewAgent("")
+	r := &fakeRunner{}
+	cancel, done := runAgent(a, r)
+
+	waitForState(t, a, AGENT_READY)
+	cancel()
+	err := <-done
+	if err == nil || !strings.Contains(err.Error(), "stopped before it started") {
+		t.Fatalf("expected the run to be stopped. found: %v", err)
+	}
+	if !r.dispatched.IsZero() || !r.closed {
+		t.Errorf("expected the runner to be closed without being dispatched")
+	}
+}
+
+func TestAgentStartTimeout(t *testing.T) {
+	timeout := AGENT_START_TIMEOUT
+	AGENT_START_TIMEOUT = 10 * time.Millisecond
+	defer func() { AGENT_START_TIMEOUT = timeout }()
+
+	a := NewAgent("")
+	r := &fakeRunner{}
+	cancel, done := runAgent(a, r)
+	defer cancel()
+
+	err := <-done
+	if err == nil || !strings.Contains(err.Error(), "no start time") {
+		t.Fatalf("expected the run to give up waiting for the start time. found: %v", err)
+	}
+	if !r.dispatched.IsZero() || !r.closed {
+		t.Errorf("expected the runner to be closed without being dispatched")
+	}
+}
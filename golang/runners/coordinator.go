@@ -0,0 +1,441 @@
+package runners
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/kaleido-io/kaleido-fabric-go/kaleido"
+	log "github.com/sirupsen/logrus"
+)
+
+var DEFAULT_AGENT_START_DELAY time.Duration = time.Duration(5) * time.Second
+var AGENT_POLL_INTERVAL time.Duration = time.Duration(1) * time.Second
+
+// the number of polls an agent can fail in a row before it is considered lost
+const AGENT_MAX_POLL_FAILURES = 10
+
+// Coordinator hands out a share of the scenario to each agent, starts them all at the
+// same time once they are all ready, and merges their results into a single report
+type Coordinator struct {
+	scenario *Scenario
+	client   *resty.Client
+}
+
+type agentState struct {
+	url          string
+	status       *agentStatus
+	pollFailures int
+}
+
+func NewCoordinator(scenario *Scenario) *Coordinator {
+	return &Coordinator{
+		scenario: scenario,
+		client:   resty.New().SetTimeout(10 * time.Second),
+	}
+}
+
+func (c *Coordinator) Exec(ctx context.Context) error {
+	log.Infof("Coordinating the run across %d agents", len(c.scenario.Agents))
+	startTime := time.Now()
+
+	agents := make([]*agentState, len(c.scenario.Agents))
+	for i, url := range c.scenario.Agents {
+		agents[i] = &agentState{url: strings.TrimSuffix(url, "/")}
+		err := c.prepareAgent(agents[i], c.scenario.share(i, len(agents)))
+		if err != nil {
+			// do not leave the agents that have already accepted their share running
+			c.stopAgents(agents[:i])
+			return err
+		}
+		log.Infof("Agent %s is preparing its share", agents[i].url)
+	}
+
+	err := c.waitForReady(ctx, agents)
+	if err != nil {
+		c.stopAgents(agents)
+		return err
+	}
+	// the slowest agent is ready by now, so the delay is only for the start time to reach
+	// the agents. An agent that receives it too late rejects it, and the run fails
+	startAt := time.Now().Add(c.scenario.agentStartDelay)
+	for _, agent := range agents {
+		err := c.startAgent(agent, startAt)
+		if err != nil {
+			c.stopAgents(agents)
+			return err
+		}
+		log.Infof("Agent %s will start its share at %s", agent.url, startAt.Format(time.RFC3339Nano))
+	}
+
+	runErr := c.waitForAgents(ctx, agents)
+
+	// merge the results of each phase across the agents
+	summaries := []*phaseSummary{}
+	for i := range c.scenario.Phases {
+		parts := []*phaseSummary{}
+		for _, agent := range agents {
+			if agent.status != nil && i < len(agent.status.Phases) {
+				parts = append(parts, agent.status.Phases[i].summary())
+			}
+		}
+		if len(parts) == 0 {
+			break
+		}
+		summaries = append(summaries, mergeSummaries(parts))
+	}
+
+	printFinalReport(c.scenario, c.scenario.Target.Fabconnect.EventBatchSize, startTime, summaries)
+	fmt.Printf("  - Agents: %d\n", len(agents))
+	for _, agent := range agents {
+		state := "lost"
+		if agent.status != nil {
+			state = agent.status.State
+			if agent.status.Error != "" {
+				state = fmt.Sprintf("%s (%s)", state, agent.status.Error)
+			}
+		}
+		fmt.Printf("    * %s: %s\n", agent.url, state)
+	}
+
+	return processResults(c.scenario, summaries, runErr)
+}
+
+func (c *Coordinator) prepareAgent(agent *agentState, share *Scenario) error {
+	var errMsg agentError
+	res, err := c.client.R().SetBody(&agentRunRequest{Scenario: share}).SetError(&errMsg).Post(agent.url + "/run")
+	if err != nil {
+		return fmt.Errorf("failed to send its share to agent %s. %v", agent.url, err)
+	}
+	if res.StatusCode() != http.StatusAccepted {
+		return fmt.Errorf("failed to send its share to agent %s. [%d] %s", agent.url, res.StatusCode(), errMsg.Error)
+	}
+	return nil
+}
+
+func (c *Coordinator) startAgent(agent *agentState, startAt time.Time) error {
+	var errMsg agentError
+	res, err := c.client.R().SetBody(&agentStartRequest{StartAt: startAt}).SetError(&errMsg).Post(agent.url + "/run/start")
+	if err != nil {
+		return fmt.Errorf("failed to start agent %s. %v", agent.url, err)
+	}
+	if res.StatusCode() != http.StatusAccepted {
+		return fmt.Errorf("failed to start agent %s. [%d] %s", agent.url, res.StatusCode(), errMsg.Error)
+	}
+	return nil
+}
+
+func (c *Coordinator) stopAgents(agents []*agentState) {
+	for _, agent := range agents {
+		c.stopAgent(agent)
+	}
+}
+
+func (c *Coordinator) stopAgent(agent *agentState) {
+	_, err := c.client.R().Post(agent.url + "/run/stop")
+	if err != nil {
+		log.Errorf("Failed to stop agent %s. %v", agent.url, err)
+	}
+}
+
+// waitForReady polls the agents until they have all prepared their share. The run fails
+// if an agent fails to prepare, is lost or the context is cancelled
+func (c *Coordinator) waitForReady(ctx context.Context, agents []*agentState) error {
+	ticker := time.NewTicker(AGENT_POLL_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("run interrupted before the agents were ready")
+		case <-ticker.C:
+		}
+
+		ready := 0
+		for _, agent := range agents {
+			if agent.ready() {
+				ready++
+				continue
+			}
+			if !c.poll(agent) {
+				return fmt.Errorf("agent %s lost while preparing its share", agent.url)
+			}
+			switch {
+			case agent.ready():
+				log.Infof("Agent %s is ready", agent.url)
+				ready++
+			case agent.finished():
+				return fmt.Errorf("agent %s failed to prepare its share. %s", agent.url, agent.status.Error)
+			}
+		}
+		if ready == len(agents) {
+			return nil
+		}
+	}
+}
+
+// waitForAgents polls the agents until they have all completed their share. If the context
+// is cancelled, the agents are stopped, and given the time to report what they have done
+func (c *Coordinator) waitForAgents(ctx context.Context, agents []*agentState) error {
+	ticker := time.NewTicker(AGENT_POLL_INTERVAL)
+	defer ticker.Stop()
+	cancelled := ctx.Done()
+	for {
+		select {
+		case <-cancelled:
+			log.Warnf("Run interrupted. Stopping the agents")
+			c.stopAgents(agents)
+			cancelled = nil
+		case <-ticker.C:
+		}
+
+		running := 0
+		for _, agent := range agents {
+			if agent.finished() {
+				continue
+			}
+			if c.poll(agent) && !agent.finished() {
+				running++
+			}
+		}
+		if running == 0 {
+			break
+		}
+	}
+
+	failed := []string{}
+	for _, agent := range agents {
+		switch {
+		case agent.status == nil || !agent.finished():
+			failed = append(failed, fmt.Sprintf("%s: lost", agent.url))
+		case agent.status.State == AGENT_FAILED:
+			failed = append(failed, fmt.Sprintf("%s: %s", agent.url, agent.status.Error))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%d of %d agents failed. %s", len(failed), len(agents), strings.Join(failed, "; "))
+	}
+	if ctx.Err() != nil {
+		return fmt.Errorf("run interrupted")
+	}
+	return nil
+}
+
+// poll gets the status of an agent. It returns false once the agent has failed to
+// respond too many times in a row, and is considered lost
+func (c *Coordinator) poll(agent *agentState) bool {
+	var status agentStatus
+	res, err := c.client.R().SetResult(&status).Get(agent.url + "/run")
+	if err == nil && res.StatusCode() != http.StatusOK {
+		err = fmt.Errorf("[%d] %s", res.StatusCode(), res.String())
+	}
+	if err != nil {
+		agent.pollFailures++
+		log.Warnf("Failed to get the status of agent %s. %v", agent.url, err)
+		return agent.pollFailures < AGENT_MAX_POLL_FAILURES
+	}
+	agent.pollFailures = 0
+	agent.status = &status
+	return true
+}
+
+func (a *agentState) ready() bool {
+	return a.status != nil && a.status.State == AGENT_READY
+}
+
+func (a *agentState) finished() bool {
+	return a.status != nil && (a.status.State == AGENT_DONE || a.status.State == AGENT_FAILED)
+}
+
+// agentError is the body of the error responses of an agent
+type agentError struct {
+	Error string `json:"error"`
+}
+
+// share returns the part of the scenario run by one of the agents: the transaction counts,
+// the workers and the rates of the phases are split evenly, and so are the identities
+// if there are enough of them
+func (s *Scenario) share(index, count int) *Scenario {
+	share := *s
+	share.Name = fmt.Sprintf("%s-agent-%d", s.Name, index+1)
+	share.Agents = nil
+	share.Results = ResultsSpec{}
+	if share.Target.Type == TARGET_FABCONNECT {
+		// each agent listens to the events on its own websocket topic
+		topic := s.Target.Fabconnect.Topic
+		if topic == "" {
+			topic = kaleido.EVENT_LISTENER_TOPIC
+		}
+		share.Target.Fabconnect.Topic = fmt.Sprintf("%s-agent-%d", topic, index+1)
+	}
+
+	if len(s.Identities) >= count {
+		share.Identities = []string{}
+		for i := index; i < len(s.Identities); i += count {
+			share.Identities = append(share.Identities, s.Identities[i])
+		}
+	}
+
+	if s.WarmUp != nil {
+		share.WarmUp = &WarmUpSpec{
+			TxCount:  split(s.WarmUp.TxCount, index, count),
+			Duration: s.WarmUp.Duration,
+		}
+	}
+
+	share.Phases = []PhaseSpec{}
+	for _, phase := range s.Phases {
+		if phase.warmUp {
+			// added back by the agent from the warm-up spec
+			continue
+		}
+		phase.TxCount = split(phase.TxCount, index, count)
+		phase.Workers = split(phase.Workers, index, count)
+		phase.Rate = phase.Rate / float64(count)
+		share.Phases = append(share.Phases, phase)
+	}
+	return &share
+}
+
+// split returns the part of n given to one of count agents, the first ones getting
+// one more when it does not divide evenly
+func split(n, index, count int) int {
+	part := n / count
+	if index < n%count {
+		part++
+	}
+	return part
+}
+
+func (s *Scenario) validateAgents() error {
+	if len(s.Agents) == 0 {
+		return nil
+	}
+	if s.InitChaincode {
+		return fmt.Errorf("the chaincode initialization cannot be distributed across agents")
+	}
+	err := s.validateHeadless()
+	if err != nil {
+		return err
+	}
+	if s.Target.Fabconnect.Webhook != nil {
+		// the agents would all be given the same webhook
+		return fmt.Errorf("the webhook cannot be shared by agents")
+	}
+	if s.WarmUp != nil && s.WarmUp.TxCount > 0 && s.WarmUp.TxCount < len(s.Agents) {
+		return fmt.Errorf("the warm-up transaction count must be at least the number of agents, %d", len(s.Agents))
+	}
+	for _, phase := range s.Phases {
+		if phase.warmUp {
+			// checked with the phase it runs the workload of
+			continue
+		}
+		if phase.HotKeys != nil {
+			// each agent would update the hot keys created by its own share of the run, so the
+			// contention would be spread across disjoint sets of keys
+			return fmt.Errorf("phase %s has hot keys, which cannot be shared by agents", phase.Name)
+		}
+		if phase.TxCount > 0 && phase.TxCount < len(s.Agents) {
+			return fmt.Errorf("the transaction count of phase %s must be at least the number of agents, %d", phase.Name, len(s.Agents))
+		}
+		if phase.Workers < len(s.Agents) {
+			// each agent needs a worker, which would raise the concurrency above the one of the phase
+			return fmt.Errorf("the workers of phase %s must be at least the number of agents, %d", phase.Name, len(s.Agents))
+		}
+	}
+	s.agentStartDelay = DEFAULT_AGENT_START_DELAY
+	if s.AgentStartDelay != "" {
+		delay, err := time.ParseDuration(s.AgentStartDelay)
+		if err != nil {
+			return fmt.Errorf("failed to parse the agent start delay %s as a duration. %v", s.AgentStartDelay, err)
+		}
+		s.agentStartDelay = delay
+	}
+	return nil
+}
+
+// validateHeadless checks that the scenario can run without prompting for the Kaleido
+// network settings, as an agent has no one to answer
+func (s *Scenario) validateHeadless() error {
+	if s.Target.Type != TARGET_KALEIDO {
+		return nil
+	}
+	network := s.Target.Kaleido
+	missing := []string{}
+	for _, setting := range []struct {
+		name  string
+		value string
+	}{
+		{"apiKey", network.APIKey},
+		{"consortium", network.Consortium},
+		{"environment", network.Environment},
+		{"membership", network.Membership},
+		{"channel", network.Channel},
+	} {
+		if setting.value == "" {
+			missing = append(missing, setting.name)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("the Kaleido target of agents must not need an interactive selection. missing: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// mergeSummaries adds up the summaries of the same phase run by several agents. As the
+// agents run at the same time, the elapsed time of the phase is the longest of them
+func mergeSummaries(parts []*phaseSummary) *phaseSummary {
+	merged := &phaseSummary{
+		phase:      parts[0].phase,
+		failures:   make(map[failureClass]int),
+		functions:  make(map[string]txStats),
+		identities: make(map[string]txStats),
+		channels:   make(map[string]txStats),
+		chaincodes: make(map[string]txStats),
+		missing:    []string{},
+	}
+	for _, part := range parts {
+		merged.expected += part.expected
+		merged.submitted += part.submitted
+		merged.payload += part.payload
+		if part.maxPayload > merged.maxPayload {
+			merged.maxPayload = part.maxPayload
+		}
+		merged.latencies = append(merged.latencies, part.latencies...)
+		merged.confirmed += part.confirmed
+		merged.failed += part.failed
+		for class, count := range part.failures {
+			merged.failures[class] += count
+		}
+		mergeStats(merged.functions, part.functions)
+		mergeStats(merged.identities, part.identities)
+		mergeStats(merged.channels, part.channels)
+		mergeStats(merged.chaincodes, part.chaincodes)
+		merged.conflicts += part.conflicts
+		merged.retries += part.retries
+		merged.recovered += part.recovered
+		merged.reconnects += part.reconnects
+		merged.requestRetries += part.requestRetries
+		merged.missing = append(merged.missing, part.missing...)
+		merged.interrupted = merged.interrupted || part.interrupted
+		if part.elapsed > merged.elapsed {
+			merged.elapsed = part.elapsed
+		}
+	}
+	sort.Strings(merged.missing)
+	merged.latency = newLatencyStats(merged.latencies)
+	return merged
+}
+
+func mergeStats(merged, part map[string]txStats) {
+	for key, stats := range part {
+		total := merged[key]
+		total.submitted += stats.submitted
+		total.confirmed += stats.confirmed
+		total.failed += stats.failed
+		merged[key] = total
+	}
+}
@@ -0,0 +1,399 @@
+package runners
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kaleido-io/kaleido-fabric-go/kaleido"
+)
+
+func TestSplit(t *testing.T) {
+	cases := []struct {
+		n     int
+		count int
+		parts []int
+	}{
+		{10, 1, []int{10}},
+		{10, 2, []int{5, 5}},
+		{10, 3, []int{4, 3, 3}},
+		{11, 4, []int{3, 3, 3, 2}},
+		{2, 3, []int{1, 1, 0}},
+		{0, 2, []int{0, 0}},
+	}
+	for _, c := range cases {
+		total := 0
+		parts := []int{}
+		for index := 0; index < c.count; index++ {
+			part := split(c.n, index, c.count)
+			parts = append(parts, part)
+			total += part
+		}
+		if !reflect.DeepEqual(parts, c.parts) {
+			t.Errorf("expected %d split across %d agents to be %v. found: %v", c.n, c.count, c.parts, parts)
+		}
+		if total != c.n {
+			t.Errorf("expected the parts of %d to add up. found: %d", c.n, total)
+		}
+	}
+}
+
+func TestScenarioShare(t *testing.T) {
+	scenario := validScenario()
+	scenario.Name = "run"
+	scenario.Identities = []string{"user1", "user2", "user3", "user4", "user5"}
+	scenario.Agents = []string{"http://agent1:8080", "http://agent2:8080"}
+	scenario.Results = ResultsSpec{File: "results.json"}
+	scenario.WarmUp = &WarmUpSpec{TxCount: 5}
+	scenario.Phases = []PhaseSpec{
+		{Name: "load", TxCount: 11, Workers: 5, Rate: 100},
+		{Name: "soak", Duration: "1m", Workers: 2},
+	}
+	err := scenario.validate()
+	if err != nil {
+		t.Fatalf("unexpected error. %v", err)
+	}
+
+	cases := []struct {
+		index      int
+		name       string
+		identities []string
+		warmUp     int
+		txCounts   []int
+		workers    []int
+		rates      []float64
+	}{
+		{0, "run-agent-1", []string{"user1", "user3", "user5"}, 3, []int{6, 0}, []int{3, 1}, []float64{50, 0}},
+		{1, "run-agent-2", []string{"user2", "user4"}, 2, []int{5, 0}, []int{2, 1}, []float64{50, 0}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			share := scenario.share(c.index, len(scenario.Agents))
+			if share.Name != c.name {
+				t.Errorf("expected name %s. found: %s", c.name, share.Name)
+			}
+			if share.Agents != nil || share.Results.File != "" {
+				t.Errorf("expected the share not to have agents nor a results file. found: %v, %+v", share.Agents, share.Results)
+			}
+			if !reflect.DeepEqual(share.Identities, c.identities) {
+				t.Errorf("expected identities %v. found: %v", c.identities, share.Identities)
+			}
+			if share.WarmUp == nil || share.WarmUp.TxCount != c.warmUp {
+				t.Errorf("expected a warm-up of %d transactions. found: %+v", c.warmUp, share.WarmUp)
+			}
+			if len(share.Phases) != len(c.txCounts) {
+				t.Fatalf("expected %d phases, without the warm-up. found: %d", len(c.txCounts), len(share.Phases))
+			}
+			for i, phase := range share.Phases {
+				if phase.TxCount != c.txCounts[i] || phase.Workers != c.workers[i] || phase.Rate != c.rates[i] {
+					t.Errorf("expected phase %s to have %d transactions, %d workers and a rate of %v. found: %d, %d and %v", phase.Name, c.txCounts[i], c.workers[i], c.rates[i], phase.TxCount, phase.Workers, phase.Rate)
+				}
+			}
+			// the share is validated by the agent, which adds the warm-up phase back
+			err := share.validate()
+			if err != nil {
+				t.Fatalf("unexpected error. %v", err)
+			}
+		})
+	}
+	if scenario.Phases[1].TxCount != 11 || len(scenario.Identities) != 5 {
+		t.Errorf("expected the scenario to be left unchanged")
+	}
+}
+
+func TestScenarioShareKeepsTheIdentities(t *testing.T) {
+	scenario := validScenario()
+	scenario.Identities = []string{"user1", "user2"}
+	share := scenario.share(2, 3)
+	if !reflect.DeepEqual(share.Identities, scenario.Identities) {
+		t.Errorf("expected every agent to use all the identities when there are fewer than agents. found: %v", share.Identities)
+	}
+}
+
+func TestScenarioShareTopic(t *testing.T) {
+	cases := []struct {
+		name  string
+		topic string
+		index int
+		share string
+	}{
+		{"default topic", "", 0, kaleido.EVENT_LISTENER_TOPIC + "-agent-1"},
+		{"scenario topic", "perf", 2, "perf-agent-3"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			scenario := validScenario()
+			scenario.Target = TargetSpec{Type: TARGET_FABCONNECT}
+			scenario.Target.Fabconnect.Topic = c.topic
+			share := scenario.share(c.index, 3)
+			if share.Target.Fabconnect.Topic != c.share {
+				t.Errorf("expected topic %s. found: %s", c.share, share.Target.Fabconnect.Topic)
+			}
+		})
+	}
+}
+
+func TestMergeSummaries(t *testing.T) {
+	parts := []*phaseSummary{
+		{
+			phase:      "load",
+			expected:   6,
+			submitted:  6,
+			payload:    600,
+			maxPayload: 120,
+			latencies:  []time.Duration{time.Second, 3 * time.Second},
+			confirmed:  5,
+			failed:     1,
+			failures:   map[failureClass]int{FAILURE_MVCC_CONFLICT: 1},
+			functions:  map[string]txStats{"CreateAsset": {submitted: 6, confirmed: 5, failed: 1}},
+			identities: map[string]txStats{"user1": {submitted: 6, confirmed: 5, failed: 1}},
+			channels:   map[string]txStats{"ch1": {submitted: 6, confirmed: 5, failed: 1}},
+			chaincodes: map[string]txStats{"cc1": {submitted: 6, confirmed: 5, failed: 1}},
+			conflicts:  1,
+			missing:    []string{"asset-b"},
+			elapsed:    10 * time.Second,
+		},
+		{
+			phase:          "load",
+			expected:       5,
+			submitted:      5,
+			payload:        500,
+			maxPayload:     150,
+			latencies:      []time.Duration{2 * time.Second},
+			confirmed:      4,
+			failed:         1,
+			failures:       map[failureClass]int{FAILURE_TIMEOUT: 1},
+			functions:      map[string]txStats{"CreateAsset": {submitted: 3, confirmed: 3}, "ReadAsset": {submitted: 2, confirmed: 1, failed: 1}},
+			identities:     map[string]txStats{"user2": {submitted: 5, confirmed: 4, failed: 1}},
+			channels:       map[string]txStats{"ch1": {submitted: 5, confirmed: 4, failed: 1}},
+			chaincodes:     map[string]txStats{"cc1": {submitted: 5, confirmed: 4, failed: 1}},
+			retries:        2,
+			recovered:      1,
+			reconnects:     1,
+			requestRetries: 3,
+			missing:        []string{"asset-a"},
+			interrupted:    true,
+			elapsed:        12 * time.Second,
+		},
+	}
+	merged := mergeSummaries(parts)
+
+	if merged.phase != "load" || merged.expected != 11 || merged.submitted != 11 || merged.confirmed != 9 || merged.failed != 2 {
+		t.Errorf("expected the counts to add up. found: %+v", merged)
+	}
+	if merged.payload != 1100 || merged.maxPayload != 150 {
+		t.Errorf("expected a payload of 1100 bytes, at most 150. found: %d, %d", merged.payload, merged.maxPayload)
+	}
+	if merged.conflicts != 1 || merged.retries != 2 || merged.recovered != 1 || merged.reconnects != 1 || merged.requestRetries != 3 {
+		t.Errorf("expected the retries to add up. found: %+v", merged)
+	}
+	if !reflect.DeepEqual(merged.failures, map[failureClass]int{FAILURE_MVCC_CONFLICT: 1, FAILURE_TIMEOUT: 1}) {
+		t.Errorf("unexpected failures. found: %v", merged.failures)
+	}
+	if !reflect.DeepEqual(merged.functions, map[string]txStats{"CreateAsset": {submitted: 9, confirmed: 8, failed: 1}, "ReadAsset": {submitted: 2, confirmed: 1, failed: 1}}) {
+		t.Errorf("unexpected stats of the functions. found: %v", merged.functions)
+	}
+	if len(merged.identities) != 2 || merged.channels["ch1"] != (txStats{submitted: 11, confirmed: 9, failed: 2}) || merged.chaincodes["cc1"] != (txStats{submitted: 11, confirmed: 9, failed: 2}) {
+		t.Errorf("unexpected stats of the identities, channels or chaincodes. found: %v, %v, %v", merged.identities, merged.channels, merged.chaincodes)
+	}
+	if !reflect.DeepEqual(merged.missing, []string{"asset-a", "asset-b"}) {
+		t.Errorf("expected the missing assets to be sorted. found: %v", merged.missing)
+	}
+	if !merged.interrupted || merged.elapsed != 12*time.Second {
+		t.Errorf("expected the phase to be interrupted and to take the longest elapsed time. found: %v, %s", merged.interrupted, merged.elapsed)
+	}
+	if merged.latency.p50 != 2*time.Second || merged.latency.max != 3*time.Second {
+		t.Errorf("expected the latencies to be computed across the agents. found: %+v", merged.latency)
+	}
+}
+
+func TestScenarioValidateHeadless(t *testing.T) {
+	complete := kaleido.NetworkConfig{APIKey: "key", Consortium: "c1", Environment: "e1", Membership: "m1", Channel: "ch1"}
+	cases := []struct {
+		name    string
+		target  TargetSpec
+		missing string
+	}{
+		{"ccp", TargetSpec{Type: TARGET_CCP, CCP: "ccp.yaml"}, ""},
+		{"fabconnect", TargetSpec{Type: TARGET_FABCONNECT}, ""},
+		{"complete kaleido target", TargetSpec{Type: TARGET_KALEIDO, Kaleido: complete}, ""},
+		{"no api key", TargetSpec{Type: TARGET_KALEIDO, Kaleido: kaleido.NetworkConfig{Consortium: "c1", Environment: "e1", Membership: "m1", Channel: "ch1"}}, "apiKey"},
+		{"no selection", TargetSpec{Type: TARGET_KALEIDO, Kaleido: kaleido.NetworkConfig{APIKey: "key"}}, "consortium, environment, membership, channel"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			scenario := validScenario()
+			scenario.Target = c.target
+			err := scenario.validateHeadless()
+			if c.missing != "" {
+				if err == nil || !strings.Contains(err.Error(), c.missing) {
+					t.Fatalf("expected an error about %s. found: %v", c.missing, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error. %v", err)
+			}
+		})
+	}
+}
+
+// fakeAgent reports the states it is given in turn, then stays in the last one
+type fakeAgent struct {
+	mu      sync.Mutex
+	states  []string
+	state   string
+	startAt time.Time
+	started time.Time
+	// the state reported before the start time was received
+	stateAtStart string
+	stopped      bool
+}
+
+func (f *fakeAgent) serve(t *testing.T) string {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		switch r.URL.Path {
+		case "/run":
+			if r.Method == http.MethodPost {
+				writeJSON(w, http.StatusAccepted, &agentStatus{State: AGENT_PREPARING})
+				return
+			}
+			f.state = f.states[0]
+			if len(f.states) > 1 {
+				f.states = f.states[1:]
+			}
+			writeJSON(w, http.StatusOK, &agentStatus{State: f.state})
+		case "/run/start":
+			var req agentStartRequest
+			json.NewDecoder(r.Body).Decode(&req)
+			f.startAt = req.StartAt
+			f.started = time.Now()
+			f.stateAtStart = f.state
+			writeJSON(w, http.StatusAccepted, &agentStatus{State: AGENT_WAITING})
+		case "/run/stop":
+			f.stopped = true
+			writeJSON(w, http.StatusOK, &agentStatus{State: AGENT_FAILED})
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+func TestCoordinatorWaitsForTheSlowestAgent(t *testing.T) {
+	interval := AGENT_POLL_INTERVAL
+	AGENT_POLL_INTERVAL = time.Millisecond
+	defer func() { AGENT_POLL_INTERVAL = interval }()
+
+	fast := &fakeAgent{states: []string{AGENT_READY}}
+	slow := &fakeAgent{states: []string{AGENT_PREPARING, AGENT_PREPARING, AGENT_PREPARING, AGENT_READY}}
+	coordinator := NewCoordinator(validScenario())
+	agents := []*agentState{{url: fast.serve(t)}, {url: slow.serve(t)}}
+	err := coordinator.waitForReady(context.Background(), agents)
+	if err != nil {
+		t.Fatalf("unexpected error. %v", err)
+	}
+	if len(slow.states) != 1 {
+		t.Errorf("expected the coordinator to wait until the slow agent is ready. found: %v", slow.states)
+	}
+}
+
+func TestCoordinatorWaitForReadyFails(t *testing.T) {
+	interval := AGENT_POLL_INTERVAL
+	AGENT_POLL_INTERVAL = time.Millisecond
+	defer func() { AGENT_POLL_INTERVAL = interval }()
+
+	cases := []struct {
+		name    string
+		states  []string
+		cancel  bool
+		invalid string
+	}{
+		{"failed agent", []string{AGENT_PREPARING, AGENT_FAILED}, false, "failed to prepare"},
+		{"interrupted", []string{AGENT_PREPARING}, true, "interrupted"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ready := &fakeAgent{states: []string{AGENT_READY}}
+			other := &fakeAgent{states: c.states}
+			coordinator := NewCoordinator(validScenario())
+			agents := []*agentState{{url: ready.serve(t)}, {url: other.serve(t)}}
+			ctx, cancel := context.WithCancel(context.Background())
+			if c.cancel {
+				cancel()
+			} else {
+				defer cancel()
+			}
+			err := coordinator.waitForReady(ctx, agents)
+			if err == nil || !strings.Contains(err.Error(), c.invalid) {
+				t.Fatalf("expected an error about %s. found: %v", c.invalid, err)
+			}
+		})
+	}
+}
+
+func TestCoordinatorStartsTheAgentsOnceReady(t *testing.T) {
+	interval := AGENT_POLL_INTERVAL
+	AGENT_POLL_INTERVAL = time.Millisecond
+	defer func() { AGENT_POLL_INTERVAL = interval }()
+
+	fast := &fakeAgent{states: []string{AGENT_READY, AGENT_READY, AGENT_FAILED}}
+	slow := &fakeAgent{states: []string{AGENT_PREPARING, AGENT_PREPARING, AGENT_READY, AGENT_FAILED}}
+	scenario := validScenario()
+	scenario.Agents = []string{fast.serve(t), slow.serve(t)}
+	scenario.Phases[0].Workers = 2
+	err := scenario.validate()
+	if err != nil {
+		t.Fatalf("unexpected error. %v", err)
+	}
+	err = NewCoordinator(scenario).Exec(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "2 of 2 agents failed") {
+		t.Fatalf("expected the agents to fail. found: %v", err)
+	}
+	for _, agent := range []*fakeAgent{fast, slow} {
+		if agent.startAt.IsZero() {
+			t.Fatalf("expected the agents to be started")
+		}
+		if agent.stateAtStart != AGENT_READY {
+			t.Errorf("expected the agents to be started once ready. found: %s", agent.stateAtStart)
+		}
+		if !agent.startAt.After(agent.started) {
+			t.Errorf("expected the start time %s to be after the agent was started at %s", agent.startAt, agent.started)
+		}
+	}
+	if !fast.startAt.Equal(slow.startAt) {
+		t.Errorf("expected the agents to start at the same time. found: %s and %s", fast.startAt, slow.startAt)
+	}
+}
+
+func TestCoordinatorStopsTheAgentsWhenOneFailsToPrepare(t *testing.T) {
+	interval := AGENT_POLL_INTERVAL
+	AGENT_POLL_INTERVAL = time.Millisecond
+	defer func() { AGENT_POLL_INTERVAL = interval }()
+
+	ready := &fakeAgent{states: []string{AGENT_READY}}
+	failed := &fakeAgent{states: []string{AGENT_PREPARING, AGENT_FAILED}}
+	scenario := validScenario()
+	scenario.Agents = []string{ready.serve(t), failed.serve(t)}
+	scenario.Phases[0].Workers = 2
+	err := scenario.validate()
+	if err != nil {
+		t.Fatalf("unexpected error. %v", err)
+	}
+	err = NewCoordinator(scenario).Exec(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "failed to prepare") {
+		t.Fatalf("expected the run to fail. found: %v", err)
+	}
+	for _, agent := range []*fakeAgent{ready, failed} {
+		if !agent.startAt.IsZero() || !agent.stopped {
+			t.Errorf("expected the agents to be stopped without being started")
+		}
+	}
+}
@@ -10,128 +10,250 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+var DEFAULT_SUBSCRIPTION_TIMEOUT time.Duration = time.Duration(30) * time.Second
+
 type FabconnectRunner struct {
-	user          string
-	channel       string
-	chaincode     string
-	count         int
-	workers       int
-	initChaincode bool
-	client        *kaleido.FabconnectClient
+	scenario *Scenario
+	user     string
+	client   *kaleido.FabconnectClient
+	clients  []identityClient
+	// buffered so the event listener never blocks once the runner stops waiting
+	eventAssetIdsChan chan string
+	cleanups          cleanups
+	// the summaries of the phases run so far
+	summaries []*phaseSummary
 }
 
-func NewFabconnectRunner(user, channel, chaincode string, count, workers int, initChaincode bool) *FabconnectRunner {
+func NewFabconnectRunner(scenario *Scenario) *FabconnectRunner {
 	return &FabconnectRunner{
-		user:          user,
-		channel:       channel,
-		chaincode:     chaincode,
-		count:         count,
-		workers:       workers,
-		initChaincode: initChaincode,
+		scenario:          scenario,
+		user:              scenario.Identities[0],
+		eventAssetIdsChan: make(chan string, 1000),
 	}
 }
 
-func (f *FabconnectRunner) Exec() error {
+func (f *FabconnectRunner) Exec(ctx context.Context) error {
+	defer f.close()
+	err := f.prepare(ctx)
+	if err != nil {
+		return err
+	}
+	return f.dispatch(ctx)
+}
+
+// prepare enrolls the identities, and sets up the event stream and the subscriptions
+func (f *FabconnectRunner) prepare(ctx context.Context) error {
 	log.Info("Using Fabconnect for transaction submission")
 
-	fabconnectUrl := os.Getenv("FABCONNECT_URL")
-	client, err := kaleido.NewFabconnectClient(fabconnectUrl, f.user)
+	client, err := kaleido.NewFabconnectClient(f.scenario.Target.Fabconnect.FabconnectConfig, f.user)
 	if err != nil {
 		log.Errorf("Failed to create Fabconnect client. %v", err)
 		return err
 	}
+	client.EventBatchSize = f.scenario.Target.Fabconnect.EventBatchSize
+	client.Webhook = f.scenario.Target.Fabconnect.Webhook
+	if f.scenario.Target.Fabconnect.Topic != "" {
+		// a stream of its own for each topic, such as the one of each agent
+		client.Topic = f.scenario.Target.Fabconnect.Topic
+		client.EventStreamName = f.scenario.Target.Fabconnect.Topic
+	}
 	f.client = client
 
-	err = f.client.EnsureIdentity()
-	if err != nil {
-		log.Errorf("Failed to ensure Fabconnect identity. %v", err)
-		return err
+	// register and enroll all the identities up front, the first one is also used for the event stream
+	for _, identity := range f.scenario.Identities {
+		signerClient := f.client.WithSigner(identity)
+		err = signerClient.EnsureIdentity()
+		if err != nil {
+			log.Errorf("Failed to ensure Fabconnect identity %s. %v", identity, err)
+			return err
+		}
+		log.Infof("Using Fabconnect identity: %s", identity)
+		f.clients = append(f.clients, identityClient{identity: identity, client: signerClient})
 	}
-	log.Infof("Using Fabconnect identity: %s", f.user)
 
-	if f.initChaincode {
-		err = f.runInitChaincode()
-	} else {
-		err = f.runTransactions()
+	if f.scenario.InitChaincode {
+		return nil
 	}
-	if err != nil {
-		return err
+	return f.prepareEvents(ctx)
+}
+
+// dispatch initializes the chaincodes, or runs the phases
+func (f *FabconnectRunner) dispatch(ctx context.Context) error {
+	if f.scenario.InitChaincode {
+		return f.runInitChaincode(ctx)
+	}
+	return f.runPhases(ctx)
+}
+
+func (f *FabconnectRunner) close() {
+	f.cleanups.run()
+}
+
+func (f *FabconnectRunner) runInitChaincode(ctx context.Context) error {
+	for _, d := range f.scenario.Deployments {
+		if f.scenario.Target.Fabconnect.Confirmation == CONFIRM_SYNC {
+			receipt, err := f.client.InitChaincodeSync(d.Channel, d.Chaincode)
+			if err != nil {
+				log.Errorf("Failed to initialize chaincode %s on channel %s: %s", d.Chaincode, d.Channel, err)
+				return err
+			}
+			log.Infof("Chaincode %s init successful on channel %s in block %d", d.Chaincode, d.Channel, receipt.BlockNumber)
+			continue
+		}
+
+		receiptId, err := f.client.InitChaincode(d.Channel, d.Chaincode)
+		if err != nil {
+			log.Errorf("Failed to initialize chaincode %s on channel %s: %s", d.Chaincode, d.Channel, err)
+			return err
+		}
+		_, err = f.client.WaitForReceipt(ctx, receiptId, f.scenario.Target.Fabconnect.receiptTimeout)
+		if err != nil {
+			log.Errorf("Failed to initialize chaincode %s on channel %s. %v", d.Chaincode, d.Channel, err)
+			return err
+		}
+		log.Infof("Chaincode %s init successful on channel %s", d.Chaincode, d.Channel)
 	}
 
 	return nil
 }
 
-func (f *FabconnectRunner) runInitChaincode() error {
-	receiptId, err := f.client.InitChaincode(f.channel, f.chaincode)
+// prepareEvents starts listening to the events, and waits until the subscriptions deliver them
+func (f *FabconnectRunner) prepareEvents(ctx context.Context) error {
+	confirmation := f.scenario.Target.Fabconnect.Confirmation
+	if confirmation != CONFIRM_EVENTS {
+		// the workers confirm the transactions themselves, without an event stream
+		log.Infof("Confirming the transactions by %s", confirmation)
+		return nil
+	}
+
+	checkpoints, err := f.scenario.checkpointStore()
 	if err != nil {
-		log.Errorf("Failed to initialize chaincode: %s", err)
+		log.Errorf("Failed to load the event checkpoints. %v", err)
 		return err
 	}
+	f.client.Checkpoints = checkpoints
 
-	receipt, err := f.client.GetReceipt(receiptId)
+	// the websocket listens to the topic, or the webhook receiver is up, before the stream
+	// delivers the first batch, so FabConnect does not back off from a failed delivery
+	err = f.startEventClient(f.eventAssetIdsChan)
 	if err != nil {
-		log.Errorf("Failed to query receipt %s", receiptId)
 		return err
 	}
+	f.cleanups.add(f.client.StopEventClient)
 
-	if receipt.Headers.Type == "TransactionSuccess" {
-		log.Info("Chaincode init successful")
+	streamId, err := f.client.EnsureEventStream()
+	if err != nil {
+		log.Errorf("Failed to create event listener. %v", err)
+		return err
 	}
+	// clean up the event stream however the run ends, including when interrupted
+	f.cleanups.add(func() { f.cleanupEventListener(streamId) })
 
-	return nil
-}
+	// a subscription for each chaincode on its channel, all delivering to the same stream
+	subscriptionIds := []string{}
+	for _, d := range f.scenario.Deployments {
+		subscriptionId, err := f.client.EnsureSubscription(streamId, d.Channel, d.Chaincode)
+		if err != nil {
+			log.Errorf("Failed to subscribe to events of chaincode %s on channel %s. %v", d.Chaincode, d.Channel, err)
+			return err
+		}
+		subscriptionIds = append(subscriptionIds, subscriptionId)
+	}
 
-func (f *FabconnectRunner) runTransactions() error {
-	ctx := context.Background()
-	// assign each worker the transaction count
-	eventAssetIdsChan, workers := allocateWorkers(ctx, f.channel, f.chaincode, f.count, f.workers, f.client)
+	for _, subscriptionId := range subscriptionIds {
+		if ctx.Err() != nil {
+			return fmt.Errorf("run interrupted before the transactions were started")
+		}
+		err = f.client.WaitForSubscription(streamId, subscriptionId, f.scenario.Target.Fabconnect.subscriptionTimeout)
+		if err != nil {
+			log.Errorf("Failed to wait for the event subscription. %v", err)
+			return err
+		}
+	}
 
-	streamId, err := f.client.CreateEventListener(f.channel, f.chaincode)
+	// start the transactions once all the subscriptions deliver events
+	err = f.waitForSentinels(ctx, f.eventAssetIdsChan)
 	if err != nil {
-		log.Errorf("Failed to create event listener. %v", err)
+		log.Errorf("Failed to wait for the event subscriptions to be live. %v", err)
 		return err
 	}
+	return nil
+}
 
-	// prompt the user to start the event listener
-	fmt.Printf("Check the fabconnect logs to verify it has subscribed to the events. Press enter to start the transactions...")
-	fmt.Scanln()
+// waitForSentinels sends a transaction to each deployment, generated like the ones of the
+// first phase, and waits for its event, so the subscription is known to deliver the events.
+// The events received before, such as the ones delivered again from a checkpoint, are dropped
+func (f *FabconnectRunner) waitForSentinels(ctx context.Context, eventAssetIdsChan chan string) error {
+	timeout := f.scenario.Target.Fabconnect.subscriptionTimeout
+	for _, d := range newDeployments(f.scenario.Deployments) {
+		workload := newWorkload(&f.scenario.Phases[0], []*deployment{d})
+		req, err := workload.sentinel(d)
+		if err != nil {
+			return fmt.Errorf("failed to generate the sentinel transaction for chaincode %s on channel %s. %v", d.chaincode, d.channel, err)
+		}
+		txId, err := f.clients[0].client.ExecChaincode(d.channel, d.chaincode, req.function, req.args)
+		if err != nil {
+			return fmt.Errorf("failed to send the sentinel transaction to chaincode %s on channel %s. %v", d.chaincode, d.channel, err)
+		}
+		log.Infof("Sent sentinel transaction %s(%s) to chaincode %s on channel %s. ID: %s", req.function, req.assetId, d.chaincode, d.channel, txId)
 
-	err = f.client.StartEventClient(eventAssetIdsChan)
-	if err != nil {
-		log.Errorf("Failed to start event client. %v", err)
-		return err
+		timer := time.NewTimer(timeout)
+		received := false
+		for !received {
+			select {
+			case assetId := <-eventAssetIdsChan:
+				if assetId != req.assetId {
+					log.Debugf("Dropped event for asset ID %s received before the sentinel", assetId)
+					continue
+				}
+				log.Infof("Received the event of the sentinel transaction. The subscription to chaincode %s on channel %s is live", d.chaincode, d.channel)
+				received = true
+			case <-ctx.Done():
+				timer.Stop()
+				return fmt.Errorf("run interrupted before the transactions were started")
+			case <-timer.C:
+				return fmt.Errorf("no event received within %s for the sentinel transaction %s to chaincode %s on channel %s. check the subscription and the event stream in the FabConnect logs", timeout, txId, d.chaincode, d.channel)
+			}
+		}
+		timer.Stop()
 	}
+	return nil
+}
 
+func (f *FabconnectRunner) runPhases(ctx context.Context) error {
 	f.client.Start = time.Now()
 
-	// start each worker
-	for _, worker := range workers {
-		worker.Start()
-	}
+	summaries, err := runPhases(ctx, f.scenario, f.clients, f.eventAssetIdsChan, f.client.Reconnects, f.client.Retries)
+	f.summaries = summaries
 
-	assets := make(map[string]bool)
-	eventsReceived := 0
-	for eventAssetId := range eventAssetIdsChan {
-		log.Infof("Received eventAssetId: %s", eventAssetId)
-		assets[eventAssetId] = true
-		eventsReceived++
-		log.Infof("Events received: %d", eventsReceived)
-		if eventsReceived >= f.count {
-			break
-		}
+	printFinalReport(f.scenario, f.client.EventBatchSize, f.client.Start, summaries)
+	if invalid := f.client.InvalidMessages(); invalid > 0 {
+		fmt.Printf("  - Invalid event messages, not acked: %d\n", invalid)
 	}
 
-	printFinalReport(f.count, f.workers, f.client.EventBatchSize, f.client.Start)
+	return processResults(f.scenario, summaries, err)
+}
 
+func (f *FabconnectRunner) startEventClient(eventAssetIdsChan chan string) error {
+	err := f.client.StartEventClient(eventAssetIdsChan)
+	if err != nil {
+		log.Errorf("Failed to start event client. %v", err)
+		return err
+	}
+	return nil
+}
+
+func (f *FabconnectRunner) cleanupEventListener(streamId string) {
 	disableCleanup := os.Getenv("NO_CLEANUP")
 
 	if disableCleanup != "true" {
-		err = f.client.CleanupEventListener(streamId)
+		err := f.client.CleanupEventListener(streamId)
 		if err != nil {
 			log.Errorf("Failed to cleanup event listener. %v", err)
-			return err
 		}
 	}
+}
 
-	return nil
+func (f *FabconnectRunner) phaseSummaries() []*phaseSummary {
+	return f.summaries
 }
@@ -0,0 +1,51 @@
+package runners
+
+import (
+	"strings"
+)
+
+type failureClass string
+
+const (
+	FAILURE_MVCC_CONFLICT     failureClass = "MVCC read conflict"
+	FAILURE_TOO_MANY_INFLIGHT failureClass = "too many in-flight transactions"
+	FAILURE_CONNECTION        failureClass = "TLS/connection error"
+	FAILURE_TIMEOUT           failureClass = "timeout"
+	FAILURE_ENDORSEMENT       failureClass = "endorsement failure"
+	FAILURE_GENERATION        failureClass = "generation error"
+	FAILURE_OTHER             failureClass = "other"
+)
+
+// the order matters, as some of the errors reported by the SDK match more than one class,
+// for example a connection failure to an endorser is reported as an endorsement error
+var failurePatterns = []struct {
+	class    failureClass
+	patterns []string
+}{
+	{FAILURE_MVCC_CONFLICT, []string{"MVCC_READ_CONFLICT", "PHANTOM_READ_CONFLICT"}},
+	{FAILURE_TOO_MANY_INFLIGHT, []string{"Too many in-flight transactions"}},
+	{FAILURE_CONNECTION, []string{"tls:", "x509:", "CONNECTION_FAILED", "connection refused", "connection reset", "no such host", "TRANSIENT_FAILURE", "broken pipe", "EOF"}},
+	{FAILURE_TIMEOUT, []string{"timeout", "Timeout", "deadline exceeded", "timed out"}},
+	{FAILURE_ENDORSEMENT, []string{"ENDORSEMENT_POLICY_FAILURE", "endorse", "Endorser", "Chaincode status Code", "ProposalResponsePayloads do not match"}},
+}
+
+func classifyFailure(err error) failureClass {
+	msg := err.Error()
+	for _, fp := range failurePatterns {
+		for _, pattern := range fp.patterns {
+			if strings.Contains(msg, pattern) {
+				return fp.class
+			}
+		}
+	}
+	return FAILURE_OTHER
+}
+
+func allFailureClasses() []failureClass {
+	classes := []failureClass{}
+	for _, fp := range failurePatterns {
+		classes = append(classes, fp.class)
+	}
+	// the generation errors are raised by the workload, not the client, so are not matched by a pattern
+	return append(classes, FAILURE_GENERATION, FAILURE_OTHER)
+}
@@ -0,0 +1,240 @@
+package runners
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"math"
+	mrand "math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const randomStringChars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+// the payload generators produce argument values of various sizes and shapes, to measure
+// how the payload size affects the block size, the latency and the throughput
+
+func generateRandomString(wl *workload, req *txRequest, param string) (string, error) {
+	size, err := parseSizeDistribution(param)
+	if err != nil {
+		return "", err
+	}
+	return randomString(size.sample()), nil
+}
+
+// generateSequence returns the next number of the phase, starting from the parameter or 1
+func generateSequence(wl *workload, req *txRequest, param string) (string, error) {
+	start, err := parseSequenceStart(param)
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(start+atomic.AddInt64(&wl.sequence, 1)-1, 10), nil
+}
+
+func generateUUIDArg(wl *workload, req *txRequest, param string) (string, error) {
+	return generateUUID()
+}
+
+func generateFileValue(wl *workload, req *txRequest, param string) (string, error) {
+	values, err := loadFileValues(param)
+	if err != nil {
+		return "", err
+	}
+	return values[mrand.Intn(len(values))], nil
+}
+
+func generateJSON(wl *workload, req *txRequest, param string) (string, error) {
+	size, err := parseSizeDistribution(param)
+	if err != nil {
+		return "", err
+	}
+	return jsonBlob(size.sample())
+}
+
+// argValidators check the parameter of a generator when the scenario is loaded, rather
+// than failing the transactions once the run has started
+var argValidators = map[string]func(param string) error{
+	"randomString": func(param string) error {
+		_, err := parseSizeDistribution(param)
+		return err
+	},
+	"sequence": func(param string) error {
+		_, err := parseSequenceStart(param)
+		return err
+	},
+	"fileValue": func(param string) error {
+		_, err := loadFileValues(param)
+		return err
+	},
+	"json": func(param string) error {
+		_, err := parseSizeDistribution(param)
+		return err
+	},
+}
+
+func parseSequenceStart(param string) (int64, error) {
+	if param == "" {
+		return 1, nil
+	}
+	start, err := strconv.ParseInt(param, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed to convert the sequence start %s to integer", param)
+	}
+	return start, nil
+}
+
+// sizeDistribution is the distribution of the size of a generated value, in bytes:
+//   - "1024": always 1024 bytes
+//   - "512-4096": uniformly distributed between 512 and 4096 bytes
+//   - "normal:2048:512": normally distributed with a mean of 2048 and a standard deviation of 512
+//   - "exp:1024": exponentially distributed with a mean of 1024
+type sizeDistribution struct {
+	kind string
+	a    float64
+	b    float64
+}
+
+func parseSizeDistribution(spec string) (*sizeDistribution, error) {
+	if spec == "" {
+		return nil, fmt.Errorf("a size is required, such as 1024, 512-4096, normal:2048:512 or exp:1024")
+	}
+	parts := strings.Split(spec, ":")
+	var numbers []string
+	d := &sizeDistribution{}
+	switch {
+	case parts[0] == "normal" && len(parts) == 3:
+		d.kind = parts[0]
+		numbers = parts[1:]
+	case parts[0] == "exp" && len(parts) == 2:
+		d.kind = parts[0]
+		numbers = parts[1:]
+	case len(parts) == 1 && strings.Contains(spec, "-"):
+		d.kind = "uniform"
+		numbers = strings.SplitN(spec, "-", 2)
+	case len(parts) == 1:
+		d.kind = "fixed"
+		numbers = parts
+	default:
+		return nil, fmt.Errorf("invalid size %s. use a size such as 1024, 512-4096, normal:2048:512 or exp:1024", spec)
+	}
+	values := make([]float64, len(numbers))
+	for i, number := range numbers {
+		value, err := strconv.ParseFloat(number, 64)
+		if err != nil || value < 0 {
+			return nil, fmt.Errorf("invalid size %s. %s is not a positive number", spec, number)
+		}
+		values[i] = value
+	}
+	d.a = values[0]
+	if len(values) > 1 {
+		d.b = values[1]
+	}
+	if d.kind == "uniform" && d.b < d.a {
+		return nil, fmt.Errorf("invalid size %s. the maximum is lower than the minimum", spec)
+	}
+	return d, nil
+}
+
+func (d *sizeDistribution) sample() int {
+	var size float64
+	switch d.kind {
+	case "uniform":
+		size = d.a + mrand.Float64()*(d.b-d.a+1)
+	case "normal":
+		size = mrand.NormFloat64()*d.b + d.a
+	case "exp":
+		size = mrand.ExpFloat64() * d.a
+	default:
+		size = d.a
+	}
+	return int(math.Max(0, size))
+}
+
+func randomString(size int) string {
+	b := make([]byte, size)
+	for i := range b {
+		b[i] = randomStringChars[mrand.Intn(len(randomStringChars))]
+	}
+	return string(b)
+}
+
+// jsonBlob generates a JSON object of about the given size, with random string fields
+// of up to 64 characters
+func jsonBlob(size int) (string, error) {
+	blob := make(map[string]string)
+	// allow for the braces, and the quotes, colon and comma of each field
+	remaining := size - 2
+	for i := 0; remaining > 0; i++ {
+		key := fmt.Sprintf("field%d", i)
+		valueSize := remaining - len(key) - 6
+		if valueSize > 64 {
+			valueSize = 64
+		}
+		if valueSize < 0 {
+			valueSize = 0
+		}
+		blob[key] = randomString(valueSize)
+		remaining -= len(key) + valueSize + 6
+	}
+	encoded, err := json.Marshal(blob)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode the JSON blob. %v", err)
+	}
+	return string(encoded), nil
+}
+
+func generateUUID() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	// version 4, variant 10
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+var fileValuesCache = struct {
+	sync.Mutex
+	values map[string][]string
+}{values: make(map[string][]string)}
+
+// loadFileValues reads the non empty lines of a file once, and keeps them for the rest of the run
+func loadFileValues(filename string) ([]string, error) {
+	fileValuesCache.Lock()
+	defer fileValuesCache.Unlock()
+	if values, ok := fileValuesCache.values[filename]; ok {
+		return values, nil
+	}
+	if filename == "" {
+		return nil, fmt.Errorf("the path of the file to pick the values from is required")
+	}
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open values file %s. %v", filename, err)
+	}
+	defer file.Close()
+	values := []string{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" {
+			values = append(values, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read values file %s. %v", filename, err)
+	}
+	if len(values) == 0 {
+		return nil, fmt.Errorf("values file %s is empty", filename)
+	}
+	fileValuesCache.values[filename] = values
+	return values, nil
+}
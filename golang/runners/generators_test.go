@@ -0,0 +1,146 @@
+package runners
+
+import (
+	"encoding/json"
+	"regexp"
+	"testing"
+)
+
+func TestParseSizeDistribution(t *testing.T) {
+	cases := []struct {
+		spec    string
+		kind    string
+		a       float64
+		b       float64
+		invalid bool
+	}{
+		{spec: "1024", kind: "fixed", a: 1024},
+		{spec: "0", kind: "fixed", a: 0},
+		{spec: "512-4096", kind: "uniform", a: 512, b: 4096},
+		{spec: "100-100", kind: "uniform", a: 100, b: 100},
+		{spec: "normal:2048:512", kind: "normal", a: 2048, b: 512},
+		{spec: "exp:1024", kind: "exp", a: 1024},
+		{spec: "", invalid: true},
+		{spec: "big", invalid: true},
+		{spec: "-10", invalid: true},
+		{spec: "4096-512", invalid: true},
+		{spec: "10-x", invalid: true},
+		{spec: "normal:2048", invalid: true},
+		{spec: "normal:2048:-1", invalid: true},
+		{spec: "exp:1024:1", invalid: true},
+		{spec: "poisson:10", invalid: true},
+	}
+	for _, c := range cases {
+		t.Run(c.spec, func(t *testing.T) {
+			d, err := parseSizeDistribution(c.spec)
+			if c.invalid {
+				if err == nil {
+					t.Fatalf("expected size %q to be rejected", c.spec)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error. %v", err)
+			}
+			if d.kind != c.kind || d.a != c.a || d.b != c.b {
+				t.Errorf("expected %s(%v, %v). found: %s(%v, %v)", c.kind, c.a, c.b, d.kind, d.a, d.b)
+			}
+		})
+	}
+}
+
+func TestSizeDistributionSample(t *testing.T) {
+	cases := []struct {
+		spec string
+		min  int
+		max  int
+	}{
+		{"1024", 1024, 1024},
+		{"512-4096", 512, 4096},
+		{"100-100", 100, 100},
+		{"normal:10:100", 0, 1 << 30},
+		{"exp:10", 0, 1 << 30},
+	}
+	for _, c := range cases {
+		t.Run(c.spec, func(t *testing.T) {
+			d, err := parseSizeDistribution(c.spec)
+			if err != nil {
+				t.Fatalf("unexpected error. %v", err)
+			}
+			for i := 0; i < 1000; i++ {
+				if size := d.sample(); size < c.min || size > c.max {
+					t.Fatalf("expected a size between %d and %d. found: %d", c.min, c.max, size)
+				}
+			}
+		})
+	}
+}
+
+func TestJSONBlob(t *testing.T) {
+	for _, size := range []int{0, 1, 20, 100, 1000, 4096} {
+		blob, err := jsonBlob(size)
+		if err != nil {
+			t.Fatalf("unexpected error. %v", err)
+		}
+		var fields map[string]string
+		if err := json.Unmarshal([]byte(blob), &fields); err != nil {
+			t.Fatalf("expected a JSON object of size %d. found: %s. %v", size, blob, err)
+		}
+		for key, value := range fields {
+			if len(value) > 64 {
+				t.Errorf("expected field %s to be at most 64 characters. found: %d", key, len(value))
+			}
+		}
+		if size >= 20 && (len(blob) < size-16 || len(blob) > size+16) {
+			t.Errorf("expected a JSON object of about %d bytes. found: %d", size, len(blob))
+		}
+	}
+}
+
+func TestGenerateUUID(t *testing.T) {
+	uuidRegex := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	seen := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		uuid, err := generateUUID()
+		if err != nil {
+			t.Fatalf("unexpected error. %v", err)
+		}
+		if !uuidRegex.MatchString(uuid) {
+			t.Fatalf("expected a version 4 UUID. found: %s", uuid)
+		}
+		if seen[uuid] {
+			t.Fatalf("expected unique UUIDs. found %s twice", uuid)
+		}
+		seen[uuid] = true
+	}
+}
+
+func TestParseSequenceStart(t *testing.T) {
+	cases := []struct {
+		param   string
+		start   int64
+		invalid bool
+	}{
+		{param: "", start: 1},
+		{param: "1000", start: 1000},
+		{param: "-5", start: -5},
+		{param: "first", invalid: true},
+	}
+	for _, c := range cases {
+		t.Run(c.param, func(t *testing.T) {
+			start, err := parseSequenceStart(c.param)
+			if c.invalid {
+				if err == nil {
+					t.Fatalf("expected sequence start %q to be rejected", c.param)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error. %v", err)
+			}
+			if start != c.start {
+				t.Errorf("expected %d. found: %d", c.start, start)
+			}
+		})
+	}
+}
@@ -0,0 +1,95 @@
+package runners
+
+import (
+	"context"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// runPhases executes the phases of the scenario in order, against a single event stream.
+// It returns the summaries of the phases that have been started, so they can be reported
+// on even when a phase fails or the run is interrupted. reconnects and requestRetries, if set,
+// return how many times the event stream has been reconnected, and how many requests have
+// been retried, so far
+func runPhases(ctx context.Context, scenario *Scenario, clients []identityClient, eventAssetIdsChan chan string, reconnects, requestRetries func() int) ([]*phaseSummary, error) {
+	trackers := []*txTracker{}
+	// the assets created by a phase can be referenced by the following ones
+	deployments := newDeployments(scenario.Deployments)
+	for i := range scenario.Phases {
+		phase := &scenario.Phases[i]
+		log.Infof("Starting phase %d of %d: %s", i+1, len(scenario.Phases), phase.Name)
+		// the requests are retried from the moment the workers start dispatching
+		requestRetriesBefore := 0
+		if requestRetries != nil {
+			requestRetriesBefore = requestRetries()
+		}
+		tracker, stop := runPhase(ctx, scenario, phase, deployments, clients)
+		trackers = append(trackers, tracker)
+
+		reconnectsBefore := 0
+		if reconnects != nil {
+			reconnectsBefore = reconnects()
+		}
+		err := tracker.waitForEvents(ctx, eventAssetIdsChan, scenario.completionTimeout)
+		stop()
+		if reconnects != nil {
+			tracker.reconnected(reconnects() - reconnectsBefore)
+		}
+		if requestRetries != nil {
+			tracker.requestsRetried(requestRetries() - requestRetriesBefore)
+		}
+		if err != nil {
+			return summarize(trackers), err
+		}
+		log.Infof("Completed phase %d of %d: %s", i+1, len(scenario.Phases), phase.Name)
+	}
+	return summarize(trackers), nil
+}
+
+func summarize(trackers []*txTracker) []*phaseSummary {
+	summaries := make([]*phaseSummary, len(trackers))
+	for i, tracker := range trackers {
+		summaries[i] = tracker.summary()
+	}
+	return summaries
+}
+
+// runPhase starts the workers of a phase, and returns the function to stop them
+func runPhase(ctx context.Context, scenario *Scenario, phase *PhaseSpec, deployments []*deployment, clients []identityClient) (*txTracker, func()) {
+	// the workers stop dispatching when the duration of the phase has elapsed, or the run is
+	// interrupted, and stop confirming their transactions once the phase is stopped
+	confirmCtx, cancelConfirm := context.WithCancel(context.Background())
+	var dispatchCtx context.Context
+	var cancel context.CancelFunc
+	if phase.duration > 0 {
+		dispatchCtx, cancel = context.WithTimeout(ctx, phase.duration)
+	} else {
+		dispatchCtx, cancel = context.WithCancel(ctx)
+	}
+
+	var limiter <-chan time.Time
+	var ticker *time.Ticker
+	if phase.Rate > 0 {
+		ticker = time.NewTicker(time.Duration(float64(time.Second) / phase.Rate))
+		limiter = ticker.C
+	}
+
+	// assign each worker the transaction count
+	tracker, workers := allocateWorkers(dispatchCtx, confirmCtx, scenario, phase, deployments, limiter, clients)
+	tracker.started()
+
+	// start each worker
+	for _, worker := range workers {
+		worker.Start()
+	}
+
+	stop := func() {
+		cancel()
+		cancelConfirm()
+		if ticker != nil {
+			ticker.Stop()
+		}
+	}
+	return tracker, stop
+}
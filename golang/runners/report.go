@@ -0,0 +1,179 @@
+package runners
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/kaleido-io/kaleido-fabric-go/kaleido"
+)
+
+func printFinalReport(scenario *Scenario, eventBatchSize int, startTime time.Time, summaries []*phaseSummary) {
+	interrupted := false
+	for _, summary := range summaries {
+		interrupted = interrupted || summary.interrupted
+	}
+
+	if interrupted {
+		fmt.Println("\n\nFinal Report (partial, the run was interrupted)")
+	} else {
+		fmt.Println("\n\nFinal Report")
+	}
+	fmt.Println("  - Configuration:")
+	fmt.Printf("    * scenario: %s\n", scenario.Name)
+	phases := len(scenario.Phases)
+	if scenario.WarmUp != nil {
+		phases--
+	}
+	fmt.Printf("    * phases: %d\n", phases)
+	if scenario.WarmUp != nil {
+		if scenario.WarmUp.TxCount > 0 {
+			fmt.Printf("    * warm-up transactions: %d\n", scenario.WarmUp.TxCount)
+		}
+		if scenario.WarmUp.Duration != "" {
+			fmt.Printf("    * warm-up duration: %s\n", scenario.WarmUp.Duration)
+		}
+	}
+	if len(scenario.Identities) > 1 {
+		fmt.Printf("    * identities: %d (%s)\n", len(scenario.Identities), scenario.IdentityAssignment)
+	}
+	if len(scenario.Deployments) > 1 {
+		fmt.Println("    * deployments:")
+		for _, d := range scenario.Deployments {
+			fmt.Printf("      - %s on channel %s (weight %d)\n", d.Chaincode, d.Channel, d.weight())
+		}
+	}
+	if scenario.Target.Type == TARGET_FABCONNECT {
+		fmt.Printf("    * confirmation: %s\n", scenario.Target.Fabconnect.Confirmation)
+	}
+	if scenario.Target.Fabconnect.Confirmation == CONFIRM_EVENTS {
+		if scenario.Target.Type == TARGET_FABCONNECT {
+			delivery := kaleido.EVENT_STREAM_WEBSOCKET
+			if scenario.Target.Fabconnect.Webhook != nil {
+				delivery = kaleido.EVENT_STREAM_WEBHOOK
+			}
+			fmt.Printf("    * event delivery: %s\n", delivery)
+		}
+		fmt.Printf("    * event batch size: %d\n", eventBatchSize)
+	}
+	fmt.Printf("  - Total program runtime: %s\n", time.Since(startTime))
+
+	for i, summary := range summaries {
+		phase := &scenario.Phases[i]
+		if phase.warmUp {
+			// only show that the warm-up went through, its numbers are not representative
+			fmt.Printf("  - Warm-up: %d of %d transactions confirmed in %s, excluded from the measurements\n", summary.confirmed, summary.submitted, summary.elapsed)
+			continue
+		}
+		printPhaseReport(scenario, phase, summary)
+	}
+	for i := len(summaries); i < len(scenario.Phases); i++ {
+		fmt.Printf("  - Phase %s: not started\n", scenario.Phases[i].Name)
+	}
+}
+
+func printPhaseReport(scenario *Scenario, phase *PhaseSpec, summary *phaseSummary) {
+	fmt.Printf("  - Phase %s:\n", phase.Name)
+	if phase.TxCount > 0 {
+		fmt.Printf("    * total transactions: %d\n", phase.TxCount)
+	}
+	if phase.duration > 0 {
+		fmt.Printf("    * duration: %s\n", phase.duration)
+	}
+	fmt.Printf("    * workers count: %d\n", phase.Workers)
+	if confirmation := phaseConfirmation(scenario, phase); confirmation != scenario.Target.Fabconnect.Confirmation {
+		fmt.Printf("    * confirmation: %s, to detect the MVCC read conflicts\n", confirmation)
+	}
+	if phase.Rate > 0 {
+		fmt.Printf("    * rate: %g tx/s\n", phase.Rate)
+	}
+	fmt.Printf("    * runtime: %s\n", summary.elapsed)
+	fmt.Printf("    * submitted transactions: %d\n", summary.submitted)
+	if summary.submitted > 0 {
+		fmt.Printf("    * payload size: average %d bytes, max %d bytes\n", summary.payload/summary.submitted, summary.maxPayload)
+	}
+	fmt.Printf("    * confirmed transactions: %d\n", summary.confirmed)
+	fmt.Printf("    * TPS: %f\n", float64(summary.confirmed)/summary.elapsed.Seconds())
+	if summary.confirmed > 0 {
+		latency := summary.latency
+		fmt.Printf("    * latency: p50 %s, p90 %s, p95 %s, p99 %s, max %s\n", latency.p50, latency.p90, latency.p95, latency.p99, latency.max)
+	}
+	if len(phase.Functions) > 1 {
+		fmt.Println("    * functions:")
+		for _, f := range phase.Functions {
+			stats := summary.functions[f.Name]
+			fmt.Printf("      - %s (%s, weight %d): submitted %d, confirmed %d, failed %d, TPS %f\n", f.Name, f.Type, f.weight(), stats.submitted, stats.confirmed, stats.failed, float64(stats.confirmed)/summary.elapsed.Seconds())
+		}
+	}
+	if len(scenario.Identities) > 1 {
+		printBreakdown("identities", scenario.Identities, summary.identities, summary.elapsed)
+	}
+	if channels := scenario.channels(); len(channels) > 1 {
+		printBreakdown("channels", channels, summary.channels, summary.elapsed)
+	}
+	if chaincodes := scenario.chaincodes(); len(chaincodes) > 1 {
+		printBreakdown("chaincodes", chaincodes, summary.chaincodes, summary.elapsed)
+	}
+	if phase.HotKeys != nil || summary.conflicts > 0 {
+		printContentionReport(phase, summary)
+	}
+	if summary.failed > 0 {
+		fmt.Printf("    * failed transactions: %d\n", summary.failed)
+		for _, class := range allFailureClasses() {
+			if summary.failures[class] > 0 {
+				fmt.Printf("      - %s: %d\n", class, summary.failures[class])
+			}
+		}
+	}
+	if summary.reconnects > 0 {
+		fmt.Printf("    * event stream reconnects: %d\n", summary.reconnects)
+	}
+	if summary.requestRetries > 0 {
+		fmt.Printf("    * request retries: %d\n", summary.requestRetries)
+	}
+	if len(summary.missing) > 0 {
+		fmt.Printf("    * missing confirmations: %d\n", len(summary.missing))
+		for _, assetId := range summary.missing {
+			fmt.Printf("      - %s\n", assetId)
+		}
+	}
+	// the transactions that could not be generated are already reported as failed
+	if notSubmitted := summary.expected - summary.submitted - summary.failures[FAILURE_GENERATION]; notSubmitted > 0 {
+		fmt.Printf("    * never submitted: %d\n", notSubmitted)
+	}
+}
+
+// printBreakdown shows the results of a phase for each identity, channel or chaincode
+func printBreakdown(title string, keys []string, all map[string]txStats, elapsed time.Duration) {
+	fmt.Printf("    * %s:\n", title)
+	for _, key := range keys {
+		stats, ok := all[key]
+		if !ok {
+			fmt.Printf("      - %s: no transactions\n", key)
+			continue
+		}
+		fmt.Printf("      - %s: submitted %d, confirmed %d, failed %d, TPS %f\n", key, stats.submitted, stats.confirmed, stats.failed, float64(stats.confirmed)/elapsed.Seconds())
+	}
+}
+
+// printContentionReport shows how often the transactions hit an MVCC read conflict, and
+// how much of the throughput is spent on the client-side retries of the conflicting ones
+func printContentionReport(phase *PhaseSpec, summary *phaseSummary) {
+	fmt.Println("    * contention:")
+	if phase.HotKeys != nil {
+		fmt.Printf("      - hot keys: %d (skew %g)\n", phase.HotKeys.Count, phase.HotKeys.Skew)
+	}
+	attempts := summary.submitted + summary.retries
+	fmt.Printf("      - attempts: %d (%d retries, up to %d per transaction)\n", attempts, summary.retries, phase.ConflictRetries)
+	fmt.Printf("      - MVCC read conflicts: %d\n", summary.conflicts)
+	if attempts > 0 {
+		fmt.Printf("      - conflict rate: %.2f%%\n", 100*float64(summary.conflicts)/float64(attempts))
+	}
+	fmt.Printf("      - recovered by a retry: %d\n", summary.recovered)
+	attemptTPS := float64(attempts) / summary.elapsed.Seconds()
+	effectiveTPS := float64(summary.confirmed) / summary.elapsed.Seconds()
+	fmt.Printf("      - attempted TPS: %f\n", attemptTPS)
+	fmt.Printf("      - effective TPS: %f\n", effectiveTPS)
+	if attempts > 0 {
+		fmt.Printf("      - throughput lost to conflicts and retries: %.2f%%\n", 100*(1-float64(summary.confirmed)/float64(attempts)))
+	}
+}
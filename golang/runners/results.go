@@ -0,0 +1,270 @@
+package runners
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var DEFAULT_MAX_TPS_DROP = 10.0
+var DEFAULT_MAX_LATENCY_INCREASE = 20.0
+
+// Results are the measurements of a run, saved to the results file so they can be
+// compared with the results of a later run. The warm-up is left out. The results of a
+// failed run are saved with its error, but cannot be compared
+type Results struct {
+	Scenario    string         `json:"scenario"`
+	Timestamp   time.Time      `json:"timestamp"`
+	Interrupted bool           `json:"interrupted"`
+	Failed      bool           `json:"failed"`
+	Error       string         `json:"error,omitempty"`
+	Phases      []PhaseResults `json:"phases"`
+}
+
+type PhaseResults struct {
+	Name           string         `json:"name"`
+	Submitted      int            `json:"submitted"`
+	Confirmed      int            `json:"confirmed"`
+	Failed         int            `json:"failed"`
+	RuntimeSeconds float64        `json:"runtimeSeconds"`
+	TPS            float64        `json:"tps"`
+	Latency        LatencyResults `json:"latencyMs"`
+}
+
+// LatencyResults are the confirmation latency percentiles, in milliseconds
+type LatencyResults struct {
+	P50 float64 `json:"p50"`
+	P90 float64 `json:"p90"`
+	P95 float64 `json:"p95"`
+	P99 float64 `json:"p99"`
+	Max float64 `json:"max"`
+}
+
+// Thresholds are how much worse than the baseline a run can be before it is a regression,
+// as a percentage of the baseline. An omitted threshold is the default one, and a threshold
+// of 0 does not tolerate any regression
+type Thresholds struct {
+	MaxTPSDrop         *float64 `yaml:"maxTpsDrop,omitempty" json:"maxTpsDrop,omitempty"`
+	MaxLatencyIncrease *float64 `yaml:"maxLatencyIncrease,omitempty" json:"maxLatencyIncrease,omitempty"`
+}
+
+// ThresholdsFromEnv reads the thresholds from MAX_TPS_DROP and MAX_LATENCY_INCREASE
+func ThresholdsFromEnv() (Thresholds, error) {
+	thresholds := Thresholds{}
+	for name, value := range map[string]**float64{
+		"MAX_TPS_DROP":         &thresholds.MaxTPSDrop,
+		"MAX_LATENCY_INCREASE": &thresholds.MaxLatencyIncrease,
+	} {
+		valueStr := os.Getenv(name)
+		if valueStr == "" {
+			continue
+		}
+		parsed, err := strconv.ParseFloat(valueStr, 64)
+		if err != nil {
+			return thresholds, fmt.Errorf("failed to convert %s %s to a number", name, valueStr)
+		}
+		*value = &parsed
+	}
+	return thresholds, thresholds.validate()
+}
+
+func (t *Thresholds) validate() error {
+	if t.maxTPSDrop() < 0 || t.maxLatencyIncrease() < 0 {
+		return fmt.Errorf("the regression thresholds must not be negative")
+	}
+	return nil
+}
+
+func (t *Thresholds) maxTPSDrop() float64 {
+	if t.MaxTPSDrop == nil {
+		return DEFAULT_MAX_TPS_DROP
+	}
+	return *t.MaxTPSDrop
+}
+
+func (t *Thresholds) maxLatencyIncrease() float64 {
+	if t.MaxLatencyIncrease == nil {
+		return DEFAULT_MAX_LATENCY_INCREASE
+	}
+	return *t.MaxLatencyIncrease
+}
+
+func newResults(scenario *Scenario, summaries []*phaseSummary) *Results {
+	results := &Results{
+		Scenario:  scenario.Name,
+		Timestamp: time.Now().UTC(),
+		Phases:    []PhaseResults{},
+	}
+	for i, summary := range summaries {
+		results.Interrupted = results.Interrupted || summary.interrupted
+		if scenario.Phases[i].warmUp {
+			continue
+		}
+		results.Phases = append(results.Phases, PhaseResults{
+			Name:           summary.phase,
+			Submitted:      summary.submitted,
+			Confirmed:      summary.confirmed,
+			Failed:         summary.failed,
+			RuntimeSeconds: summary.elapsed.Seconds(),
+			TPS:            float64(summary.confirmed) / summary.elapsed.Seconds(),
+			Latency: LatencyResults{
+				P50: milliseconds(summary.latency.p50),
+				P90: milliseconds(summary.latency.p90),
+				P95: milliseconds(summary.latency.p95),
+				P99: milliseconds(summary.latency.p99),
+				Max: milliseconds(summary.latency.max),
+			},
+		})
+	}
+	return results
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func (r *Results) write(filename string) error {
+	content, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode the results. %v", err)
+	}
+	err = ioutil.WriteFile(filename, content, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write results file %s. %v", filename, err)
+	}
+	return nil
+}
+
+func LoadResults(filename string) (*Results, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read results file %s. %v", filename, err)
+	}
+	results := &Results{}
+	err = json.Unmarshal(content, results)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse results file %s. %v", filename, err)
+	}
+	return results, nil
+}
+
+// processResults saves the results of the run and compares them with the baseline, when
+// the scenario asks for it. A failed run still saves its results, marked as failed so they
+// are not used as a baseline, but is not compared
+func processResults(scenario *Scenario, summaries []*phaseSummary, runErr error) error {
+	results := newResults(scenario, summaries)
+	if runErr != nil {
+		results.Failed = true
+		results.Error = runErr.Error()
+	}
+	if scenario.Results.File != "" {
+		err := results.write(scenario.Results.File)
+		if err != nil {
+			log.Errorf("Failed to save the results. %v", err)
+			if runErr == nil {
+				return err
+			}
+		} else {
+			log.Infof("Results saved to %s", scenario.Results.File)
+		}
+	}
+	if runErr != nil || scenario.Results.Baseline == "" {
+		return runErr
+	}
+	baseline, err := LoadResults(scenario.Results.Baseline)
+	if err != nil {
+		return err
+	}
+	return CompareResults(results, baseline, scenario.Results.Thresholds)
+}
+
+// CompareResultFiles compares a results file with a baseline results file
+func CompareResultFiles(resultsFile, baselineFile string, thresholds Thresholds) error {
+	results, err := LoadResults(resultsFile)
+	if err != nil {
+		return err
+	}
+	baseline, err := LoadResults(baselineFile)
+	if err != nil {
+		return err
+	}
+	return CompareResults(results, baseline, thresholds)
+}
+
+// CompareResults prints the difference with the baseline for the TPS and the latency
+// percentiles of each phase, and returns an error if any of them has regressed beyond
+// its threshold. The phases are matched by name. The results of a failed run cannot be
+// compared, nor used as a baseline
+func CompareResults(results, baseline *Results, thresholds Thresholds) error {
+	err := thresholds.validate()
+	if err != nil {
+		return err
+	}
+	if baseline.Failed {
+		return fmt.Errorf("the baseline of %s is the results of a failed run, which cannot be compared with. %s", baseline.Timestamp.Format(time.RFC3339), baseline.Error)
+	}
+	if results.Failed {
+		return fmt.Errorf("the results of %s are of a failed run, which cannot be compared. %s", results.Timestamp.Format(time.RFC3339), results.Error)
+	}
+	current := make(map[string]PhaseResults)
+	for _, phase := range results.Phases {
+		current[phase.Name] = phase
+	}
+
+	fmt.Printf("\n\nComparison with the baseline of %s\n", baseline.Timestamp.Format(time.RFC3339))
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PHASE\tMETRIC\tBASELINE\tCURRENT\tCHANGE\tTHRESHOLD\tSTATUS")
+	regressions := 0
+	for _, base := range baseline.Phases {
+		phase, ok := current[base.Name]
+		if !ok {
+			fmt.Fprintf(w, "%s\t-\t-\t-\t-\t-\tMISSING\n", base.Name)
+			regressions++
+			continue
+		}
+		metrics := []struct {
+			name     string
+			baseline float64
+			current  float64
+			// the TPS must not drop, the latency must not increase
+			higherIsBetter bool
+		}{
+			{"TPS", base.TPS, phase.TPS, true},
+			{"p50 latency (ms)", base.Latency.P50, phase.Latency.P50, false},
+			{"p95 latency (ms)", base.Latency.P95, phase.Latency.P95, false},
+			{"p99 latency (ms)", base.Latency.P99, phase.Latency.P99, false},
+		}
+		for _, m := range metrics {
+			if m.baseline == 0 {
+				fmt.Fprintf(w, "%s\t%s\t%.2f\t%.2f\t-\t-\tno baseline\n", base.Name, m.name, m.baseline, m.current)
+				continue
+			}
+			change := 100 * (m.current - m.baseline) / m.baseline
+			threshold := thresholds.maxLatencyIncrease()
+			regressed := change > threshold
+			if m.higherIsBetter {
+				threshold = -thresholds.maxTPSDrop()
+				regressed = change < threshold
+			}
+			status := "ok"
+			if regressed {
+				status = "REGRESSION"
+				regressions++
+			}
+			fmt.Fprintf(w, "%s\t%s\t%.2f\t%.2f\t%+.2f%%\t%+.2f%%\t%s\n", base.Name, m.name, m.baseline, m.current, change, threshold, status)
+		}
+	}
+	w.Flush()
+
+	if regressions > 0 {
+		return fmt.Errorf("performance regressed beyond the thresholds on %d metric(s) compared with the baseline", regressions)
+	}
+	fmt.Println("No regression compared with the baseline")
+	return nil
+}
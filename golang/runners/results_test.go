@@ -0,0 +1,134 @@
+package runners
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func phaseResults(name string, tps, p50, p95, p99 float64) PhaseResults {
+	return PhaseResults{
+		Name: name,
+		TPS:  tps,
+		Latency: LatencyResults{
+			P50: p50,
+			P95: p95,
+			P99: p99,
+		},
+	}
+}
+
+func threshold(value float64) *float64 {
+	return &value
+}
+
+func TestCompareResults(t *testing.T) {
+	baseline := &Results{
+		Scenario: "baseline",
+		Phases:   []PhaseResults{phaseResults("load", 100, 200, 400, 800)},
+	}
+	cases := []struct {
+		name       string
+		phases     []PhaseResults
+		thresholds Thresholds
+		regression bool
+	}{
+		{"unchanged", []PhaseResults{phaseResults("load", 100, 200, 400, 800)}, Thresholds{}, false},
+		{"better", []PhaseResults{phaseResults("load", 120, 150, 300, 600)}, Thresholds{}, false},
+		{"TPS drop within the default threshold", []PhaseResults{phaseResults("load", 95, 200, 400, 800)}, Thresholds{}, false},
+		{"TPS drop beyond the default threshold", []PhaseResults{phaseResults("load", 85, 200, 400, 800)}, Thresholds{}, true},
+		{"latency increase within the default threshold", []PhaseResults{phaseResults("load", 100, 220, 440, 880)}, Thresholds{}, false},
+		{"p99 latency increase beyond the default threshold", []PhaseResults{phaseResults("load", 100, 200, 400, 1000)}, Thresholds{}, true},
+		{"TPS drop within a custom threshold", []PhaseResults{phaseResults("load", 85, 200, 400, 800)}, Thresholds{MaxTPSDrop: threshold(20)}, false},
+		{"latency increase beyond a custom threshold", []PhaseResults{phaseResults("load", 100, 220, 400, 800)}, Thresholds{MaxLatencyIncrease: threshold(5)}, true},
+		{"any TPS drop with a zero threshold", []PhaseResults{phaseResults("load", 99, 200, 400, 800)}, Thresholds{MaxTPSDrop: threshold(0)}, true},
+		{"any latency increase with a zero threshold", []PhaseResults{phaseResults("load", 100, 201, 400, 800)}, Thresholds{MaxLatencyIncrease: threshold(0)}, true},
+		{"unchanged with zero thresholds", []PhaseResults{phaseResults("load", 100, 200, 400, 800)}, Thresholds{MaxTPSDrop: threshold(0), MaxLatencyIncrease: threshold(0)}, false},
+		{"phase missing", []PhaseResults{phaseResults("other", 100, 200, 400, 800)}, Thresholds{}, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := CompareResults(&Results{Scenario: "current", Phases: c.phases}, baseline, c.thresholds)
+			if c.regression && err == nil {
+				t.Errorf("expected a regression")
+			}
+			if !c.regression && err != nil {
+				t.Errorf("expected no regression. %v", err)
+			}
+		})
+	}
+}
+
+func TestCompareResultsWithoutBaselineMetric(t *testing.T) {
+	baseline := &Results{Phases: []PhaseResults{phaseResults("load", 0, 0, 0, 0)}}
+	results := &Results{Phases: []PhaseResults{phaseResults("load", 10, 200, 400, 800)}}
+	err := CompareResults(results, baseline, Thresholds{MaxTPSDrop: threshold(0), MaxLatencyIncrease: threshold(0)})
+	if err != nil {
+		t.Errorf("expected the metrics with no baseline to be skipped. %v", err)
+	}
+}
+
+func TestCompareResultsNegativeThreshold(t *testing.T) {
+	baseline := &Results{Phases: []PhaseResults{phaseResults("load", 100, 200, 400, 800)}}
+	err := CompareResults(baseline, baseline, Thresholds{MaxTPSDrop: threshold(-1)})
+	if err == nil {
+		t.Errorf("expected a negative threshold to be rejected")
+	}
+}
+
+func TestCompareResultsOfFailedRuns(t *testing.T) {
+	passed := &Results{Phases: []PhaseResults{phaseResults("load", 100, 200, 400, 800)}}
+	failed := &Results{Failed: true, Error: "1 of 2 agents failed", Phases: []PhaseResults{phaseResults("load", 100, 200, 400, 800)}}
+	cases := []struct {
+		name     string
+		results  *Results
+		baseline *Results
+		invalid  string
+	}{
+		{"failed baseline", passed, failed, "baseline"},
+		{"failed run", failed, passed, "results"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := CompareResults(c.results, c.baseline, Thresholds{})
+			if err == nil || !strings.Contains(err.Error(), c.invalid) || !strings.Contains(err.Error(), "failed run") {
+				t.Errorf("expected the %s of a failed run to be refused. found: %v", c.invalid, err)
+			}
+		})
+	}
+}
+
+func TestProcessResultsMarksFailedRuns(t *testing.T) {
+	cases := []struct {
+		name   string
+		runErr error
+	}{
+		{"passed", nil},
+		{"failed", fmt.Errorf("2 of 2 agents failed")},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			scenario := validScenario()
+			err := scenario.validate()
+			if err != nil {
+				t.Fatalf("unexpected error. %v", err)
+			}
+			scenario.Results.File = filepath.Join(t.TempDir(), "results.json")
+			err = processResults(scenario, []*phaseSummary{}, c.runErr)
+			if err != c.runErr {
+				t.Fatalf("expected the error of the run. found: %v", err)
+			}
+			results, err := LoadResults(scenario.Results.File)
+			if err != nil {
+				t.Fatalf("unexpected error. %v", err)
+			}
+			if results.Failed != (c.runErr != nil) {
+				t.Errorf("expected failed to be %v. found: %v", c.runErr != nil, results.Failed)
+			}
+			if c.runErr != nil && results.Error != c.runErr.Error() {
+				t.Errorf("expected the error of the run to be saved. found: %q", results.Error)
+			}
+		})
+	}
+}
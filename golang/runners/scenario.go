@@ -0,0 +1,703 @@
+package runners
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kaleido-io/kaleido-fabric-go/kaleido"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	TARGET_KALEIDO    = "kaleido"
+	TARGET_CCP        = "ccp"
+	TARGET_FABCONNECT = "fabconnect"
+)
+
+const (
+	ASSIGN_ROUND_ROBIN = "round-robin"
+	ASSIGN_RANDOM      = "random"
+)
+
+// how the transactions sent to FabConnect are confirmed: by the chaincode events, by polling
+// the receipts, or by submitting them synchronously
+const (
+	CONFIRM_EVENTS   = "events"
+	CONFIRM_RECEIPTS = "receipts"
+	CONFIRM_SYNC     = "sync"
+)
+
+// Scenario declares what a run targets and the workload phases to execute in order.
+// It is loaded from a YAML or JSON file, or built from the environment variables
+type Scenario struct {
+	Name               string           `yaml:"name,omitempty" json:"name,omitempty"`
+	Target             TargetSpec       `yaml:"target" json:"target"`
+	Identities         []string         `yaml:"identities,omitempty" json:"identities,omitempty"`
+	IdentityAssignment string           `yaml:"identityAssignment,omitempty" json:"identityAssignment,omitempty"`
+	Channel            string           `yaml:"channel,omitempty" json:"channel,omitempty"`
+	Chaincode          string           `yaml:"chaincode,omitempty" json:"chaincode,omitempty"`
+	Deployments        []DeploymentSpec `yaml:"deployments,omitempty" json:"deployments,omitempty"`
+	InitChaincode      bool             `yaml:"initChaincode,omitempty" json:"initChaincode,omitempty"`
+	CompletionTimeout  string           `yaml:"completionTimeout,omitempty" json:"completionTimeout,omitempty"`
+	// the file the event consumption is checkpointed to, so a later run resumes from there
+	EventCheckpointFile string        `yaml:"eventCheckpointFile,omitempty" json:"eventCheckpointFile,omitempty"`
+	WarmUp              *WarmUpSpec   `yaml:"warmUp,omitempty" json:"warmUp,omitempty"`
+	Phases              []PhaseSpec   `yaml:"phases,omitempty" json:"phases,omitempty"`
+	Results             ResultsSpec   `yaml:"results,omitempty" json:"results,omitempty"`
+	Agents              []string      `yaml:"agents,omitempty" json:"agents,omitempty"`
+	AgentStartDelay     string        `yaml:"agentStartDelay,omitempty" json:"agentStartDelay,omitempty"`
+	agentStartDelay     time.Duration `yaml:"-" json:"-"`
+	completionTimeout   time.Duration `yaml:"-" json:"-"`
+}
+
+type TargetSpec struct {
+	Type       string                `yaml:"type" json:"type"`
+	CCP        string                `yaml:"ccp,omitempty" json:"ccp,omitempty"`
+	Kaleido    kaleido.NetworkConfig `yaml:"kaleido,omitempty" json:"kaleido,omitempty"`
+	Fabconnect FabconnectSpec        `yaml:"fabconnect,omitempty" json:"fabconnect,omitempty"`
+}
+
+type FabconnectSpec struct {
+	kaleido.FabconnectConfig `yaml:",inline"`
+	EventBatchSize           int    `yaml:"eventBatchSize,omitempty" json:"eventBatchSize,omitempty"`
+	Topic                    string `yaml:"topic,omitempty" json:"topic,omitempty"`
+	Confirmation             string `yaml:"confirmation,omitempty" json:"confirmation,omitempty"`
+	ReceiptTimeout           string `yaml:"receiptTimeout,omitempty" json:"receiptTimeout,omitempty"`
+	// how long to wait for the event subscriptions to be live before sending the transactions
+	SubscriptionTimeout string        `yaml:"subscriptionTimeout,omitempty" json:"subscriptionTimeout,omitempty"`
+	receiptTimeout      time.Duration `yaml:"-" json:"-"`
+	subscriptionTimeout time.Duration `yaml:"-" json:"-"`
+	// the events are delivered to a webhook instead of the websocket, if set
+	Webhook *kaleido.WebhookConfig `yaml:"webhook,omitempty" json:"webhook,omitempty"`
+}
+
+// ResultsSpec is where to save the results of the run, and the baseline results to compare
+// them with. The run fails if it regresses beyond the thresholds
+type ResultsSpec struct {
+	File       string `yaml:"file,omitempty" json:"file,omitempty"`
+	Baseline   string `yaml:"baseline,omitempty" json:"baseline,omitempty"`
+	Thresholds `yaml:",inline"`
+}
+
+// WarmUpSpec is a number of transactions, or a duration, to send before the phases and
+// leave out of the measurements, while the connections are being established
+type WarmUpSpec struct {
+	TxCount  int    `yaml:"txCount,omitempty" json:"txCount,omitempty"`
+	Duration string `yaml:"duration,omitempty" json:"duration,omitempty"`
+}
+
+// DeploymentSpec is a chaincode deployed on a channel. The transactions of a run are
+// spread across the deployments with a probability proportional to their weight, 1 if
+// omitted. A deployment with a weight of 0 is not sent any transaction
+type DeploymentSpec struct {
+	Channel   string `yaml:"channel,omitempty" json:"channel,omitempty"`
+	Chaincode string `yaml:"chaincode,omitempty" json:"chaincode,omitempty"`
+	Weight    *int   `yaml:"weight,omitempty" json:"weight,omitempty"`
+}
+
+// PhaseSpec is a workload phase. It ends after sending TxCount transactions,
+// or when Duration has elapsed if TxCount is not set
+type PhaseSpec struct {
+	Name            string         `yaml:"name,omitempty" json:"name,omitempty"`
+	TxCount         int            `yaml:"txCount,omitempty" json:"txCount,omitempty"`
+	Duration        string         `yaml:"duration,omitempty" json:"duration,omitempty"`
+	Workers         int            `yaml:"workers,omitempty" json:"workers,omitempty"`
+	Rate            float64        `yaml:"rate,omitempty" json:"rate,omitempty"`
+	Functions       []FunctionSpec `yaml:"functions,omitempty" json:"functions,omitempty"`
+	HotKeys         *HotKeySpec    `yaml:"hotKeys,omitempty" json:"hotKeys,omitempty"`
+	ConflictRetries int            `yaml:"conflictRetries,omitempty" json:"conflictRetries,omitempty"`
+	duration        time.Duration  `yaml:"-" json:"-"`
+	// the warm-up phase is run like the others, but left out of the measurements
+	warmUp bool `yaml:"-" json:"-"`
+}
+
+// HotKeySpec is the set of keys updated by the ${hotAssetId} argument generator: the
+// first Count assets created in the run, picked with a Zipf distribution of exponent Skew
+type HotKeySpec struct {
+	Count int     `yaml:"count" json:"count"`
+	Skew  float64 `yaml:"skew,omitempty" json:"skew,omitempty"`
+}
+
+const DEFAULT_HOT_KEY_SKEW = 1.1
+
+// FunctionSpec is a chaincode function in the mix of a phase, picked with a probability
+// proportional to its weight, 1 if omitted. A function with a weight of 0 is left out of
+// the mix. The type is either invoke or query, and the args are templates resolved by the
+// argument generators
+type FunctionSpec struct {
+	Name   string   `yaml:"name" json:"name"`
+	Type   string   `yaml:"type,omitempty" json:"type,omitempty"`
+	Weight *int     `yaml:"weight,omitempty" json:"weight,omitempty"`
+	Args   []string `yaml:"args,omitempty" json:"args,omitempty"`
+}
+
+func (f FunctionSpec) weight() int {
+	return weightOf(f.Weight)
+}
+
+func (d DeploymentSpec) weight() int {
+	return weightOf(d.Weight)
+}
+
+func weightOf(weight *int) int {
+	if weight == nil {
+		return 1
+	}
+	return *weight
+}
+
+// LoadScenario reads a scenario file, as JSON if the file has a .json extension, otherwise as
+// YAML. Either way, an unknown field is rejected rather than ignored
+func LoadScenario(filename string) (*Scenario, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read scenario file %s. %v", filename, err)
+	}
+
+	scenario := &Scenario{}
+	if strings.ToLower(filepath.Ext(filename)) == ".json" {
+		decoder := json.NewDecoder(bytes.NewReader(content))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(scenario)
+	} else {
+		err = yaml.UnmarshalStrict(content, scenario)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse scenario file %s. %v", filename, err)
+	}
+	if scenario.Name == "" {
+		scenario.Name = strings.TrimSuffix(filepath.Base(filename), filepath.Ext(filename))
+	}
+
+	err = scenario.validate()
+	if err != nil {
+		return nil, fmt.Errorf("invalid scenario file %s. %v", filename, err)
+	}
+	if scenario.Target.Kaleido.Channel == "" {
+		// select the channel of the scenario in the Kaleido environment, rather than prompting
+		scenario.Target.Kaleido.Channel = scenario.Channel
+	}
+	return scenario, nil
+}
+
+// ScenarioFromEnv builds a single phase scenario from the environment variables. CHANNEL_ID
+// and CCNAME can be comma separated lists, to spread the transactions across every chaincode
+// on every channel
+func ScenarioFromEnv() (*Scenario, error) {
+	username := os.Getenv("USER_ID")
+	if username == "" {
+		username = "user1"
+	}
+
+	channel := os.Getenv("CHANNEL_ID")
+	if channel == "" {
+		channel = "default-channel"
+	}
+
+	ccname := os.Getenv("CCNAME")
+	if ccname == "" {
+		ccname = "asset_transfer"
+	}
+
+	count, err := getIntEnv("TX_COUNT", 1)
+	if err != nil {
+		return nil, err
+	}
+
+	workers, err := getIntEnv("WORKERS", 1)
+	if err != nil {
+		return nil, err
+	}
+
+	channels := strings.Split(channel, ",")
+	ccnames := strings.Split(ccname, ",")
+	deployments := []DeploymentSpec{}
+	for _, ch := range channels {
+		for _, cc := range ccnames {
+			deployments = append(deployments, DeploymentSpec{Channel: strings.TrimSpace(ch), Chaincode: strings.TrimSpace(cc)})
+		}
+	}
+
+	// with more than one identity, they are named after the USER_ID with a sequence suffix
+	identityCount, err := getIntEnv("IDENTITY_COUNT", 1)
+	if err != nil {
+		return nil, err
+	}
+	identities := []string{username}
+	if identityCount > 1 {
+		identities = make([]string, identityCount)
+		for i := range identities {
+			identities[i] = fmt.Sprintf("%s-%d", username, i+1)
+		}
+	}
+
+	eventBatchSize, err := getIntEnv("EVENT_BATCH_SIZE", 1)
+	if err != nil {
+		return nil, err
+	}
+
+	functions, err := parseFunctionMix(os.Getenv("TX_FUNCTIONS"))
+	if err != nil {
+		return nil, err
+	}
+
+	hotKeys, err := getIntEnv("HOT_KEYS", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	conflictRetries, err := getIntEnv("CONFLICT_RETRIES", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	warmUpCount, err := getIntEnv("WARMUP_TX_COUNT", 0)
+	if err != nil {
+		return nil, err
+	}
+	var warmUp *WarmUpSpec
+	if warmUpCount > 0 || os.Getenv("WARMUP_DURATION") != "" {
+		warmUp = &WarmUpSpec{TxCount: warmUpCount, Duration: os.Getenv("WARMUP_DURATION")}
+	}
+
+	targetType := TARGET_KALEIDO
+	if os.Getenv("USE_FABCONNECT") == "true" {
+		targetType = TARGET_FABCONNECT
+	} else if os.Getenv("CCP") != "" {
+		targetType = TARGET_CCP
+	}
+
+	// distribute the run across the agents, given as a comma separated list of URLs
+	var agents []string
+	if os.Getenv("AGENTS") != "" {
+		for _, agent := range strings.Split(os.Getenv("AGENTS"), ",") {
+			agents = append(agents, strings.TrimSpace(agent))
+		}
+	}
+
+	thresholds, err := ThresholdsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	webhook, err := kaleido.WebhookConfigFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	fabconnectConfig := kaleido.FabconnectConfigFromEnv()
+	fabconnectConfig.Retry, err = kaleido.RetryPolicyFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	scenario := &Scenario{
+		Name: "default",
+		Target: TargetSpec{
+			Type:    targetType,
+			CCP:     os.Getenv("CCP"),
+			Kaleido: kaleido.NetworkConfigFromEnv(),
+			Fabconnect: FabconnectSpec{
+				FabconnectConfig:    fabconnectConfig,
+				EventBatchSize:      eventBatchSize,
+				Confirmation:        os.Getenv("CONFIRMATION"),
+				ReceiptTimeout:      os.Getenv("RECEIPT_TIMEOUT"),
+				SubscriptionTimeout: os.Getenv("SUBSCRIPTION_TIMEOUT"),
+				Webhook:             webhook,
+			},
+		},
+		Identities:          identities,
+		IdentityAssignment:  os.Getenv("IDENTITY_ASSIGNMENT"),
+		Channel:             strings.TrimSpace(channels[0]),
+		Chaincode:           strings.TrimSpace(ccnames[0]),
+		Deployments:         deployments,
+		InitChaincode:       strings.ToLower(os.Getenv("INIT_CC")) == "true",
+		CompletionTimeout:   os.Getenv("COMPLETION_TIMEOUT"),
+		EventCheckpointFile: os.Getenv("EVENT_CHECKPOINT_FILE"),
+		WarmUp:              warmUp,
+		Agents:              agents,
+		AgentStartDelay:     os.Getenv("AGENT_START_DELAY"),
+		Results: ResultsSpec{
+			File:       os.Getenv("RESULTS_FILE"),
+			Baseline:   os.Getenv("BASELINE_FILE"),
+			Thresholds: thresholds,
+		},
+		Phases: []PhaseSpec{
+			{
+				Name:            "default",
+				TxCount:         count,
+				Workers:         workers,
+				Functions:       functions,
+				ConflictRetries: conflictRetries,
+			},
+		},
+	}
+
+	if hotKeys > 0 {
+		// create the hot keys first, then update them concurrently
+		skew := DEFAULT_HOT_KEY_SKEW
+		skewStr := os.Getenv("HOT_KEY_SKEW")
+		if skewStr != "" {
+			skew, err = strconv.ParseFloat(skewStr, 64)
+			if err != nil {
+				return nil, fmt.Errorf("failed to convert HOT_KEY_SKEW %s to a number", skewStr)
+			}
+		}
+		contention := &scenario.Phases[0]
+		contention.Name = "contention"
+		contention.HotKeys = &HotKeySpec{Count: hotKeys, Skew: skew}
+		if len(contention.Functions) == 0 {
+			contention.Functions = []FunctionSpec{
+				{Name: "UpdateAsset", Args: []string{"${hotAssetId}", "blue", "15", "Tom", "1500"}},
+			}
+		}
+		setup := PhaseSpec{
+			Name:    "hot-keys-setup",
+			TxCount: hotKeys,
+			Workers: workers,
+		}
+		scenario.Phases = []PhaseSpec{setup, *contention}
+	}
+
+	err = scenario.validate()
+	if err != nil {
+		return nil, err
+	}
+	return scenario, nil
+}
+
+func (s *Scenario) validate() error {
+	switch s.Target.Type {
+	case TARGET_KALEIDO, TARGET_CCP, TARGET_FABCONNECT:
+	default:
+		return fmt.Errorf("target type must be one of %s, %s or %s. found: %q", TARGET_KALEIDO, TARGET_CCP, TARGET_FABCONNECT, s.Target.Type)
+	}
+	if s.Target.Type == TARGET_CCP && s.Target.CCP == "" {
+		return fmt.Errorf("the path to the common connection profile is required for target type %s", TARGET_CCP)
+	}
+	if s.Target.Type == TARGET_FABCONNECT && s.Target.Fabconnect.URL == "" {
+		return fmt.Errorf("the FabConnect URL is required for target type %s", TARGET_FABCONNECT)
+	}
+	err := s.Target.Fabconnect.validate(s.Target.Type)
+	if err != nil {
+		return err
+	}
+
+	if len(s.Identities) == 0 {
+		return fmt.Errorf("at least one identity is required")
+	}
+	switch s.IdentityAssignment {
+	case "":
+		s.IdentityAssignment = ASSIGN_ROUND_ROBIN
+	case ASSIGN_ROUND_ROBIN, ASSIGN_RANDOM:
+	default:
+		return fmt.Errorf("identity assignment must be one of %s or %s. found: %q", ASSIGN_ROUND_ROBIN, ASSIGN_RANDOM, s.IdentityAssignment)
+	}
+	err = s.validateDeployments()
+	if err != nil {
+		return err
+	}
+
+	s.completionTimeout = DEFAULT_COMPLETION_TIMEOUT
+	if s.CompletionTimeout != "" {
+		timeout, err := time.ParseDuration(s.CompletionTimeout)
+		if err != nil {
+			return fmt.Errorf("failed to parse the completion timeout %s as a duration. %v", s.CompletionTimeout, err)
+		}
+		s.completionTimeout = timeout
+	}
+
+	err = s.Results.Thresholds.validate()
+	if err != nil {
+		return err
+	}
+
+	if len(s.Phases) == 0 && !s.InitChaincode {
+		return fmt.Errorf("at least one phase is required")
+	}
+	for i := range s.Phases {
+		err = s.Phases[i].validate(i)
+		if err != nil {
+			return err
+		}
+	}
+	if s.WarmUp != nil && len(s.Phases) > 0 && !s.Phases[0].warmUp {
+		err = s.addWarmUpPhase()
+		if err != nil {
+			return err
+		}
+	}
+	return s.validateAgents()
+}
+
+func (f *FabconnectSpec) validate(targetType string) error {
+	switch f.Confirmation {
+	case "":
+		f.Confirmation = CONFIRM_EVENTS
+	case CONFIRM_EVENTS:
+	case CONFIRM_RECEIPTS, CONFIRM_SYNC:
+		if targetType != TARGET_FABCONNECT {
+			return fmt.Errorf("the %s confirmation is only supported for target type %s", f.Confirmation, TARGET_FABCONNECT)
+		}
+	default:
+		return fmt.Errorf("confirmation must be one of %s, %s or %s. found: %q", CONFIRM_EVENTS, CONFIRM_RECEIPTS, CONFIRM_SYNC, f.Confirmation)
+	}
+	f.receiptTimeout = TIMEOUT
+	if f.ReceiptTimeout != "" {
+		timeout, err := time.ParseDuration(f.ReceiptTimeout)
+		if err != nil {
+			return fmt.Errorf("failed to parse the receipt timeout %s as a duration. %v", f.ReceiptTimeout, err)
+		}
+		f.receiptTimeout = timeout
+	}
+	f.subscriptionTimeout = DEFAULT_SUBSCRIPTION_TIMEOUT
+	if f.SubscriptionTimeout != "" {
+		timeout, err := time.ParseDuration(f.SubscriptionTimeout)
+		if err != nil {
+			return fmt.Errorf("failed to parse the subscription timeout %s as a duration. %v", f.SubscriptionTimeout, err)
+		}
+		f.subscriptionTimeout = timeout
+	}
+	if f.Retry != nil {
+		err := f.Retry.Validate()
+		if err != nil {
+			return err
+		}
+	}
+	if f.Webhook != nil {
+		if targetType != TARGET_FABCONNECT || f.Confirmation != CONFIRM_EVENTS {
+			return fmt.Errorf("the webhook is only supported for target type %s with the %s confirmation", TARGET_FABCONNECT, CONFIRM_EVENTS)
+		}
+		return f.Webhook.Validate()
+	}
+	return nil
+}
+
+// addWarmUpPhase runs the workload of the first phase for the warm-up count or duration
+// before the phases of the scenario
+func (s *Scenario) addWarmUpPhase() error {
+	first := s.Phases[0]
+	warmUp := PhaseSpec{
+		Name:            "warm-up",
+		TxCount:         s.WarmUp.TxCount,
+		Duration:        s.WarmUp.Duration,
+		Workers:         first.Workers,
+		Rate:            first.Rate,
+		Functions:       first.Functions,
+		HotKeys:         first.HotKeys,
+		ConflictRetries: first.ConflictRetries,
+		warmUp:          true,
+	}
+	err := warmUp.validate(0)
+	if err != nil {
+		return fmt.Errorf("invalid warm-up. %v", err)
+	}
+	s.Phases = append([]PhaseSpec{warmUp}, s.Phases...)
+	return nil
+}
+
+// validateDeployments defaults the deployments to the chaincode and channel of the scenario,
+// and the channel and chaincode of the scenario to the first deployment
+func (s *Scenario) validateDeployments() error {
+	if len(s.Deployments) == 0 {
+		s.Deployments = []DeploymentSpec{{Channel: s.Channel, Chaincode: s.Chaincode}}
+	}
+	seen := make(map[string]bool)
+	totalWeight := 0
+	for i := range s.Deployments {
+		d := &s.Deployments[i]
+		if d.Channel == "" {
+			d.Channel = s.Channel
+		}
+		if d.Chaincode == "" {
+			d.Chaincode = s.Chaincode
+		}
+		if d.Channel == "" {
+			return fmt.Errorf("the channel is required")
+		}
+		if d.Chaincode == "" {
+			return fmt.Errorf("the chaincode is required")
+		}
+		if d.weight() < 0 {
+			return fmt.Errorf("the weight of chaincode %s on channel %s must not be negative", d.Chaincode, d.Channel)
+		}
+		totalWeight += d.weight()
+		if seen[d.key()] {
+			return fmt.Errorf("chaincode %s on channel %s is listed more than once", d.Chaincode, d.Channel)
+		}
+		seen[d.key()] = true
+	}
+	if totalWeight == 0 {
+		return fmt.Errorf("at least one deployment must have a positive weight")
+	}
+	if s.Channel == "" {
+		s.Channel = s.Deployments[0].Channel
+	}
+	if s.Chaincode == "" {
+		s.Chaincode = s.Deployments[0].Chaincode
+	}
+	if s.Target.Type == TARGET_KALEIDO && len(s.channels()) > 1 {
+		return fmt.Errorf("target type %s supports a single channel. use a common connection profile or FabConnect to send to several channels", TARGET_KALEIDO)
+	}
+	return nil
+}
+
+func (d *DeploymentSpec) key() string {
+	return fmt.Sprintf("%s/%s", d.Channel, d.Chaincode)
+}
+
+// checkpointStore loads the event checkpoints, or returns nil if they are not kept
+func (s *Scenario) checkpointStore() (*kaleido.CheckpointStore, error) {
+	if s.EventCheckpointFile == "" {
+		return nil, nil
+	}
+	return kaleido.NewCheckpointStore(s.EventCheckpointFile)
+}
+
+// channels returns the distinct channels of the deployments, in order
+func (s *Scenario) channels() []string {
+	return distinct(s.Deployments, func(d DeploymentSpec) string { return d.Channel })
+}
+
+// chaincodes returns the distinct chaincode names of the deployments, in order
+func (s *Scenario) chaincodes() []string {
+	return distinct(s.Deployments, func(d DeploymentSpec) string { return d.Chaincode })
+}
+
+func distinct(deployments []DeploymentSpec, field func(DeploymentSpec) string) []string {
+	values := []string{}
+	seen := make(map[string]bool)
+	for _, d := range deployments {
+		value := field(d)
+		if !seen[value] {
+			seen[value] = true
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+func (p *PhaseSpec) validate(index int) error {
+	if p.Name == "" {
+		p.Name = fmt.Sprintf("phase-%d", index+1)
+	}
+	if p.Duration != "" {
+		duration, err := time.ParseDuration(p.Duration)
+		if err != nil {
+			return fmt.Errorf("failed to parse the duration %s of phase %s. %v", p.Duration, p.Name, err)
+		}
+		p.duration = duration
+	}
+	if p.TxCount <= 0 && p.duration <= 0 {
+		return fmt.Errorf("phase %s must set either a transaction count or a duration", p.Name)
+	}
+	if p.Workers <= 0 {
+		p.Workers = 1
+	}
+	if p.TxCount > 0 && p.Workers > p.TxCount {
+		// a worker with no transactions allocated would otherwise keep sending until the phase ends
+		p.Workers = p.TxCount
+	}
+	if p.Rate < 0 {
+		return fmt.Errorf("the rate of phase %s must not be negative", p.Name)
+	}
+	if p.ConflictRetries < 0 {
+		return fmt.Errorf("the conflict retries of phase %s must not be negative", p.Name)
+	}
+	if p.HotKeys != nil {
+		if p.HotKeys.Count <= 0 {
+			return fmt.Errorf("the hot keys count of phase %s must be positive", p.Name)
+		}
+		if p.HotKeys.Skew == 0 {
+			p.HotKeys.Skew = DEFAULT_HOT_KEY_SKEW
+		}
+		if p.HotKeys.Skew <= 1 {
+			return fmt.Errorf("the hot keys skew of phase %s must be greater than 1", p.Name)
+		}
+	}
+	if len(p.Functions) == 0 {
+		p.Functions = []FunctionSpec{{Name: "CreateAsset"}}
+	}
+	totalWeight := 0
+	for i := range p.Functions {
+		f := &p.Functions[i]
+		if f.Name == "" {
+			return fmt.Errorf("function %d of phase %s has no name", i+1, p.Name)
+		}
+		if preset, ok := functionPresets[f.Name]; ok && len(f.Args) == 0 {
+			f.Args = preset.Args
+			if f.Type == "" {
+				f.Type = preset.Type
+			}
+		}
+		if f.Type == "" {
+			f.Type = FUNCTION_INVOKE
+		}
+		if f.Type != FUNCTION_INVOKE && f.Type != FUNCTION_QUERY {
+			return fmt.Errorf("the type of function %s in phase %s must be %s or %s. found: %q", f.Name, p.Name, FUNCTION_INVOKE, FUNCTION_QUERY, f.Type)
+		}
+		if f.weight() < 0 {
+			return fmt.Errorf("the weight of function %s in phase %s must not be negative", f.Name, p.Name)
+		}
+		totalWeight += f.weight()
+		for _, arg := range f.Args {
+			err := validateArg(arg)
+			if err != nil {
+				return fmt.Errorf("invalid argument for function %s in phase %s. %v", f.Name, p.Name, err)
+			}
+		}
+		if p.HotKeys == nil && usesGenerator(*f, "hotAssetId") {
+			return fmt.Errorf("function %s in phase %s uses ${hotAssetId}, but the phase has no hot keys", f.Name, p.Name)
+		}
+	}
+	if totalWeight == 0 {
+		return fmt.Errorf("at least one function of phase %s must have a positive weight", p.Name)
+	}
+	return nil
+}
+
+// parseFunctionMix parses a comma separated list of function names with an optional
+// weight, such as "CreateAsset:3,TransferAsset:1", a weight of 0 leaving the function out
+// of the mix. Only the preset functions of the
+// asset_transfer chaincode can be used, as there is no way to give the arguments
+func parseFunctionMix(mix string) ([]FunctionSpec, error) {
+	functions := []FunctionSpec{}
+	if mix == "" {
+		return functions, nil
+	}
+	for _, entry := range strings.Split(mix, ",") {
+		parts := strings.SplitN(strings.TrimSpace(entry), ":", 2)
+		if _, ok := functionPresets[parts[0]]; !ok {
+			return nil, fmt.Errorf("unknown function %s in TX_FUNCTIONS", parts[0])
+		}
+		f := FunctionSpec{Name: parts[0]}
+		if len(parts) == 2 {
+			weight, err := strconv.Atoi(parts[1])
+			if err != nil {
+				return nil, fmt.Errorf("failed to convert the weight %s of function %s in TX_FUNCTIONS to integer", parts[1], parts[0])
+			}
+			f.Weight = &weight
+		}
+		functions = append(functions, f)
+	}
+	return functions, nil
+}
+
+func getIntEnv(name string, defaultValue int) (int, error) {
+	valueStr := os.Getenv(name)
+	if valueStr == "" {
+		return defaultValue, nil
+	}
+	value, err := strconv.Atoi(valueStr)
+	if err != nil {
+		return 0, fmt.Errorf("failed to convert %s %s to integer", name, valueStr)
+	}
+	return value, nil
+}
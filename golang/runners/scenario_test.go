@@ -0,0 +1,394 @@
+package runners
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// the environment variables read by ScenarioFromEnv, cleared by setEnv unless given
+var scenarioEnvVars = []string{
+	"AGENTS", "AGENT_START_DELAY", "APIKEY", "BASELINE_FILE", "CCNAME", "CCP", "CHANNEL_ID",
+	"COMPLETION_TIMEOUT", "CONFIRMATION", "CONFLICT_RETRIES", "CONSORTIUM", "ENVIRONMENT",
+	"EVENT_BATCH_SIZE", "EVENT_CHECKPOINT_FILE", "FABCONNECT_CA_CERT", "FABCONNECT_CLIENT_CERT",
+	"FABCONNECT_CLIENT_KEY", "FABCONNECT_RETRY_BACKOFF", "FABCONNECT_RETRY_ERROR_PATTERNS",
+	"FABCONNECT_RETRY_MAX_ATTEMPTS", "FABCONNECT_RETRY_MAX_WAIT", "FABCONNECT_RETRY_STATUS_CODES",
+	"FABCONNECT_URL", "FABCONNECT_WS_URL", "HOT_KEYS", "HOT_KEY_SKEW", "IDENTITY_ASSIGNMENT",
+	"IDENTITY_COUNT", "INIT_CC", "KALEIDO_URL", "MAX_LATENCY_INCREASE", "MAX_TPS_DROP",
+	"RECEIPT_TIMEOUT", "RESULTS_FILE", "SUBMITTER", "SUBSCRIPTION_TIMEOUT", "TX_COUNT",
+	"TX_FUNCTIONS", "USER_ID", "USE_FABCONNECT", "WARMUP_DURATION", "WARMUP_TX_COUNT",
+	"WEBHOOK_HEADERS", "WEBHOOK_LISTEN_ADDRESS", "WEBHOOK_REQUEST_TIMEOUT",
+	"WEBHOOK_TLS_SKIP_VERIFY", "WEBHOOK_URL", "WORKERS",
+}
+
+func setEnv(t *testing.T, env map[string]string) {
+	for _, name := range scenarioEnvVars {
+		previous, set := os.LookupEnv(name)
+		os.Setenv(name, env[name])
+		t.Cleanup(func() {
+			if set {
+				os.Setenv(name, previous)
+			} else {
+				os.Unsetenv(name)
+			}
+		})
+	}
+}
+
+func writeScenario(t *testing.T, name, content string) string {
+	filename := filepath.Join(t.TempDir(), name)
+	err := ioutil.WriteFile(filename, []byte(content), 0644)
+	if err != nil {
+		t.Fatalf("failed to write the scenario. %v", err)
+	}
+	return filename
+}
+
+func weight(value int) *int {
+	return &value
+}
+
+func validScenario() *Scenario {
+	return &Scenario{
+		Target:     TargetSpec{Type: TARGET_CCP, CCP: "ccp.yaml"},
+		Identities: []string{"user1"},
+		Channel:    "default-channel",
+		Chaincode:  "asset_transfer",
+		Phases:     []PhaseSpec{{Name: "load", TxCount: 10}},
+	}
+}
+
+func TestLoadScenario(t *testing.T) {
+	cases := []struct {
+		name    string
+		file    string
+		content string
+		invalid string
+	}{
+		{"yaml", "run.yaml", "target:\n  type: ccp\n  ccp: ccp.yaml\nidentities: [user1]\nchannel: ch1\nchaincode: cc1\nphases:\n  - txCount: 10\n", ""},
+		{"json", "run.json", `{"target":{"type":"ccp","ccp":"ccp.yaml"},"identities":["user1"],"channel":"ch1","chaincode":"cc1","phases":[{"txCount":10}]}`, ""},
+		{"json with the inline fields", "run.json", `{"target":{"type":"fabconnect","fabconnect":{"url":"http://localhost:3000","confirmation":"receipts"}},"identities":["user1"],"channel":"ch1","chaincode":"cc1","phases":[{"txCount":10}],"results":{"file":"results.json","maxTpsDrop":5}}`, ""},
+		{"yaml with an unknown field", "run.yaml", "target:\n  type: ccp\n  ccp: ccp.yaml\nidentities: [user1]\nchannel: ch1\nchaincode: cc1\nphases:\n  - txcount: 10\n", "txcount"},
+		{"json with an unknown field", "run.json", `{"target":{"type":"ccp","ccp":"ccp.yaml"},"identities":["user1"],"channel":"ch1","chaincode":"cc1","phases":[{"txCont":10}]}`, "txCont"},
+		{"json with an unknown nested field", "run.json", `{"target":{"type":"fabconnect","fabconnect":{"url":"http://localhost:3000","batchSize":10}},"identities":["user1"],"channel":"ch1","chaincode":"cc1","phases":[{"txCount":10}]}`, "batchSize"},
+		{"invalid scenario", "run.yaml", "target:\n  type: other\nidentities: [user1]\nchannel: ch1\nchaincode: cc1\nphases:\n  - txCount: 10\n", "target type"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			scenario, err := LoadScenario(writeScenario(t, c.file, c.content))
+			if c.invalid != "" {
+				if err == nil || !strings.Contains(err.Error(), c.invalid) {
+					t.Fatalf("expected an error about %s. found: %v", c.invalid, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error. %v", err)
+			}
+			if scenario.Name != "run" {
+				t.Errorf("expected the scenario to be named after the file. found: %s", scenario.Name)
+			}
+			if scenario.Target.Kaleido.Channel != "ch1" {
+				t.Errorf("expected the Kaleido channel to default to the channel of the scenario. found: %s", scenario.Target.Kaleido.Channel)
+			}
+		})
+	}
+}
+
+func TestScenarioValidate(t *testing.T) {
+	cases := []struct {
+		name    string
+		modify  func(s *Scenario)
+		invalid string
+	}{
+		{"valid", func(s *Scenario) {}, ""},
+		{"unknown target type", func(s *Scenario) { s.Target.Type = "other" }, "target type"},
+		{"no identity", func(s *Scenario) { s.Identities = nil }, "at least one identity"},
+		{"unknown identity assignment", func(s *Scenario) { s.IdentityAssignment = "sticky" }, "identity assignment"},
+		{"no phase", func(s *Scenario) { s.Phases = nil }, "at least one phase"},
+		{"no channel", func(s *Scenario) { s.Channel = "" }, "the channel is required"},
+		{"phase with neither a count nor a duration", func(s *Scenario) { s.Phases[0].TxCount = 0 }, "either a transaction count or a duration"},
+		{"invalid phase duration", func(s *Scenario) { s.Phases[0].TxCount = 0; s.Phases[0].Duration = "1 minute" }, "duration"},
+		{"negative rate", func(s *Scenario) { s.Phases[0].Rate = -1 }, "rate"},
+		{"invalid completion timeout", func(s *Scenario) { s.CompletionTimeout = "soon" }, "completion timeout"},
+		{"negative threshold", func(s *Scenario) { drop := -1.0; s.Results.MaxTPSDrop = &drop }, "thresholds"},
+		{"receipts without FabConnect", func(s *Scenario) { s.Target.Fabconnect.Confirmation = CONFIRM_RECEIPTS }, "only supported"},
+		{"unknown confirmation", func(s *Scenario) { s.Target.Fabconnect.Confirmation = "blocks" }, "confirmation must be one of"},
+		{"hot keys without a count", func(s *Scenario) { s.Phases[0].HotKeys = &HotKeySpec{} }, "hot keys count"},
+		{"hot keys skew of 1", func(s *Scenario) { s.Phases[0].HotKeys = &HotKeySpec{Count: 10, Skew: 1} }, "skew"},
+		{"deployment listed twice", func(s *Scenario) {
+			s.Deployments = []DeploymentSpec{{Chaincode: "cc1"}, {Chaincode: "cc1"}}
+		}, "more than once"},
+		{"negative deployment weight", func(s *Scenario) {
+			s.Deployments = []DeploymentSpec{{Chaincode: "cc1", Weight: weight(-1)}, {Chaincode: "cc2"}}
+		}, "must not be negative"},
+		{"deployment weights all 0", func(s *Scenario) {
+			s.Deployments = []DeploymentSpec{{Chaincode: "cc1", Weight: weight(0)}, {Chaincode: "cc2", Weight: weight(0)}}
+		}, "at least one deployment must have a positive weight"},
+		{"deployment left out with a weight of 0", func(s *Scenario) {
+			s.Deployments = []DeploymentSpec{{Chaincode: "cc1", Weight: weight(0)}, {Chaincode: "cc2"}}
+		}, ""},
+		{"several channels on Kaleido", func(s *Scenario) {
+			s.Target = TargetSpec{Type: TARGET_KALEIDO}
+			s.Deployments = []DeploymentSpec{{Channel: "ch1"}, {Channel: "ch2"}}
+		}, "single channel"},
+		{"function without a name", func(s *Scenario) { s.Phases[0].Functions = []FunctionSpec{{}} }, "has no name"},
+		{"unknown function type", func(s *Scenario) {
+			s.Phases[0].Functions = []FunctionSpec{{Name: "Mint", Type: "write"}}
+		}, "must be invoke or query"},
+		{"unknown argument generator", func(s *Scenario) {
+			s.Phases[0].Functions = []FunctionSpec{{Name: "Mint", Args: []string{"${newTokenId}"}}}
+		}, "unknown argument generator"},
+		{"invalid generator parameter", func(s *Scenario) {
+			s.Phases[0].Functions = []FunctionSpec{{Name: "Mint", Args: []string{"${randomString:big}"}}}
+		}, "invalid parameter"},
+		{"hot asset ID without hot keys", func(s *Scenario) {
+			s.Phases[0].Functions = []FunctionSpec{{Name: "UpdateAsset", Args: []string{"${hotAssetId}"}}}
+		}, "no hot keys"},
+		{"negative function weight", func(s *Scenario) {
+			s.Phases[0].Functions = []FunctionSpec{{Name: "CreateAsset", Weight: weight(-2)}}
+		}, "must not be negative"},
+		{"function weights all 0", func(s *Scenario) {
+			s.Phases[0].Functions = []FunctionSpec{{Name: "CreateAsset", Weight: weight(0)}, {Name: "ReadAsset", Weight: weight(0)}}
+		}, "at least one function of phase load must have a positive weight"},
+		{"function left out with a weight of 0", func(s *Scenario) {
+			s.Phases[0].Functions = []FunctionSpec{{Name: "CreateAsset"}, {Name: "ReadAsset", Weight: weight(0)}}
+		}, ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := validScenario()
+			c.modify(s)
+			err := s.validate()
+			if c.invalid == "" && err != nil {
+				t.Fatalf("unexpected error. %v", err)
+			}
+			if c.invalid != "" && (err == nil || !strings.Contains(err.Error(), c.invalid)) {
+				t.Fatalf("expected an error about %q. found: %v", c.invalid, err)
+			}
+		})
+	}
+}
+
+func TestScenarioValidateDefaults(t *testing.T) {
+	s := validScenario()
+	s.Phases[0].Workers = 20
+	s.WarmUp = &WarmUpSpec{TxCount: 5}
+	err := s.validate()
+	if err != nil {
+		t.Fatalf("unexpected error. %v", err)
+	}
+	if s.IdentityAssignment != ASSIGN_ROUND_ROBIN {
+		t.Errorf("expected the identities to be assigned %s. found: %s", ASSIGN_ROUND_ROBIN, s.IdentityAssignment)
+	}
+	if len(s.Deployments) != 1 || s.Deployments[0].Channel != "default-channel" || s.Deployments[0].Chaincode != "asset_transfer" {
+		t.Errorf("expected a deployment of the chaincode on the channel of the scenario. found: %+v", s.Deployments)
+	}
+	if s.completionTimeout != DEFAULT_COMPLETION_TIMEOUT {
+		t.Errorf("expected the default completion timeout. found: %s", s.completionTimeout)
+	}
+	if len(s.Phases) != 2 || !s.Phases[0].warmUp || s.Phases[0].TxCount != 5 {
+		t.Fatalf("expected a warm-up phase of 5 transactions first. found: %+v", s.Phases)
+	}
+	load := s.Phases[1]
+	if load.Workers != 10 {
+		t.Errorf("expected the workers to be capped to the transaction count. found: %d", load.Workers)
+	}
+	// an empty function mix is a mix of CreateAsset
+	if len(load.Functions) != 1 || load.Functions[0].Name != "CreateAsset" || load.Functions[0].Type != FUNCTION_INVOKE || len(load.Functions[0].Args) == 0 {
+		t.Errorf("expected the function mix to default to CreateAsset. found: %+v", load.Functions)
+	}
+}
+
+func TestParseFunctionMix(t *testing.T) {
+	cases := []struct {
+		mix       string
+		functions []FunctionSpec
+		invalid   string
+	}{
+		{"", []FunctionSpec{}, ""},
+		{"CreateAsset", []FunctionSpec{{Name: "CreateAsset"}}, ""},
+		{"CreateAsset:3, ReadAsset:1", []FunctionSpec{{Name: "CreateAsset", Weight: weight(3)}, {Name: "ReadAsset", Weight: weight(1)}}, ""},
+		{"CreateAsset,TransferAsset:0", []FunctionSpec{{Name: "CreateAsset"}, {Name: "TransferAsset", Weight: weight(0)}}, ""},
+		{"CreateAsset,DeleteAsset", nil, "unknown function DeleteAsset"},
+		{"CreateAsset:many", nil, "failed to convert the weight"},
+	}
+	for _, c := range cases {
+		t.Run(c.mix, func(t *testing.T) {
+			functions, err := parseFunctionMix(c.mix)
+			if c.invalid != "" {
+				if err == nil || !strings.Contains(err.Error(), c.invalid) {
+					t.Fatalf("expected an error about %q. found: %v", c.invalid, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error. %v", err)
+			}
+			if !reflect.DeepEqual(functions, c.functions) {
+				t.Errorf("expected %+v. found: %+v", c.functions, functions)
+			}
+		})
+	}
+}
+
+func TestScenarioFromEnvMatchesScenarioFile(t *testing.T) {
+	cases := []struct {
+		name string
+		env  map[string]string
+		yaml string
+	}{
+		{
+			name: "defaults",
+			env:  map[string]string{"CCP": "ccp.yaml"},
+			yaml: `
+name: default
+target:
+  type: ccp
+  ccp: ccp.yaml
+  fabconnect:
+    eventBatchSize: 1
+identities: [user1]
+channel: default-channel
+chaincode: asset_transfer
+phases:
+  - name: default
+    txCount: 1
+    workers: 1
+`,
+		},
+		{
+			name: "FabConnect with several chaincodes, a function mix and a warm-up",
+			env: map[string]string{
+				"USE_FABCONNECT":   "true",
+				"FABCONNECT_URL":   "http://localhost:3000",
+				"CONFIRMATION":     "receipts",
+				"EVENT_BATCH_SIZE": "10",
+				"USER_ID":          "bench",
+				"IDENTITY_COUNT":   "2",
+				"CHANNEL_ID":       "ch1",
+				"CCNAME":           "cc1, cc2",
+				"TX_COUNT":         "100",
+				"WORKERS":          "4",
+				"TX_FUNCTIONS":     "CreateAsset:3,ReadAsset:1",
+				"WARMUP_TX_COUNT":  "10",
+				"RESULTS_FILE":     "results.json",
+				"MAX_TPS_DROP":     "5",
+			},
+			yaml: `
+name: default
+target:
+  type: fabconnect
+  fabconnect:
+    url: http://localhost:3000
+    confirmation: receipts
+    eventBatchSize: 10
+identities: [bench-1, bench-2]
+channel: ch1
+chaincode: cc1
+deployments:
+  - channel: ch1
+    chaincode: cc1
+  - channel: ch1
+    chaincode: cc2
+warmUp:
+  txCount: 10
+results:
+  file: results.json
+  maxTpsDrop: 5
+phases:
+  - name: default
+    txCount: 100
+    workers: 4
+    functions:
+      - name: CreateAsset
+        weight: 3
+      - name: ReadAsset
+        weight: 1
+`,
+		},
+		{
+			name: "hot keys",
+			env: map[string]string{
+				"CCP":              "ccp.yaml",
+				"TX_COUNT":         "50",
+				"WORKERS":          "5",
+				"HOT_KEYS":         "8",
+				"HOT_KEY_SKEW":     "1.5",
+				"CONFLICT_RETRIES": "2",
+			},
+			yaml: `
+name: default
+target:
+  type: ccp
+  ccp: ccp.yaml
+  fabconnect:
+    eventBatchSize: 1
+identities: [user1]
+channel: default-channel
+chaincode: asset_transfer
+phases:
+  - name: hot-keys-setup
+    txCount: 8
+    workers: 5
+  - name: contention
+    txCount: 50
+    workers: 5
+    conflictRetries: 2
+    hotKeys:
+      count: 8
+      skew: 1.5
+    functions:
+      - name: UpdateAsset
+        args: ["${hotAssetId}", "blue", "15", "Tom", "1500"]
+`,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			setEnv(t, c.env)
+			fromEnv, err := ScenarioFromEnv()
+			if err != nil {
+				t.Fatalf("failed to build the scenario from the environment. %v", err)
+			}
+			fromFile, err := LoadScenario(writeScenario(t, "default.yaml", c.yaml))
+			if err != nil {
+				t.Fatalf("failed to load the scenario file. %v", err)
+			}
+			if c.env["CHANNEL_ID"] == "" {
+				// without CHANNEL_ID, the Kaleido channel is left to be selected interactively,
+				// while a file always gives the channel of the scenario
+				fromFile.Target.Kaleido.Channel = ""
+			}
+			if !reflect.DeepEqual(fromEnv, fromFile) {
+				t.Errorf("expected the scenarios to match.\nfrom the environment: %+v\nfrom the file: %+v", fromEnv, fromFile)
+			}
+		})
+	}
+}
+
+func TestScenarioFromEnvInvalid(t *testing.T) {
+	cases := []struct {
+		name    string
+		env     map[string]string
+		invalid string
+	}{
+		{"transaction count", map[string]string{"TX_COUNT": "lots"}, "TX_COUNT"},
+		{"unknown function", map[string]string{"TX_FUNCTIONS": "CreateAsset,BurnAsset"}, "unknown function BurnAsset"},
+		{"function weights all 0", map[string]string{"TX_FUNCTIONS": "CreateAsset:0"}, "positive weight"},
+		{"hot key skew", map[string]string{"HOT_KEYS": "5", "HOT_KEY_SKEW": "steep"}, "HOT_KEY_SKEW"},
+		{"threshold", map[string]string{"MAX_LATENCY_INCREASE": "-5"}, "must not be negative"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			setEnv(t, c.env)
+			_, err := ScenarioFromEnv()
+			if err == nil || !strings.Contains(err.Error(), c.invalid) {
+				t.Fatalf("expected an error about %q. found: %v", c.invalid, err)
+			}
+		})
+	}
+}
@@ -3,7 +3,6 @@ package runners
 import (
 	"context"
 	"fmt"
-	"os"
 	"time"
 
 	"github.com/hyperledger/fabric-sdk-go/pkg/client/msp"
@@ -16,121 +15,170 @@ import (
 )
 
 type SDKRunner struct {
-	user          string
-	channel       string
-	chaincode     string
-	count         int
-	workers       int
-	initChaincode bool
-	channelClient *kaleido.Channel
-	sdk           *fabsdk.FabricSDK
+	scenario *Scenario
+	clients  []identityClient
+	sdk      *fabsdk.FabricSDK
+	// buffered so the event listeners never block once the runner stops waiting
+	eventAssetIdsChan chan string
+	cleanups          cleanups
+	// the summaries of the phases run so far
+	summaries []*phaseSummary
 }
 
-func NewSDKRunner(user, channel, chaincode string, count, workers int, initChaincode bool) *SDKRunner {
+// channelRouter sends each request through the channel client of its channel,
+// all connected as the same identity
+type channelRouter map[string]*kaleido.Channel
+
+func (r channelRouter) InitChaincode(channel, chaincodeId string) (string, error) {
+	return r[channel].InitChaincode(channel, chaincodeId)
+}
+
+func (r channelRouter) ExecChaincode(channel, chaincodeId, function string, args []string) (string, error) {
+	return r[channel].ExecChaincode(channel, chaincodeId, function, args)
+}
+
+func (r channelRouter) QueryChaincode(channel, chaincodeId, function string, args []string) (string, error) {
+	return r[channel].QueryChaincode(channel, chaincodeId, function, args)
+}
+
+func NewSDKRunner(scenario *Scenario) *SDKRunner {
 	return &SDKRunner{
-		user:          user,
-		channel:       channel,
-		chaincode:     chaincode,
-		count:         count,
-		workers:       workers,
-		initChaincode: initChaincode,
+		scenario:          scenario,
+		eventAssetIdsChan: make(chan string, 1000),
 	}
 }
 
-func (s *SDKRunner) Exec() error {
-	log.Info("Using the Fabric SDK for transaction submission")
-	err := s.init(s.channel)
+func (s *SDKRunner) Exec(ctx context.Context) error {
+	defer s.close()
+	err := s.prepare(ctx)
 	if err != nil {
 		return err
 	}
-	defer s.sdk.Close()
+	return s.dispatch(ctx)
+}
 
-	if s.initChaincode {
-		err = s.runInitChaincode()
-	} else {
-		err = s.runTransactions()
-	}
+// prepare connects to the channels as each identity, and subscribes to the events
+func (s *SDKRunner) prepare(ctx context.Context) error {
+	log.Info("Using the Fabric SDK for transaction submission")
+	err := s.init()
 	if err != nil {
 		return err
 	}
+	s.cleanups.add(s.sdk.Close)
 
-	return nil
+	if s.scenario.InitChaincode {
+		return nil
+	}
+	return s.subscribeEvents()
 }
 
-func (s *SDKRunner) runInitChaincode() error {
-	txId, err := s.channelClient.InitChaincode(s.channel, s.chaincode)
-	if err != nil {
-		log.Errorf("Failed to initialize chaincode: %s", err)
-		return err
+// dispatch initializes the chaincodes, or runs the phases
+func (s *SDKRunner) dispatch(ctx context.Context) error {
+	if s.scenario.InitChaincode {
+		return s.runInitChaincode()
 	}
+	return s.runPhases(ctx)
+}
 
-	log.Infof("Chaincode initialized. TxId: %s", txId)
-	return nil
+func (s *SDKRunner) close() {
+	s.cleanups.run()
 }
 
-func (s *SDKRunner) runTransactions() error {
-	ctx := context.Background()
-	// assign each worker the transaction count
-	done, workers := allocateWorkers(ctx, s.channel, s.chaincode, s.count, s.workers, s.channelClient)
+func (s *SDKRunner) runInitChaincode() error {
+	for _, d := range s.scenario.Deployments {
+		txId, err := s.clients[0].client.InitChaincode(d.Channel, d.Chaincode)
+		if err != nil {
+			log.Errorf("Failed to initialize chaincode %s on channel %s: %s", d.Chaincode, d.Channel, err)
+			return err
+		}
+		log.Infof("Chaincode %s initialized on channel %s. TxId: %s", d.Chaincode, d.Channel, txId)
+	}
+	return nil
+}
 
-	// subscribe to events
-	reg, err := s.channelClient.SubscribeEvents(s.chaincode, done, s.count)
+// subscribeEvents subscribes to the events of each chaincode on its channel
+func (s *SDKRunner) subscribeEvents() error {
+	router := s.clients[0].client.(channelRouter)
+	checkpoints, err := s.scenario.checkpointStore()
 	if err != nil {
-		log.Errorf("Failed to subscribe to events: %s", err)
+		log.Errorf("Failed to load the event checkpoints. %v", err)
 		return err
 	}
-
-	s.channelClient.Start = time.Now()
-
-	// start workers
-	for _, w := range workers {
-		w.Start()
+	for _, d := range s.scenario.Deployments {
+		channelClient := router[d.Channel]
+		channelClient.Checkpoints = checkpoints
+		reg, err := channelClient.SubscribeEvents(d.Chaincode, s.eventAssetIdsChan)
+		if err != nil {
+			log.Errorf("Failed to subscribe to events of chaincode %s on channel %s: %s", d.Chaincode, d.Channel, err)
+			return err
+		}
+		s.cleanups.add(func() { channelClient.UnsubscribeEvents(reg) })
 	}
+	return nil
+}
 
-	<-done
+func (s *SDKRunner) runPhases(ctx context.Context) error {
+	start := time.Now()
 
-	defer s.channelClient.UnsubscribeEvents(reg)
+	summaries, err := runPhases(ctx, s.scenario, s.clients, s.eventAssetIdsChan, nil, nil)
+	s.summaries = summaries
 
-	printFinalReport(s.count, s.workers, 1, s.channelClient.Start)
+	printFinalReport(s.scenario, 1, start, summaries)
 
-	return nil
+	return processResults(s.scenario, summaries, err)
+}
+
+func (s *SDKRunner) phaseSummaries() []*phaseSummary {
+	return s.summaries
 }
 
-func (s *SDKRunner) init(channel string) error {
-	var signer *coremsp.IdentityIdentifier
+func (s *SDKRunner) init() error {
+	var signers []*coremsp.IdentityIdentifier
 	var orgId string
 	// if a CCP YAML is provided, use it to initialize the SDK
-	ccpFile := os.Getenv("CCP")
-	if ccpFile != "" {
-		si, orgID, err := s.initWithCCP(ccpFile)
+	if s.scenario.Target.Type == TARGET_CCP {
+		signerIds, orgID, err := s.initWithCCP(s.scenario.Target.CCP)
 		if err != nil {
 			log.Errorf("Failed to instantiate an SDK: %s", err)
 			return err
 		}
-		signer = si.Identifier()
+		signers = signerIds
 		orgId = orgID
 	} else {
-		selectedChannel, signerId, orgID, err := s.initWithKaleido()
+		selectedChannel, signerIds, orgID, err := s.initWithKaleido()
 		if err != nil {
 			log.Errorf("Failed to instantiate an SDK: %s", err)
 			return err
 		}
-		signer = signerId
+		signers = signerIds
 		orgId = orgID
-		channel = selectedChannel
+		// a Kaleido scenario has a single channel, which may have been selected interactively
+		s.scenario.Channel = selectedChannel
+		for i := range s.scenario.Deployments {
+			s.scenario.Deployments[i].Channel = selectedChannel
+		}
 	}
 
-	s.channelClient = kaleido.NewChannel(channel, s.sdk)
-	err := s.channelClient.Connect(signer, orgId)
-	if err != nil {
-		log.Errorf("Failed to connect to channel: %s", err)
-		return err
+	// a channel client for each identity on each channel, the clients of the first
+	// identity are also used for the events
+	for _, signer := range signers {
+		router := channelRouter{}
+		for _, channel := range s.scenario.channels() {
+			channelClient := kaleido.NewChannel(channel, s.sdk)
+			err := channelClient.Connect(signer, orgId)
+			if err != nil {
+				log.Errorf("Failed to connect to channel %s as %s: %s", channel, signer.ID, err)
+				return err
+			}
+			router[channel] = channelClient
+		}
+		s.clients = append(s.clients, identityClient{identity: signer.ID, client: router})
 	}
 
 	return nil
 }
 
-func (s *SDKRunner) initWithCCP(ccpFile string) (coremsp.SigningIdentity, string, error) {
+func (s *SDKRunner) initWithCCP(ccpFile string) ([]*coremsp.IdentityIdentifier, string, error) {
 	configProvider := config.FromFile(ccpFile)
 	sdk, err := fabsdk.New(configProvider)
 	if err != nil {
@@ -161,16 +209,20 @@ func (s *SDKRunner) initWithCCP(ccpFile string) (coremsp.SigningIdentity, string
 		log.Errorf("Failed to create Fabric CA client. %v", err)
 		return nil, "", err
 	}
-	si, err := mspClient.GetSigningIdentity(s.user)
-	if err != nil {
-		log.Errorf("Failed to get signing identity: %v.", err)
-		return nil, "", err
+	signers := []*coremsp.IdentityIdentifier{}
+	for _, identity := range s.scenario.Identities {
+		si, err := mspClient.GetSigningIdentity(identity)
+		if err != nil {
+			log.Errorf("Failed to get signing identity %s: %v.", identity, err)
+			return nil, "", err
+		}
+		signers = append(signers, si.Identifier())
 	}
-	return si, orgId.(string), nil
+	return signers, orgId.(string), nil
 }
 
-func (s *SDKRunner) initWithKaleido() (string, *coremsp.IdentityIdentifier, string, error) {
-	network := kaleido.NewNetwork()
+func (s *SDKRunner) initWithKaleido() (string, []*coremsp.IdentityIdentifier, string, error) {
+	network := kaleido.NewNetwork(s.scenario.Target.Kaleido)
 	network.Initialize()
 	config, err := fabric.BuildConfig(network)
 	if err != nil {
@@ -184,21 +236,30 @@ func (s *SDKRunner) initWithKaleido() (string, *coremsp.IdentityIdentifier, stri
 	}
 	defer sdk1.Close()
 
-	wallet := kaleido.NewWallet(s.user, *network, sdk1)
-	err = wallet.InitIdentity()
-	if err != nil || wallet.Signer == nil {
-		log.Errorf("Failed to initiate wallet: %v", err)
-		return "", nil, "", err
+	// register and enroll all the identities up front, the first one is used for the client TLS
+	signers := []*coremsp.IdentityIdentifier{}
+	var tlsSigner coremsp.SigningIdentity
+	for _, identity := range s.scenario.Identities {
+		wallet := kaleido.NewWallet(identity, *network, sdk1)
+		err = wallet.InitIdentity()
+		if err != nil || wallet.Signer == nil {
+			log.Errorf("Failed to initiate wallet for %s: %v", identity, err)
+			return "", nil, "", err
+		}
+		if tlsSigner == nil {
+			tlsSigner = wallet.Signer
+		}
+		signers = append(signers, wallet.Signer.Identifier())
 	}
 
-	fabric.AddTlsConfig(config, wallet.Signer)
+	fabric.AddTlsConfig(config, tlsSigner)
 
 	sdk2, err := newSDK(config)
 	s.sdk = sdk2
 	if err != nil {
 		return "", nil, "", err
 	}
-	return network.TargetChannel.Name, wallet.Signer.Identifier(), network.MyMembership.ID, nil
+	return network.TargetChannel.Name, signers, network.MyMembership.ID, nil
 }
 
 func newSDK(config map[string]interface{}) (*fabsdk.FabricSDK, error) {
@@ -0,0 +1,533 @@
+package runners
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var DEFAULT_COMPLETION_TIMEOUT time.Duration = time.Duration(5) * time.Minute
+var DEFAULT_SHUTDOWN_GRACE_PERIOD time.Duration = time.Duration(10) * time.Second
+
+// txTracker keeps track of the transactions submitted by the workers of a phase, and
+// the ones that have been confirmed by a chaincode event or have failed to submit,
+// so the runners can tell when the phase is complete, and which transactions never
+// made it. The phase is complete once all the workers have stopped dispatching and
+// every submitted transaction is either confirmed or failed
+type txTracker struct {
+	mu          sync.Mutex
+	phase       string
+	expected    int
+	dispatching int
+	submissions int
+	payload     int
+	maxPayload  int
+	latencies   []time.Duration
+	pending     map[string][]*txRequest
+	confirmed   int
+	failed      int
+	failures    map[failureClass]int
+	// the transactions given up on by the workers because they could not be generated
+	ungenerated int
+	// the asset IDs of the transactions whose confirmation did not arrive in time
+	unconfirmed []string
+	// set when the transactions of the phase are confirmed by other means than the events
+	ignoreEvents bool
+	// closed once all the workers have stopped dispatching
+	dispatched chan struct{}
+	functions  map[string]*txStats
+	identities map[string]*txStats
+	channels   map[string]*txStats
+	chaincodes map[string]*txStats
+	conflicts  int
+	retries    int
+	recovered  int
+	reconnects int
+	// the requests retried by the client, such as when FabConnect has too many transactions in flight
+	requestRetries int
+	complete       chan struct{}
+	interrupted    bool
+	start          time.Time
+	end            time.Time
+}
+
+// phaseSummary is a point in time copy of the counters of a tracker
+type phaseSummary struct {
+	phase          string
+	expected       int
+	submitted      int
+	payload        int
+	maxPayload     int
+	latency        latencyStats
+	latencies      []time.Duration
+	confirmed      int
+	failed         int
+	failures       map[failureClass]int
+	functions      map[string]txStats
+	identities     map[string]txStats
+	channels       map[string]txStats
+	chaincodes     map[string]txStats
+	conflicts      int
+	retries        int
+	recovered      int
+	reconnects     int
+	requestRetries int
+	missing        []string
+	interrupted    bool
+	elapsed        time.Duration
+}
+
+// txStats are the counters of the transactions of a function, signed by an identity, or
+// sent to a channel or a chaincode
+type txStats struct {
+	submitted int
+	confirmed int
+	failed    int
+}
+
+func newTxTracker(phase string, expected, workers int) *txTracker {
+	return &txTracker{
+		phase:       phase,
+		expected:    expected,
+		dispatching: workers,
+		pending:     make(map[string][]*txRequest),
+		failures:    make(map[failureClass]int),
+		dispatched:  make(chan struct{}),
+		functions:   make(map[string]*txStats),
+		identities:  make(map[string]*txStats),
+		channels:    make(map[string]*txStats),
+		chaincodes:  make(map[string]*txStats),
+		complete:    make(chan struct{}),
+	}
+}
+
+func (t *txTracker) started() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.start = time.Now()
+}
+
+// submitted must be called before the transaction is sent, as the event may
+// arrive before the client call returns
+func (t *txTracker) submitted(req *txRequest) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	req.sent = time.Now()
+	t.pending[req.assetId] = append(t.pending[req.assetId], req)
+	t.submissions++
+	t.payload += req.payloadSize
+	if req.payloadSize > t.maxPayload {
+		t.maxPayload = req.payloadSize
+	}
+	for _, stats := range t.stats(req) {
+		stats.submitted++
+	}
+}
+
+// workerDone is called by each worker when it stops dispatching transactions
+func (t *txTracker) workerDone() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.dispatching--
+	if t.dispatching == 0 {
+		close(t.dispatched)
+	}
+	t.checkComplete()
+}
+
+// confirm records the chaincode event for an asset ID. When several transactions
+// for the same asset are in flight, the event confirms the oldest one
+func (t *txTracker) confirm(assetId string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.ignoreEvents {
+		log.Debugf("Ignoring event for asset ID %s, confirmed by its receipt", assetId)
+		return
+	}
+	for _, req := range t.pending[assetId] {
+		// queries in flight for the same asset do not produce events
+		if !req.query {
+			t.completeLocked(req)
+			log.Infof("Events received: %d", t.confirmed)
+			return
+		}
+	}
+	log.Warnf("Received event for unknown asset ID: %s", assetId)
+}
+
+// completed records a transaction that is confirmed without an event, such as a query
+func (t *txTracker) completed(req *txRequest) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.completeLocked(req)
+}
+
+func (t *txTracker) completeLocked(req *txRequest) {
+	if !t.remove(req) {
+		return
+	}
+	t.confirmed++
+	// from the first submission to the confirmation, including the retries
+	t.latencies = append(t.latencies, time.Since(req.sent))
+	for _, stats := range t.stats(req) {
+		stats.confirmed++
+	}
+	if req.retries > 0 {
+		t.recovered++
+	}
+	if len(req.createdAssets) > 0 {
+		req.deployment.pool.add(req.createdAssets...)
+	}
+	t.checkComplete()
+}
+
+// conflict records an MVCC read conflict for a transaction, and whether the
+// worker retries it. The transaction stays pending until it is retried
+func (t *txTracker) conflict(req *txRequest, retry bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.conflicts++
+	if retry {
+		t.retries++
+		req.retries++
+	}
+}
+
+// fail records a transaction that the client failed to submit, so it counts
+// towards the completion of the run without waiting for an event
+func (t *txTracker) fail(req *txRequest, err error) failureClass {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	class := classifyFailure(err)
+	if !t.remove(req) {
+		// the event of another transaction for the same asset has been taken for this one,
+		// so hand the confirmation over to the transaction that is still pending
+		other := t.reassign(req)
+		if other == nil {
+			// the event has already been received, so the failure was reported after the commit
+			log.Warnf("Failure reported for already confirmed asset ID: %s", req.assetId)
+			return class
+		}
+	}
+	t.failed++
+	t.failures[class]++
+	for _, stats := range t.stats(req) {
+		stats.failed++
+	}
+	t.checkComplete()
+	return class
+}
+
+// timedOut records a transaction whose confirmation did not arrive in time, such as a
+// receipt FabConnect never had. It counts towards the completion of the phase, and is
+// reported as missing, as it may still be committed
+func (t *txTracker) timedOut(req *txRequest) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.remove(req) {
+		return
+	}
+	t.unconfirmed = append(t.unconfirmed, req.assetId)
+	t.checkComplete()
+}
+
+// generationFailed records the transactions a worker gives up on when it fails to generate
+// one, so they are reported as failed rather than left out of the run
+func (t *txTracker) generationFailed(count int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.failed += count
+	t.failures[FAILURE_GENERATION] += count
+	t.ungenerated += count
+	t.checkComplete()
+}
+
+// reassign moves the confirmation of a transaction to the oldest transaction still
+// pending for the same asset, and returns it, or nil if there is none
+func (t *txTracker) reassign(req *txRequest) *txRequest {
+	for _, other := range t.pending[req.assetId] {
+		if other.query {
+			continue
+		}
+		t.remove(other)
+		for _, stats := range t.stats(req) {
+			stats.confirmed--
+		}
+		for _, stats := range t.stats(other) {
+			stats.confirmed++
+		}
+		if req.retries > 0 {
+			t.recovered--
+		}
+		if other.retries > 0 {
+			t.recovered++
+		}
+		if len(other.createdAssets) > 0 {
+			other.deployment.pool.add(other.createdAssets...)
+		}
+		return other
+	}
+	return nil
+}
+
+func (t *txTracker) remove(req *txRequest) bool {
+	queue := t.pending[req.assetId]
+	for i, pending := range queue {
+		if pending == req {
+			queue = append(queue[:i], queue[i+1:]...)
+			if len(queue) == 0 {
+				delete(t.pending, req.assetId)
+			} else {
+				t.pending[req.assetId] = queue
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// stats returns the counters of the function of the transaction, of its identity,
+// and of the channel and chaincode it is sent to
+func (t *txTracker) stats(req *txRequest) []*txStats {
+	return []*txStats{
+		statsOf(t.functions, req.function),
+		statsOf(t.identities, req.identity),
+		statsOf(t.channels, req.deployment.channel),
+		statsOf(t.chaincodes, req.deployment.chaincode),
+	}
+}
+
+func statsOf(all map[string]*txStats, key string) *txStats {
+	stats, ok := all[key]
+	if !ok {
+		stats = &txStats{}
+		all[key] = stats
+	}
+	return stats
+}
+
+func (t *txTracker) checkComplete() {
+	// the transactions that could not be generated are failed without being submitted
+	if t.dispatching == 0 && t.confirmed+t.failed+len(t.unconfirmed) >= t.submissions+t.ungenerated {
+		select {
+		case <-t.complete:
+		default:
+			t.end = time.Now()
+			close(t.complete)
+		}
+	}
+}
+
+// reconnected records how many times the event stream was reconnected during the phase
+func (t *txTracker) reconnected(count int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.reconnects += count
+}
+
+// requestsRetried records how many requests the client retried during the phase
+func (t *txTracker) requestsRetried(count int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.requestRetries += count
+}
+
+// missing returns the asset IDs that have been submitted but not confirmed
+func (t *txTracker) missing() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.missingLocked()
+}
+
+func (t *txTracker) missingLocked() []string {
+	ids := append([]string{}, t.unconfirmed...)
+	for assetId, queue := range t.pending {
+		for range queue {
+			ids = append(ids, assetId)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func (t *txTracker) summary() *phaseSummary {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	failures := make(map[failureClass]int)
+	for class, count := range t.failures {
+		failures[class] = count
+	}
+	end := t.end
+	if end.IsZero() {
+		end = time.Now()
+	}
+	return &phaseSummary{
+		phase:          t.phase,
+		expected:       t.expected,
+		submitted:      t.submissions,
+		payload:        t.payload,
+		maxPayload:     t.maxPayload,
+		latency:        newLatencyStats(t.latencies),
+		latencies:      append([]time.Duration{}, t.latencies...),
+		confirmed:      t.confirmed,
+		failed:         t.failed,
+		failures:       failures,
+		functions:      copyStats(t.functions),
+		identities:     copyStats(t.identities),
+		channels:       copyStats(t.channels),
+		chaincodes:     copyStats(t.chaincodes),
+		conflicts:      t.conflicts,
+		retries:        t.retries,
+		recovered:      t.recovered,
+		reconnects:     t.reconnects,
+		requestRetries: t.requestRetries,
+		missing:        t.missingLocked(),
+		interrupted:    t.interrupted,
+		elapsed:        end.Sub(t.start),
+	}
+}
+
+// latencyStats are the percentiles of the confirmation latency of the transactions of a phase
+type latencyStats struct {
+	p50 time.Duration
+	p90 time.Duration
+	p95 time.Duration
+	p99 time.Duration
+	max time.Duration
+}
+
+func newLatencyStats(latencies []time.Duration) latencyStats {
+	if len(latencies) == 0 {
+		return latencyStats{}
+	}
+	sorted := make([]time.Duration, len(latencies))
+	copy(sorted, latencies)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return latencyStats{
+		p50: percentile(sorted, 50),
+		p90: percentile(sorted, 90),
+		p95: percentile(sorted, 95),
+		p99: percentile(sorted, 99),
+		max: sorted[len(sorted)-1],
+	}
+}
+
+// percentile returns the nearest-rank percentile of sorted latencies
+func percentile(sorted []time.Duration, p int) time.Duration {
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+func copyStats(all map[string]*txStats) map[string]txStats {
+	copied := make(map[string]txStats)
+	for key, stats := range all {
+		copied[key] = *stats
+	}
+	return copied
+}
+
+// waitForEvents confirms the asset IDs received from the event stream, until all
+// the transactions have been either confirmed or failed, or the timeout expires.
+// The timeout starts once the workers have stopped dispatching, however long the
+// phase takes to send its transactions. If the context is cancelled, the transactions
+// already in flight are given the shutdown grace period to be confirmed before giving up
+func (t *txTracker) waitForEvents(ctx context.Context, eventAssetIdsChan chan string, timeout time.Duration) error {
+	var timer *time.Timer
+	var expired <-chan time.Time
+	startTimer := func(d time.Duration) {
+		if timer != nil {
+			timer.Stop()
+		}
+		timer = time.NewTimer(d)
+		expired = timer.C
+	}
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+	dispatched := t.dispatched
+	cancelled := ctx.Done()
+	for {
+		select {
+		case eventAssetId := <-eventAssetIdsChan:
+			log.Infof("Received eventAssetId: %s", eventAssetId)
+			t.confirm(eventAssetId)
+		case <-t.complete:
+			if t.isInterrupted() {
+				return fmt.Errorf("run interrupted")
+			}
+			if missing := t.missing(); len(missing) > 0 {
+				return fmt.Errorf("timed out waiting for %d confirmation(s). missing asset IDs: %v", len(missing), missing)
+			}
+			if ungenerated := t.ungeneratedCount(); ungenerated > 0 {
+				return fmt.Errorf("failed to generate %d transaction(s)", ungenerated)
+			}
+			return nil
+		case <-dispatched:
+			log.Infof("Phase %s dispatched %d transaction(s). Waiting up to %s for them to complete", t.phase, t.submittedCount(), timeout)
+			dispatched = nil
+			startTimer(timeout)
+		case <-cancelled:
+			gracePeriod, err := getShutdownGracePeriod()
+			if err != nil {
+				log.Warnf("%v. Using the default %s", err, DEFAULT_SHUTDOWN_GRACE_PERIOD)
+				gracePeriod = DEFAULT_SHUTDOWN_GRACE_PERIOD
+			}
+			log.Warnf("Run interrupted. Waiting up to %s for %d transaction(s) in flight", gracePeriod, len(t.missing()))
+			t.mu.Lock()
+			t.interrupted = true
+			t.mu.Unlock()
+			// stop waiting on the cancelled context, and let the grace period take over from the timeout
+			cancelled = nil
+			dispatched = nil
+			startTimer(gracePeriod)
+		case <-expired:
+			missing := t.missing()
+			if t.isInterrupted() {
+				log.Errorf("Shutdown grace period expired. %d transaction(s) in flight not confirmed", len(missing))
+				return fmt.Errorf("run interrupted. missing asset IDs: %v", missing)
+			}
+			log.Errorf("Timed out after %s waiting for events. %d transaction(s) not confirmed", timeout, len(missing))
+			return fmt.Errorf("timed out waiting for %d event(s). missing asset IDs: %v", len(missing), missing)
+		}
+	}
+}
+
+func (t *txTracker) isInterrupted() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.interrupted
+}
+
+func (t *txTracker) submittedCount() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.submissions
+}
+
+func (t *txTracker) ungeneratedCount() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.ungenerated
+}
+
+func getShutdownGracePeriod() (time.Duration, error) {
+	gracePeriodStr := os.Getenv("SHUTDOWN_GRACE_PERIOD")
+	if gracePeriodStr == "" {
+		return DEFAULT_SHUTDOWN_GRACE_PERIOD, nil
+	}
+	gracePeriod, err := time.ParseDuration(gracePeriodStr)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse SHUTDOWN_GRACE_PERIOD %s as a duration. %v", gracePeriodStr, err)
+	}
+	return gracePeriod, nil
+}
@@ -0,0 +1,328 @@
+package runners
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testDeployment = &deployment{channel: "ch1", chaincode: "cc1", weight: 1, pool: newAssetPool()}
+
+func newTestRequest(assetId string) *txRequest {
+	return &txRequest{
+		deployment: testDeployment,
+		function:   "CreateAsset",
+		identity:   "user1",
+		args:       []string{assetId},
+		assetId:    assetId,
+	}
+}
+
+func isComplete(tracker *txTracker) bool {
+	select {
+	case <-tracker.complete:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestTrackerComplete(t *testing.T) {
+	cases := []struct {
+		name      string
+		workers   int
+		submitted []string
+		confirmed []string
+		done      int
+		complete  bool
+		missing   []string
+	}{
+		{"all confirmed", 1, []string{"a", "b"}, []string{"b", "a"}, 1, true, []string{}},
+		{"still dispatching", 2, []string{"a", "b"}, []string{"a", "b"}, 1, false, []string{}},
+		{"confirmation missing", 1, []string{"a", "b"}, []string{"a"}, 1, false, []string{"b"}},
+		{"event of an unknown asset", 1, []string{"a"}, []string{"z"}, 1, false, []string{"a"}},
+		{"several transactions for the same asset", 1, []string{"a", "a"}, []string{"a"}, 1, false, []string{"a"}},
+		{"each transaction for the same asset confirmed", 1, []string{"a", "a"}, []string{"a", "a"}, 1, true, []string{}},
+		{"nothing submitted", 1, []string{}, []string{}, 1, true, []string{}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			tracker := newTxTracker("load", len(c.submitted), c.workers)
+			for _, assetId := range c.submitted {
+				tracker.submitted(newTestRequest(assetId))
+			}
+			for _, assetId := range c.confirmed {
+				tracker.confirm(assetId)
+			}
+			for i := 0; i < c.done; i++ {
+				tracker.workerDone()
+			}
+			if complete := isComplete(tracker); complete != c.complete {
+				t.Errorf("expected complete to be %v. found: %v", c.complete, complete)
+			}
+			if missing := tracker.missing(); !reflect.DeepEqual(missing, c.missing) {
+				t.Errorf("expected missing %v. found: %v", c.missing, missing)
+			}
+		})
+	}
+}
+
+func TestTrackerConfirmsTheOldestTransaction(t *testing.T) {
+	tracker := newTxTracker("load", 2, 1)
+	first := newTestRequest("a")
+	second := newTestRequest("a")
+	second.retries = 1
+	tracker.submitted(first)
+	tracker.submitted(second)
+	tracker.confirm("a")
+	if pending := tracker.pending["a"]; len(pending) != 1 || pending[0] != second {
+		t.Fatalf("expected the second transaction to be pending. found: %v", pending)
+	}
+	summary := tracker.summary()
+	if summary.confirmed != 1 || summary.recovered != 0 || len(summary.latencies) != 1 {
+		t.Errorf("expected the first transaction to be confirmed. found: %+v", summary)
+	}
+}
+
+func TestTrackerIgnoresQueriesForEvents(t *testing.T) {
+	tracker := newTxTracker("load", 2, 1)
+	query := newTestRequest("a")
+	query.query = true
+	invoke := newTestRequest("a")
+	tracker.submitted(query)
+	tracker.submitted(invoke)
+	tracker.confirm("a")
+	if pending := tracker.pending["a"]; len(pending) != 1 || pending[0] != query {
+		t.Fatalf("expected the event to confirm the invoke, not the query. found: %v", pending)
+	}
+	tracker.completed(query)
+	tracker.workerDone()
+	if !isComplete(tracker) {
+		t.Errorf("expected the phase to be complete")
+	}
+}
+
+func TestTrackerCountsTimeoutsAndGenerationFailures(t *testing.T) {
+	tracker := newTxTracker("load", 4, 1)
+	confirmed := newTestRequest("a")
+	timedOut := newTestRequest("b")
+	tracker.submitted(confirmed)
+	tracker.submitted(timedOut)
+	tracker.confirm("a")
+	tracker.timedOut(timedOut)
+	// the confirmation of a transaction that has timed out is not counted
+	tracker.timedOut(timedOut)
+	tracker.generationFailed(2)
+	tracker.workerDone()
+	if !isComplete(tracker) {
+		t.Fatalf("expected the timeout and the generation failures to count towards the completion")
+	}
+	summary := tracker.summary()
+	if summary.confirmed != 1 || summary.failed != 2 || summary.failures[FAILURE_GENERATION] != 2 {
+		t.Errorf("expected 1 confirmed and 2 generation failures. found: %+v", summary)
+	}
+	if !reflect.DeepEqual(summary.missing, []string{"b"}) {
+		t.Errorf("expected the timed out transaction to be missing. found: %v", summary.missing)
+	}
+}
+
+func setGracePeriod(t *testing.T, gracePeriod string) {
+	previous, set := os.LookupEnv("SHUTDOWN_GRACE_PERIOD")
+	os.Setenv("SHUTDOWN_GRACE_PERIOD", gracePeriod)
+	t.Cleanup(func() {
+		if set {
+			os.Setenv("SHUTDOWN_GRACE_PERIOD", previous)
+		} else {
+			os.Unsetenv("SHUTDOWN_GRACE_PERIOD")
+		}
+	})
+}
+
+func TestWaitForEvents(t *testing.T) {
+	cases := []struct {
+		name string
+		// run while waitForEvents is running, with the channel of the events
+		run     func(tracker *txTracker, events chan string, cancel context.CancelFunc)
+		timeout time.Duration
+		err     string
+	}{
+		{"all confirmed", func(tracker *txTracker, events chan string, cancel context.CancelFunc) {
+			events <- "a"
+			events <- "b"
+			tracker.workerDone()
+		}, time.Second, ""},
+		{"confirmation missing", func(tracker *txTracker, events chan string, cancel context.CancelFunc) {
+			events <- "a"
+			tracker.workerDone()
+		}, 50 * time.Millisecond, "timed out waiting for 1 event(s). missing asset IDs: [b]"},
+		{"timeout started once dispatched", func(tracker *txTracker, events chan string, cancel context.CancelFunc) {
+			// longer than the timeout, while the worker is still dispatching
+			time.Sleep(100 * time.Millisecond)
+			tracker.workerDone()
+			events <- "a"
+			events <- "b"
+		}, 50 * time.Millisecond, ""},
+		{"receipt timed out", func(tracker *txTracker, events chan string, cancel context.CancelFunc) {
+			events <- "a"
+			tracker.mu.Lock()
+			req := tracker.pending["b"][0]
+			tracker.mu.Unlock()
+			tracker.timedOut(req)
+			tracker.workerDone()
+		}, time.Second, "timed out waiting for 1 confirmation(s). missing asset IDs: [b]"},
+		{"generation failed", func(tracker *txTracker, events chan string, cancel context.CancelFunc) {
+			events <- "a"
+			events <- "b"
+			tracker.generationFailed(3)
+			tracker.workerDone()
+		}, time.Second, "failed to generate 3 transaction(s)"},
+		{"interrupted and confirmed within the grace period", func(tracker *txTracker, events chan string, cancel context.CancelFunc) {
+			cancel()
+			tracker.workerDone()
+			events <- "a"
+			events <- "b"
+		}, time.Second, "run interrupted"},
+		{"interrupted and not confirmed within the grace period", func(tracker *txTracker, events chan string, cancel context.CancelFunc) {
+			cancel()
+			tracker.workerDone()
+			events <- "a"
+		}, time.Second, "run interrupted. missing asset IDs: [b]"},
+	}
+	setGracePeriod(t, "50ms")
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			tracker := newTxTracker("load", 2, 1)
+			tracker.started()
+			tracker.submitted(newTestRequest("a"))
+			tracker.submitted(newTestRequest("b"))
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			events := make(chan string)
+			result := make(chan error)
+			go func() {
+				result <- tracker.waitForEvents(ctx, events, c.timeout)
+			}()
+			c.run(tracker, events, cancel)
+
+			var err error
+			select {
+			case err = <-result:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("waitForEvents did not return")
+			}
+			if c.err == "" && err != nil {
+				t.Fatalf("unexpected error. %v", err)
+			}
+			if c.err != "" && (err == nil || !strings.HasPrefix(err.Error(), c.err)) {
+				t.Fatalf("expected %q. found: %v", c.err, err)
+			}
+		})
+	}
+}
+
+func TestTrackerCountsFailures(t *testing.T) {
+	tracker := newTxTracker("load", 3, 1)
+	confirmed := newTestRequest("a")
+	conflicted := newTestRequest("b")
+	rejected := newTestRequest("c")
+	rejected.function = "TransferAsset"
+	for _, req := range []*txRequest{confirmed, conflicted, rejected} {
+		tracker.submitted(req)
+	}
+	tracker.confirm("a")
+	if class := tracker.fail(conflicted, fmt.Errorf("transaction failed. MVCC_READ_CONFLICT")); class != FAILURE_MVCC_CONFLICT {
+		t.Errorf("expected an MVCC read conflict. found: %s", class)
+	}
+	if class := tracker.fail(rejected, fmt.Errorf("[500] Too many in-flight transactions")); class != FAILURE_TOO_MANY_INFLIGHT {
+		t.Errorf("expected too many in-flight transactions. found: %s", class)
+	}
+	tracker.workerDone()
+	if !isComplete(tracker) {
+		t.Fatalf("expected the failures to count towards the completion")
+	}
+	summary := tracker.summary()
+	if summary.confirmed != 1 || summary.failed != 2 || len(summary.missing) != 0 {
+		t.Errorf("expected 1 confirmed and 2 failed. found: %+v", summary)
+	}
+	if summary.failures[FAILURE_MVCC_CONFLICT] != 1 || summary.failures[FAILURE_TOO_MANY_INFLIGHT] != 1 {
+		t.Errorf("expected the failures to be classified. found: %v", summary.failures)
+	}
+	if stats := summary.functions["CreateAsset"]; stats != (txStats{submitted: 2, confirmed: 1, failed: 1}) {
+		t.Errorf("unexpected stats of CreateAsset. found: %+v", stats)
+	}
+	if stats := summary.functions["TransferAsset"]; stats != (txStats{submitted: 1, failed: 1}) {
+		t.Errorf("unexpected stats of TransferAsset. found: %+v", stats)
+	}
+	if stats := summary.channels["ch1"]; stats != (txStats{submitted: 3, confirmed: 1, failed: 2}) {
+		t.Errorf("unexpected stats of channel ch1. found: %+v", stats)
+	}
+}
+
+// the event of a transaction is taken for an older one of the same asset, which then fails
+func TestTrackerReassignsTheConfirmation(t *testing.T) {
+	tracker := newTxTracker("load", 2, 1)
+	first := newTestRequest("a")
+	second := newTestRequest("a")
+	second.identity = "user2"
+	second.retries = 1
+	tracker.submitted(first)
+	tracker.submitted(second)
+	tracker.confirm("a")
+	tracker.fail(first, fmt.Errorf("endorsement failure"))
+	tracker.workerDone()
+	if !isComplete(tracker) {
+		t.Fatalf("expected the event to confirm the transaction still pending")
+	}
+	summary := tracker.summary()
+	if summary.confirmed != 1 || summary.failed != 1 || summary.recovered != 1 || len(summary.missing) != 0 {
+		t.Errorf("expected 1 confirmed after a retry and 1 failed. found: %+v", summary)
+	}
+	if stats := summary.identities["user1"]; stats != (txStats{submitted: 1, failed: 1}) {
+		t.Errorf("expected the transaction of user1 to have failed. found: %+v", stats)
+	}
+	if stats := summary.identities["user2"]; stats != (txStats{submitted: 1, confirmed: 1}) {
+		t.Errorf("expected the transaction of user2 to be confirmed. found: %+v", stats)
+	}
+}
+
+func TestTrackerFailureAfterTheConfirmation(t *testing.T) {
+	tracker := newTxTracker("load", 1, 1)
+	req := newTestRequest("a")
+	tracker.submitted(req)
+	tracker.confirm("a")
+	tracker.fail(req, fmt.Errorf("timed out"))
+	summary := tracker.summary()
+	if summary.confirmed != 1 || summary.failed != 0 {
+		t.Errorf("expected a failure reported after the commit to be ignored. found: %+v", summary)
+	}
+}
+
+func TestClassifyFailure(t *testing.T) {
+	cases := []struct {
+		err   string
+		class failureClass
+	}{
+		{"Transaction processing for endorser [peer0:7051]: MVCC_READ_CONFLICT", FAILURE_MVCC_CONFLICT},
+		{"PHANTOM_READ_CONFLICT", FAILURE_MVCC_CONFLICT},
+		{`[500] {"error":"Too many in-flight transactions"}`, FAILURE_TOO_MANY_INFLIGHT},
+		{"x509: certificate signed by unknown authority", FAILURE_CONNECTION},
+		{"Endorser Client Status Code: (2) CONNECTION_FAILED", FAILURE_CONNECTION},
+		{"dial tcp: connection refused", FAILURE_CONNECTION},
+		{"context deadline exceeded", FAILURE_TIMEOUT},
+		{"request timed out or been cancelled", FAILURE_TIMEOUT},
+		{"ENDORSEMENT_POLICY_FAILURE", FAILURE_ENDORSEMENT},
+		{"Chaincode status Code: (500) UNKNOWN. Description: the asset does not exist", FAILURE_ENDORSEMENT},
+		{"something else", FAILURE_OTHER},
+	}
+	for _, c := range cases {
+		t.Run(c.err, func(t *testing.T) {
+			if class := classifyFailure(fmt.Errorf("%s", c.err)); class != c.class {
+				t.Errorf("expected %s. found: %s", c.class, class)
+			}
+		})
+	}
+}
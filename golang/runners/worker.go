@@ -2,138 +2,312 @@ package runners
 
 import (
 	"context"
-	"crypto/rand"
-	"encoding/base32"
+	"errors"
 	"fmt"
+	mrand "math/rand"
 	"time"
 
+	"github.com/kaleido-io/kaleido-fabric-go/kaleido"
 	log "github.com/sirupsen/logrus"
 )
 
 type FabricClient interface {
 	InitChaincode(channel, chaincodeId string) (string, error)
-	ExecChaincode(channel, chaincodeId, assetId string) (string, error)
+	ExecChaincode(channel, chaincodeId, function string, args []string) (string, error)
+	QueryChaincode(channel, chaincodeId, function string, args []string) (string, error)
 }
 
 type Worker interface {
 	SetClient(FabricClient)
 	IncreaseTxCount()
 	Start()
-	// Track(string)
+}
+
+// receiptClient is implemented by the clients that can confirm a transaction by its receipt
+type receiptClient interface {
+	WaitForReceipt(ctx context.Context, receiptId string, timeout time.Duration) (*kaleido.FabconnectTransactionReceipt, error)
+}
+
+// syncClient is implemented by the clients that can submit a transaction synchronously, and
+// return its receipt once it is committed
+type syncClient interface {
+	ExecChaincodeSync(channel, chaincodeId, function string, args []string) (*kaleido.FabconnectTransactionReceipt, error)
+}
+
+// identityClient submits the transactions signed by one of the identities of the scenario
+type identityClient struct {
+	identity string
+	client   FabricClient
 }
 
 type worker struct {
-	channel      string
-	chaincode    string
-	index        int
-	txCount      int
-	ctx          context.Context
-	eventAssetId chan string
-	client       FabricClient
+	index    int
+	identity string
+	txCount  int
+	ctx      context.Context
+	// done when the phase stops waiting for the transactions to be confirmed
+	confirmCtx context.Context
+	tracker    *txTracker
+	workload   *workload
+	limiter    <-chan time.Time
+	retries    int
+	client     FabricClient
+	// how the transactions are confirmed, and how long to wait for their receipts
+	confirmation   string
+	receiptTimeout time.Duration
 }
 
-func NewWorker(ctx context.Context, channel, ccname string, index int, eventAssetId chan string) Worker {
+func NewWorker(ctx, confirmCtx context.Context, index int, identity string, tracker *txTracker, workload *workload, limiter <-chan time.Time, retries int, confirmation string, receiptTimeout time.Duration) Worker {
 	w := &worker{
-		channel:      channel,
-		chaincode:    ccname,
-		index:        index,
-		eventAssetId: eventAssetId,
-		ctx:          ctx,
+		index:          index,
+		identity:       identity,
+		tracker:        tracker,
+		workload:       workload,
+		limiter:        limiter,
+		retries:        retries,
+		confirmation:   confirmation,
+		receiptTimeout: receiptTimeout,
+		ctx:            ctx,
+		confirmCtx:     confirmCtx,
 	}
 	return w
 }
 
 var TIMEOUT time.Duration = time.Duration(60) * time.Second
+var CONFLICT_RETRY_BACKOFF time.Duration = time.Duration(100) * time.Millisecond
 
 func (w *worker) SetClient(client FabricClient) {
 	w.client = client
 }
 
+// Start sends the transactions allocated to the worker. A worker with no
+// transaction count keeps sending until its context is done
 func (w *worker) Start() {
 	go func() {
+		defer w.tracker.workerDone()
 		// for each tx count, send a transaction
-		for i := 0; i < w.txCount; i++ {
-			newId, err := generateId()
-			if err != nil {
+		for i := 0; w.txCount == 0 || i < w.txCount; i++ {
+			if !w.wait() {
+				log.Infof("[worker:%d] Stopped after sending %d transactions", w.index, i)
 				return
 			}
-			assetId := fmt.Sprintf("asset-%s", newId)
-			log.Infof("[worker:%d] Send transaction %d of %d (%s)", w.index, i+1, w.txCount, assetId)
-			id, err := w.client.ExecChaincode(w.channel, w.chaincode, assetId)
+			req, err := w.workload.next()
 			if err != nil {
-				log.Errorf("[worker:%d] Failed to send transaction %d of %d (%s). %s", w.index, i+1, w.txCount, assetId, err)
+				// the next ones would fail the same way, so give up on the rest of the allocation
+				remaining := 1
+				if w.txCount > 0 {
+					remaining = w.txCount - i
+				}
+				w.tracker.generationFailed(remaining)
+				log.Errorf("[worker:%d] Failed to generate transaction %s, giving up on %d transaction(s) [%s]. %s", w.index, w.progress(i), remaining, FAILURE_GENERATION, err)
+				return
+			}
+			req.identity = w.identity
+			w.tracker.submitted(req)
+			if req.query {
+				w.query(i, req)
 			} else {
-				log.Infof("[worker:%d] Transaction %d of %d (%s) sent. Asset ID: %s", w.index, i+1, w.txCount, assetId, id)
+				w.invoke(i, req)
 			}
 		}
 	}()
 }
 
+// invoke sends the transaction, and sends it again with the same arguments when it
+// is rejected because of an MVCC read conflict, up to the configured number of retries
+func (w *worker) invoke(i int, req *txRequest) {
+	for {
+		log.Infof("[worker:%d] Send transaction %s %s(%s)", w.index, w.progress(i), req.function, req.assetId)
+		var err error
+		if w.confirmation == CONFIRM_SYNC {
+			err = w.invokeSync(i, req)
+		} else {
+			var id string
+			id, err = w.client.ExecChaincode(req.deployment.channel, req.deployment.chaincode, req.function, req.args)
+			if err == nil {
+				log.Infof("[worker:%d] Transaction %s %s(%s) sent. ID: %s", w.index, w.progress(i), req.function, req.assetId, id)
+				if w.confirmation == CONFIRM_RECEIPTS {
+					w.track(i, req, id)
+				}
+			}
+		}
+		if err == nil {
+			return
+		}
+		if classifyFailure(err) == FAILURE_MVCC_CONFLICT {
+			retry := req.retries < w.retries && w.ctx.Err() == nil
+			w.tracker.conflict(req, retry)
+			if retry {
+				log.Warnf("[worker:%d] Transaction %s %s(%s) hit an MVCC read conflict. Retry %d of %d", w.index, w.progress(i), req.function, req.assetId, req.retries, w.retries)
+				conflictBackoff(req)
+				continue
+			}
+		}
+		class := w.tracker.fail(req, err)
+		log.Errorf("[worker:%d] Failed to send transaction %s %s(%s) [%s]. %s", w.index, w.progress(i), req.function, req.assetId, class, err)
+		return
+	}
+}
+
+// invokeSync sends the transaction and waits for the response, like an ordinary REST
+// application would, so the latency is the one of the request. The transaction is
+// committed once the response is returned
+func (w *worker) invokeSync(i int, req *txRequest) error {
+	client, ok := w.client.(syncClient)
+	if !ok {
+		return fmt.Errorf("the client does not support the %s confirmation", CONFIRM_SYNC)
+	}
+	receipt, err := client.ExecChaincodeSync(req.deployment.channel, req.deployment.chaincode, req.function, req.args)
+	if err != nil {
+		return err
+	}
+	log.Infof("[worker:%d] Transaction %s %s(%s) committed in block %d. ID: %s", w.index, w.progress(i), req.function, req.assetId, receipt.BlockNumber, receipt.TransactionId)
+	w.tracker.completed(req)
+	return nil
+}
+
+// query is confirmed as soon as the result is returned, as it does not produce an event
+func (w *worker) query(i int, req *txRequest) {
+	log.Infof("[worker:%d] Send query %s %s(%s)", w.index, w.progress(i), req.function, req.assetId)
+	_, err := w.client.QueryChaincode(req.deployment.channel, req.deployment.chaincode, req.function, req.args)
+	if err != nil {
+		class := w.tracker.fail(req, err)
+		log.Errorf("[worker:%d] Failed to send query %s %s(%s) [%s]. %s", w.index, w.progress(i), req.function, req.assetId, class, err)
+	} else {
+		w.tracker.completed(req)
+		log.Infof("[worker:%d] Query %s %s(%s) completed", w.index, w.progress(i), req.function, req.assetId)
+	}
+}
+
+// wait blocks until the rate limiter allows the next transaction, and
+// returns false if the worker must stop dispatching instead
+func (w *worker) wait() bool {
+	if w.limiter == nil {
+		select {
+		case <-w.ctx.Done():
+			return false
+		default:
+			return true
+		}
+	}
+	select {
+	case <-w.ctx.Done():
+		return false
+	case <-w.limiter:
+		return true
+	}
+}
+
+func (w *worker) progress(i int) string {
+	if w.txCount == 0 {
+		return fmt.Sprintf("%d", i+1)
+	}
+	return fmt.Sprintf("%d of %d", i+1, w.txCount)
+}
+
 func (w *worker) IncreaseTxCount() {
 	w.txCount++
 }
 
-// func (w *worker) Track(receiptId string) {
-// 	ticker := time.NewTicker(1 * time.Second)
-
-// 	go func(id string) {
-// 		ctx, cancel := context.WithTimeout(w.ctx, TIMEOUT)
-// 		defer cancel()
-
-// 		complete := false
-// 		for {
-// 			if complete {
-// 				break
-// 			}
-// 			select {
-// 			case <-ticker.C:
-// 				receipt, err := w.fabconnectClient.GetReceipt(id)
-// 				if err == nil && receipt != nil {
-// 					complete = true
-// 					w.done <- receipt
-// 				}
-// 			case <-ctx.Done():
-// 				complete = true
-// 				w.done <- nil
-// 			}
-// 		}
-// 	}(receiptId)
-// }
-
-func generateId() (string, error) {
-	randomBytes := make([]byte, 32)
-	_, err := rand.Read(randomBytes)
-	if err != nil {
-		return "", err
+// conflictBackoff waits before a transaction is retried after an MVCC read conflict, longer
+// with each retry, and with some jitter so the workers conflicting on the same key do not
+// retry in lock step
+func conflictBackoff(req *txRequest) {
+	time.Sleep(time.Duration(req.retries)*CONFLICT_RETRY_BACKOFF + time.Duration(mrand.Int63n(int64(CONFLICT_RETRY_BACKOFF))))
+}
+
+// track polls the receipt of a transaction in the background, so the worker can keep sending
+// transactions as it does when they are confirmed by the events. A transaction invalidated by
+// an MVCC read conflict is sent again, up to the configured number of retries
+func (w *worker) track(i int, req *txRequest, receiptId string) {
+	client, ok := w.client.(receiptClient)
+	if !ok {
+		w.tracker.fail(req, fmt.Errorf("the client does not support the confirmation by receipts"))
+		return
+	}
+	progress := w.progress(i)
+	go func() {
+		for {
+			receipt, err := client.WaitForReceipt(w.confirmCtx, receiptId, w.receiptTimeout)
+			if err == nil {
+				w.tracker.completed(req)
+				log.Infof("[worker:%d] Transaction %s %s(%s) confirmed by receipt %s", w.index, progress, req.function, req.assetId, receiptId)
+				return
+			}
+			var timeoutErr *kaleido.ReceiptTimeoutError
+			if errors.As(err, &timeoutErr) {
+				// the transaction may still be committed, so it is missing rather than failed
+				w.tracker.timedOut(req)
+				log.Errorf("[worker:%d] Transaction %s %s(%s) not confirmed. %s", w.index, progress, req.function, req.assetId, err)
+				return
+			}
+			if w.confirmCtx.Err() != nil {
+				// the phase has stopped waiting, and reports the transaction as missing
+				return
+			}
+			if receipt != nil && receipt.Status != "" {
+				// the validation code tells an MVCC read conflict from the other failures
+				err = fmt.Errorf("[%s] %v", receipt.Status, err)
+			}
+			if classifyFailure(err) == FAILURE_MVCC_CONFLICT {
+				retry := req.retries < w.retries && w.ctx.Err() == nil
+				w.tracker.conflict(req, retry)
+				if retry {
+					log.Warnf("[worker:%d] Transaction %s %s(%s) hit an MVCC read conflict. Retry %d of %d", w.index, progress, req.function, req.assetId, req.retries, w.retries)
+					conflictBackoff(req)
+					receiptId, err = w.client.ExecChaincode(req.deployment.channel, req.deployment.chaincode, req.function, req.args)
+					if err == nil {
+						log.Infof("[worker:%d] Transaction %s %s(%s) sent again. ID: %s", w.index, progress, req.function, req.assetId, receiptId)
+						continue
+					}
+				}
+			}
+			class := w.tracker.fail(req, err)
+			log.Errorf("[worker:%d] Transaction %s %s(%s) failed [%s]. %s", w.index, progress, req.function, req.assetId, class, err)
+			return
+		}
+	}()
+}
+
+// phaseConfirmation returns how the transactions of a phase are confirmed. A transaction
+// invalidated by an MVCC read conflict never produces an event, so the phases updating hot
+// keys through FabConnect are confirmed by the receipts, which have the validation code
+func phaseConfirmation(scenario *Scenario, phase *PhaseSpec) string {
+	confirmation := scenario.Target.Fabconnect.Confirmation
+	if scenario.Target.Type == TARGET_FABCONNECT && confirmation == CONFIRM_EVENTS && phase.HotKeys != nil {
+		return CONFIRM_RECEIPTS
 	}
-	return base32.HexEncoding.EncodeToString(randomBytes)[:10], nil
+	return confirmation
 }
 
-func allocateWorkers(ctx context.Context, channel, chaincode string, txCount, numWorkers int, client FabricClient) (chan string, []Worker) {
-	eventAssetIdsChan := make(chan string)
+// allocateWorkers creates the workers of a phase, each signing as one of the identities,
+// assigned in turn or at random. The workers stop sending when ctx is done, and stop
+// confirming the transactions they have sent when confirmCtx is done
+func allocateWorkers(ctx, confirmCtx context.Context, scenario *Scenario, phase *PhaseSpec, deployments []*deployment, limiter <-chan time.Time, clients []identityClient) (*txTracker, []Worker) {
+	tracker := newTxTracker(phase.Name, phase.TxCount, phase.Workers)
+	confirmation := phaseConfirmation(scenario, phase)
+	if confirmation != scenario.Target.Fabconnect.Confirmation {
+		log.Infof("Confirming the transactions of phase %s by %s, to detect the MVCC read conflicts", phase.Name, confirmation)
+		tracker.ignoreEvents = true
+	}
+	workload := newWorkload(phase, deployments)
 	sequence := 0
-	workers := make([]Worker, numWorkers)
-	for ; sequence < numWorkers; sequence++ {
-		worker := NewWorker(ctx, channel, chaincode, sequence, eventAssetIdsChan)
-		worker.SetClient(client)
+	workers := make([]Worker, phase.Workers)
+	for ; sequence < phase.Workers; sequence++ {
+		signer := clients[sequence%len(clients)]
+		if scenario.IdentityAssignment == ASSIGN_RANDOM {
+			signer = clients[mrand.Intn(len(clients))]
+		}
+		fabconnect := &scenario.Target.Fabconnect
+		worker := NewWorker(ctx, confirmCtx, sequence, signer.identity, tracker, workload, limiter, phase.ConflictRetries, confirmation, fabconnect.receiptTimeout)
+		worker.SetClient(signer.client)
 		workers[sequence] = worker
 	}
 
-	for index := 0; index < txCount; index++ {
-		workerIdx := index % numWorkers
+	for index := 0; index < phase.TxCount; index++ {
+		workerIdx := index % phase.Workers
 		w := workers[workerIdx]
 		w.IncreaseTxCount()
 	}
-	return eventAssetIdsChan, workers
-}
-
-func printFinalReport(txCount, numWorkers, eventBatchSize int, startTime time.Time) {
-	fmt.Println("\n\nFinal Report")
-	fmt.Println("  - Configuration:")
-	fmt.Printf("    * total transactions: %d\n", txCount)
-	fmt.Printf("    * workers count: %d\n", numWorkers)
-	fmt.Printf("    * event batch size: %d\n", eventBatchSize)
-	elapsed := time.Since(startTime)
-	fmt.Printf("  - Total program runtime: %s\n", elapsed)
-	fmt.Printf("  - TPS: %f\n", float64(txCount)/elapsed.Seconds())
+	return tracker, workers
 }
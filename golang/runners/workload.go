@@ -0,0 +1,337 @@
+package runners
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"fmt"
+	mrand "math/rand"
+	"regexp"
+	"sync"
+	"time"
+)
+
+const (
+	FUNCTION_INVOKE = "invoke"
+	FUNCTION_QUERY  = "query"
+)
+
+// argument templates look like ${generator} or ${generator:param}, and can be
+// embedded in a literal string, such as "owner-${newAssetId}"
+var argTemplateRegex = regexp.MustCompile(`\$\{([a-zA-Z]+)(?::([^}]*))?\}`)
+
+type argGenerator func(wl *workload, req *txRequest, param string) (string, error)
+
+var argGenerators = map[string]argGenerator{
+	"newAssetId": func(wl *workload, req *txRequest, param string) (string, error) {
+		newId, err := generateId()
+		if err != nil {
+			return "", err
+		}
+		assetId := fmt.Sprintf("asset-%s", newId)
+		req.createdAssets = append(req.createdAssets, assetId)
+		return assetId, nil
+	},
+	"existingAssetId": func(wl *workload, req *txRequest, param string) (string, error) {
+		assetId, ok := req.deployment.pool.random()
+		if !ok {
+			return "", fmt.Errorf("no asset has been created in this run yet")
+		}
+		return assetId, nil
+	},
+	"hotAssetId": func(wl *workload, req *txRequest, param string) (string, error) {
+		assetId, ok := req.deployment.pool.at(wl.hotKeys.next())
+		if !ok {
+			return "", fmt.Errorf("no asset has been created in this run yet")
+		}
+		return assetId, nil
+	},
+	"randomString": generateRandomString,
+	"sequence":     generateSequence,
+	"uuid":         generateUUIDArg,
+	"fileValue":    generateFileValue,
+	"json":         generateJSON,
+}
+
+// the generators that pick an asset from the pool, so need an asset to have been created
+var poolGenerators = []string{"existingAssetId", "hotAssetId"}
+
+// functionPresets are the functions of the asset_transfer chaincode, so a scenario
+// can list them by name without the type and args
+var functionPresets = map[string]FunctionSpec{
+	"CreateAsset": {
+		Name: "CreateAsset",
+		Type: FUNCTION_INVOKE,
+		Args: []string{"${newAssetId}", "yellow", "10", "Tom", "1300"},
+	},
+	"ReadAsset": {
+		Name: "ReadAsset",
+		Type: FUNCTION_QUERY,
+		Args: []string{"${existingAssetId}"},
+	},
+	"UpdateAsset": {
+		Name: "UpdateAsset",
+		Type: FUNCTION_INVOKE,
+		Args: []string{"${existingAssetId}", "blue", "15", "Tom", "1500"},
+	},
+	"TransferAsset": {
+		Name: "TransferAsset",
+		Type: FUNCTION_INVOKE,
+		Args: []string{"${existingAssetId}", "Jerry"},
+	},
+}
+
+// txRequest is a transaction generated by the workload. The first argument is the
+// asset ID used to match the transaction with its chaincode event
+type txRequest struct {
+	deployment    *deployment
+	function      string
+	identity      string
+	query         bool
+	args          []string
+	assetId       string
+	createdAssets []string
+	retries       int
+	payloadSize   int
+	sent          time.Time
+}
+
+// deployment is a chaincode on a channel the transactions are sent to, with its own pool
+// of assets, as an asset can only be referenced on the chaincode and channel it was created on
+type deployment struct {
+	channel   string
+	chaincode string
+	weight    int
+	pool      *assetPool
+}
+
+func newDeployments(specs []DeploymentSpec) []*deployment {
+	deployments := make([]*deployment, len(specs))
+	for i, spec := range specs {
+		deployments[i] = &deployment{
+			channel:   spec.Channel,
+			chaincode: spec.Chaincode,
+			weight:    spec.weight(),
+			pool:      newAssetPool(),
+		}
+	}
+	return deployments
+}
+
+// assetPool holds the asset IDs created during the run, that can be referenced
+// by the transactions of the following phases or the rest of the current one
+type assetPool struct {
+	mu     sync.RWMutex
+	assets []string
+}
+
+func newAssetPool() *assetPool {
+	return &assetPool{
+		assets: []string{},
+	}
+}
+
+func (p *assetPool) add(assetIds ...string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.assets = append(p.assets, assetIds...)
+}
+
+func (p *assetPool) random() (string, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if len(p.assets) == 0 {
+		return "", false
+	}
+	return p.assets[mrand.Intn(len(p.assets))], true
+}
+
+// at returns the asset created at the given position in the run. If fewer
+// assets have been created, the position wraps around
+func (p *assetPool) at(index int) (string, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if len(p.assets) == 0 {
+		return "", false
+	}
+	return p.assets[index%len(p.assets)], true
+}
+
+func (p *assetPool) size() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return len(p.assets)
+}
+
+// hotKeySelector picks the position of a hot key in the asset pool with a Zipf
+// distribution, so the first keys are updated much more often than the last ones
+type hotKeySelector struct {
+	mu   sync.Mutex
+	zipf *mrand.Zipf
+}
+
+func newHotKeySelector(spec *HotKeySpec) *hotKeySelector {
+	r := mrand.New(mrand.NewSource(time.Now().UnixNano()))
+	return &hotKeySelector{
+		zipf: mrand.NewZipf(r, spec.Skew, 1, uint64(spec.Count-1)),
+	}
+}
+
+func (h *hotKeySelector) next() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return int(h.zipf.Uint64())
+}
+
+type workload struct {
+	// the last number of the ${sequence} generator, first so it is 64-bit aligned for the atomic operations
+	sequence  int64
+	functions []FunctionSpec
+	// the functions in the mix that can run before any asset has been created
+	standalone  []FunctionSpec
+	deployments []*deployment
+	hotKeys     *hotKeySelector
+}
+
+func newWorkload(phase *PhaseSpec, deployments []*deployment) *workload {
+	wl := &workload{
+		functions:   phase.Functions,
+		standalone:  []FunctionSpec{},
+		deployments: deployments,
+	}
+	if phase.HotKeys != nil {
+		wl.hotKeys = newHotKeySelector(phase.HotKeys)
+	}
+	for _, f := range phase.Functions {
+		if f.weight() > 0 && !usesGenerator(f, poolGenerators...) {
+			wl.standalone = append(wl.standalone, f)
+		}
+	}
+	return wl
+}
+
+// next picks a deployment and a function by weight and generates its arguments. Until an
+// asset has been created on the deployment, the functions that reference an existing asset
+// are left out
+func (wl *workload) next() (*txRequest, error) {
+	target := pickDeployment(wl.deployments)
+	candidates := wl.functions
+	if target.pool.size() == 0 {
+		if len(wl.standalone) == 0 {
+			return nil, fmt.Errorf("all the functions in the mix reference an existing asset, and no asset has been created on chaincode %s of channel %s in this run yet", target.chaincode, target.channel)
+		}
+		candidates = wl.standalone
+	}
+	return wl.generate(target, pickByWeight(candidates))
+}
+
+// sentinel generates a transaction to a deployment, of the first invoke function in the mix
+// that does not reference an existing asset, as its event can be told from any other
+func (wl *workload) sentinel(target *deployment) (*txRequest, error) {
+	for _, function := range wl.standalone {
+		if function.Type == FUNCTION_INVOKE && len(function.Args) > 0 {
+			return wl.generate(target, function)
+		}
+	}
+	return nil, fmt.Errorf("no function in the mix creates a transaction with an asset ID, without referencing an existing asset")
+}
+
+func (wl *workload) generate(target *deployment, function FunctionSpec) (*txRequest, error) {
+	req := &txRequest{
+		deployment: target,
+		function:   function.Name,
+		query:      function.Type == FUNCTION_QUERY,
+		args:       make([]string, len(function.Args)),
+	}
+	for i, arg := range function.Args {
+		resolved, err := wl.resolveArg(req, arg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate argument %d for function %s. %v", i+1, function.Name, err)
+		}
+		req.args[i] = resolved
+		req.payloadSize += len(resolved)
+	}
+	if len(req.args) > 0 {
+		req.assetId = req.args[0]
+	}
+	return req, nil
+}
+
+func pickByWeight(functions []FunctionSpec) FunctionSpec {
+	totalWeight := 0
+	for _, f := range functions {
+		totalWeight += f.weight()
+	}
+	pick := mrand.Intn(totalWeight)
+	for _, f := range functions {
+		if pick < f.weight() {
+			return f
+		}
+		pick -= f.weight()
+	}
+	return functions[len(functions)-1]
+}
+
+func pickDeployment(deployments []*deployment) *deployment {
+	totalWeight := 0
+	for _, d := range deployments {
+		totalWeight += d.weight
+	}
+	pick := mrand.Intn(totalWeight)
+	for _, d := range deployments {
+		if pick < d.weight {
+			return d
+		}
+		pick -= d.weight
+	}
+	return deployments[len(deployments)-1]
+}
+
+func (wl *workload) resolveArg(req *txRequest, arg string) (string, error) {
+	var genErr error
+	resolved := argTemplateRegex.ReplaceAllStringFunc(arg, func(template string) string {
+		match := argTemplateRegex.FindStringSubmatch(template)
+		value, err := argGenerators[match[1]](wl, req, match[2])
+		if err != nil && genErr == nil {
+			genErr = err
+		}
+		return value
+	})
+	return resolved, genErr
+}
+
+func usesGenerator(f FunctionSpec, generators ...string) bool {
+	for _, arg := range f.Args {
+		for _, match := range argTemplateRegex.FindAllStringSubmatch(arg, -1) {
+			for _, generator := range generators {
+				if match[1] == generator {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func validateArg(arg string) error {
+	for _, match := range argTemplateRegex.FindAllStringSubmatch(arg, -1) {
+		if _, ok := argGenerators[match[1]]; !ok {
+			return fmt.Errorf("unknown argument generator %q in %s", match[1], arg)
+		}
+		if validate, ok := argValidators[match[1]]; ok {
+			err := validate(match[2])
+			if err != nil {
+				return fmt.Errorf("invalid parameter for argument generator %q in %s. %v", match[1], arg, err)
+			}
+		}
+	}
+	return nil
+}
+
+func generateId() (string, error) {
+	randomBytes := make([]byte, 32)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+	return base32.HexEncoding.EncodeToString(randomBytes)[:10], nil
+}
@@ -0,0 +1,102 @@
+package runners
+
+import (
+	"testing"
+)
+
+func TestPickByWeight(t *testing.T) {
+	cases := []struct {
+		name      string
+		functions []FunctionSpec
+		picked    map[string]bool
+	}{
+		{"default weights", []FunctionSpec{{Name: "CreateAsset"}, {Name: "ReadAsset"}}, map[string]bool{"CreateAsset": true, "ReadAsset": true}},
+		{"zero weight first", []FunctionSpec{{Name: "CreateAsset", Weight: weight(0)}, {Name: "ReadAsset"}}, map[string]bool{"ReadAsset": true}},
+		{"zero weight last", []FunctionSpec{{Name: "CreateAsset", Weight: weight(3)}, {Name: "ReadAsset", Weight: weight(0)}}, map[string]bool{"CreateAsset": true}},
+		{"zero weight in between", []FunctionSpec{{Name: "CreateAsset"}, {Name: "ReadAsset", Weight: weight(0)}, {Name: "UpdateAsset", Weight: weight(2)}}, map[string]bool{"CreateAsset": true, "UpdateAsset": true}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			found := map[string]bool{}
+			for i := 0; i < 1000; i++ {
+				found[pickByWeight(c.functions).Name] = true
+			}
+			for name := range found {
+				if !c.picked[name] {
+					t.Errorf("unexpected pick of function %s", name)
+				}
+			}
+			for name := range c.picked {
+				if !found[name] {
+					t.Errorf("expected function %s to be picked", name)
+				}
+			}
+		})
+	}
+}
+
+func TestPickDeployment(t *testing.T) {
+	deployments := newDeployments([]DeploymentSpec{
+		{Channel: "ch1", Chaincode: "cc1", Weight: weight(0)},
+		{Channel: "ch1", Chaincode: "cc2"},
+		{Channel: "ch2", Chaincode: "cc1", Weight: weight(0)},
+	})
+	for i := 0; i < 1000; i++ {
+		if d := pickDeployment(deployments); d != deployments[1] {
+			t.Fatalf("unexpected pick of chaincode %s on channel %s", d.chaincode, d.channel)
+		}
+	}
+}
+
+func TestWorkloadStandaloneFunctions(t *testing.T) {
+	phase := &PhaseSpec{
+		Functions: []FunctionSpec{
+			functionPresets["CreateAsset"],
+			functionPresets["ReadAsset"],
+			{Name: "CreateDisabled", Type: FUNCTION_INVOKE, Args: []string{"${newAssetId}"}, Weight: weight(0)},
+			{Name: "Ping", Type: FUNCTION_QUERY},
+		},
+	}
+	wl := newWorkload(phase, newDeployments([]DeploymentSpec{{Channel: "ch1", Chaincode: "cc1"}}))
+	names := []string{}
+	for _, f := range wl.standalone {
+		names = append(names, f.Name)
+	}
+	if len(names) != 2 || names[0] != "CreateAsset" || names[1] != "Ping" {
+		t.Errorf("expected CreateAsset and Ping to run before any asset is created. found: %v", names)
+	}
+	// until an asset is created, only the standalone functions are picked
+	for i := 0; i < 100; i++ {
+		req, err := wl.next()
+		if err != nil {
+			t.Fatalf("unexpected error. %v", err)
+		}
+		if req.function != "CreateAsset" && req.function != "Ping" {
+			t.Fatalf("unexpected function %s before any asset is created", req.function)
+		}
+	}
+}
+
+func TestWorkloadWithoutStandaloneFunctions(t *testing.T) {
+	phase := &PhaseSpec{
+		Functions: []FunctionSpec{
+			functionPresets["ReadAsset"],
+			{Name: "CreateDisabled", Type: FUNCTION_INVOKE, Args: []string{"${newAssetId}"}, Weight: weight(0)},
+		},
+	}
+	wl := newWorkload(phase, newDeployments([]DeploymentSpec{{Channel: "ch1", Chaincode: "cc1"}}))
+	if _, err := wl.next(); err == nil {
+		t.Errorf("expected an error when no function can run before an asset is created")
+	}
+	if _, err := wl.sentinel(wl.deployments[0]); err == nil {
+		t.Errorf("expected an error when no function can be a sentinel")
+	}
+	wl.deployments[0].pool.add("asset-1")
+	req, err := wl.next()
+	if err != nil {
+		t.Fatalf("unexpected error. %v", err)
+	}
+	if req.function != "ReadAsset" || req.assetId != "asset-1" {
+		t.Errorf("expected ReadAsset of asset-1. found: %s of %s", req.function, req.assetId)
+	}
+}